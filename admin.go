@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Live introspection. The Admin service returns a snapshot of a node: its view
+// of the cluster, how far it executed, the instances still in flight, its
+// connections, log and queues. `pbft status` asks every node in cluster.conf
+// and prints them side by side, marking the rows where replicas disagree.
+
+const RPCAdminStatus = "Admin.Status"
+
+type AdminService struct {
+	p *PBFT
+}
+
+type StatusArgs struct{}
+
+// InstanceStatus is a sequence number that has not executed yet.
+type InstanceStatus struct {
+	Seq      int
+	Phase    string // pre-prepared, prepared, committed, or voting (no PrePrepare yet)
+	Prepares int
+	Commits  int
+}
+
+type StatusReply struct {
+	NodeID           int
+	Role             string
+	Protocol         string
+	View             int
+	Primary          int
+	Members          []int
+	LastExecuted     int
+	StableCheckpoint int
+	LowWaterMark     int
+	HighWaterMark    int
+	StateDigest      string
+	Instances        []InstanceStatus // in sequence order
+	Peers            []PeerStatus
+	WALEntries       int
+	WALBytes         int64
+	RequestQueue     int // client requests waiting to be batched
+	BatchesInFlight  int
+	PendingReplies   int // batches whose clients wait for f+1 replies
+	VerifyQueue      int // signatures waiting for a verification worker
+}
+
+func (s *AdminService) Status(args *StatusArgs, reply *StatusReply) error {
+	p := s.p
+	p.mu.RLock()
+	reply.NodeID = p.id
+	reply.Role = RoleReplica
+	if p.learner {
+		reply.Role = RoleLearner
+	}
+	reply.Protocol = p.protocol
+	reply.View = p.view
+	reply.Primary = p.primaryID()
+	reply.Members = append([]int(nil), p.replicas().members...)
+	reply.LastExecuted = p.lastExecuted
+	reply.StableCheckpoint = p.stableCheckpoint
+	reply.LowWaterMark = p.stableCheckpoint
+	reply.HighWaterMark = p.stableCheckpoint + LOG_WINDOW
+	reply.StateDigest = p.stateDigestLocked()
+	for seq, state := range p.reqState {
+		if seq > p.lastExecuted {
+			reply.Instances = append(reply.Instances, instanceStatus(seq, state))
+		}
+	}
+	reply.WALEntries, reply.WALBytes, _ = p.storage.Size()
+	reply.BatchesInFlight = p.inFlight
+	reply.PendingReplies = len(p.pendingResponses)
+	p.mu.RUnlock()
+
+	sort.Slice(reply.Instances, func(i, j int) bool { return reply.Instances[i].Seq < reply.Instances[j].Seq })
+	reply.Peers = p.conns.Status()
+	reply.RequestQueue = len(p.ReqCh)
+	if p.verifier != nil {
+		reply.VerifyQueue = len(p.verifier.jobs)
+	}
+	return nil
+}
+
+func instanceStatus(seq int, state *RequestState) InstanceStatus {
+	st := InstanceStatus{Seq: seq, Prepares: len(state.PrepareMsgs), Commits: len(state.CommitMsgs)}
+	switch {
+	case state.Committed:
+		st.Phase = "committed"
+	case state.Prepared:
+		st.Phase = "prepared"
+	case state.PrePrepared:
+		st.Phase = "pre-prepared"
+	default:
+		st.Phase = "voting"
+	}
+	return st
+}
+
+// statusCommand queries every node in confPath and prints a combined table.
+func statusCommand(confPath string, as int, instances bool) error {
+	peers := parseConfig(confPath)
+	ids := make([]int, 0, len(peers))
+	for id := range peers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	replies := make(map[int]*StatusReply)
+	errs := make(map[int]error)
+	for _, id := range ids {
+		client, err := dialNode(confPath, id, as)
+		if err != nil {
+			errs[id] = err
+			continue
+		}
+		reply := &StatusReply{}
+		err = client.Call(RPCAdminStatus, &StatusArgs{}, reply)
+		client.Close()
+		if err != nil {
+			errs[id] = err
+			continue
+		}
+		replies[id] = reply
+	}
+	writeStatus(os.Stdout, ids, replies, errs, instances)
+	if len(errs) > 0 {
+		return fmt.Errorf("%d node(s) failed", len(errs))
+	}
+	return nil
+}
+
+// statusRow is one line of the status table.
+type statusRow struct {
+	name  string
+	value func(r *StatusReply) string
+	// key groups the nodes whose values must agree; nil means the row is
+	// informational. The state digest only has to agree at the same sequence
+	// number, so it is keyed by it.
+	key func(r *StatusReply) string
+}
+
+var sameForAll = func(r *StatusReply) string { return "" }
+
+var statusRows = []statusRow{
+	{"role", func(r *StatusReply) string { return r.Role }, nil},
+	{"protocol", func(r *StatusReply) string { return r.Protocol }, sameForAll},
+	{"view", func(r *StatusReply) string { return strconv.Itoa(r.View) }, sameForAll},
+	{"primary", func(r *StatusReply) string { return strconv.Itoa(r.Primary) }, sameForAll},
+	{"members", func(r *StatusReply) string { return joinInts(r.Members) }, sameForAll},
+	{"last executed", func(r *StatusReply) string { return strconv.Itoa(r.LastExecuted) }, nil},
+	{"stable checkpoint", func(r *StatusReply) string { return strconv.Itoa(r.StableCheckpoint) }, nil},
+	{"water marks", func(r *StatusReply) string { return fmt.Sprintf("%d-%d", r.LowWaterMark, r.HighWaterMark) }, nil},
+	{"state digest", func(r *StatusReply) string { return shortDigest(r.StateDigest) }, func(r *StatusReply) string { return strconv.Itoa(r.LastExecuted) }},
+	{"in flight", func(r *StatusReply) string { return summarizeInstances(r.Instances) }, nil},
+	{"peers up", func(r *StatusReply) string { return summarizePeers(r.Peers) }, nil},
+	{"wal", func(r *StatusReply) string { return fmt.Sprintf("%d/%s", r.WALEntries, formatBytes(r.WALBytes)) }, nil},
+	{"request queue", func(r *StatusReply) string { return strconv.Itoa(r.RequestQueue) }, nil},
+	{"batches in flight", func(r *StatusReply) string { return strconv.Itoa(r.BatchesInFlight) }, nil},
+	{"pending replies", func(r *StatusReply) string { return strconv.Itoa(r.PendingReplies) }, nil},
+	{"verify queue", func(r *StatusReply) string { return strconv.Itoa(r.VerifyQueue) }, nil},
+}
+
+// writeStatus prints one column per node. A row starts with "!" when replicas
+// that should agree on it do not; learners are left out of the comparison.
+func writeStatus(w io.Writer, ids []int, replies map[int]*StatusReply, errs map[int]error, instances bool) {
+	header := []string{""}
+	for _, id := range ids {
+		header = append(header, fmt.Sprintf("node %d", id))
+	}
+	table := [][]string{header}
+	diverged := []bool{false}
+	for _, row := range statusRows {
+		line := []string{row.name}
+		groups := make(map[string]map[string]bool)
+		for _, id := range ids {
+			r, ok := replies[id]
+			if !ok {
+				line = append(line, "-")
+				continue
+			}
+			v := row.value(r)
+			line = append(line, v)
+			if row.key != nil && r.Role == RoleReplica {
+				k := row.key(r)
+				if groups[k] == nil {
+					groups[k] = make(map[string]bool)
+				}
+				groups[k][v] = true
+			}
+		}
+		differs := false
+		for _, values := range groups {
+			differs = differs || len(values) > 1
+		}
+		table = append(table, line)
+		diverged = append(diverged, differs)
+	}
+
+	widths := make([]int, len(header))
+	for _, line := range table {
+		for i, cell := range line {
+			widths[i] = max(widths[i], len(cell))
+		}
+	}
+	anyDiverged := false
+	for i, line := range table {
+		mark := " "
+		if diverged[i] {
+			mark = "!"
+			anyDiverged = true
+		}
+		cells := make([]string, len(line))
+		for j, cell := range line {
+			cells[j] = fmt.Sprintf("%-*s", widths[j], cell)
+		}
+		fmt.Fprintf(w, "%s %s\n", mark, strings.TrimRight(strings.Join(cells, "  "), " "))
+	}
+
+	// Then what a column cannot show
+	var notes []string
+	if anyDiverged {
+		notes = append(notes, "! replicas disagree")
+	}
+	for _, id := range ids {
+		if err, ok := errs[id]; ok {
+			notes = append(notes, fmt.Sprintf("node %d: unreachable: %v", id, err))
+			continue
+		}
+		for _, peer := range replies[id].Peers {
+			if !peer.Up {
+				notes = append(notes, fmt.Sprintf("node %d: peer %d down since %s (%d failures): %s",
+					id, peer.ID, peer.Since.Format("15:04:05"), peer.Failures, peer.LastError))
+			}
+		}
+	}
+	if len(notes) > 0 {
+		fmt.Fprintf(w, "\n%s\n", strings.Join(notes, "\n"))
+	}
+	for _, id := range ids {
+		r, ok := replies[id]
+		if ok && instances && len(r.Instances) > 0 {
+			fmt.Fprintf(w, "\nnode %d in flight:\n", id)
+			for _, inst := range r.Instances {
+				fmt.Fprintf(w, "  seq %-8d %-13s prepares %d commits %d\n", inst.Seq, inst.Phase, inst.Prepares, inst.Commits)
+			}
+		}
+	}
+}
+
+// summarizeInstances counts in-flight instances per phase.
+func summarizeInstances(instances []InstanceStatus) string {
+	if len(instances) == 0 {
+		return "0"
+	}
+	counts := make(map[string]int)
+	for _, inst := range instances {
+		counts[inst.Phase]++
+	}
+	var parts []string
+	for _, phase := range []string{"voting", "pre-prepared", "prepared", "committed"} {
+		if counts[phase] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[phase], phase))
+		}
+	}
+	return fmt.Sprintf("%d (%s)", len(instances), strings.Join(parts, ", "))
+}
+
+func summarizePeers(peers []PeerStatus) string {
+	up := 0
+	for _, peer := range peers {
+		if peer.Up {
+			up++
+		}
+	}
+	return fmt.Sprintf("%d/%d", up, len(peers))
+}
+
+func joinInts(xs []int) string {
+	parts := make([]string, len(xs))
+	for i, x := range xs {
+		parts[i] = strconv.Itoa(x)
+	}
+	return strings.Join(parts, ",")
+}
+
+func shortDigest(digest string) string {
+	if len(digest) > 12 {
+		return digest[:12]
+	}
+	return digest
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStatusDivergence(t *testing.T) {
+	replica := func(view, executed int, digest string) *StatusReply {
+		return &StatusReply{Role: RoleReplica, Protocol: ProtocolPBFT, View: view, Members: []int{1, 2, 3, 4}, LastExecuted: executed, StateDigest: digest}
+	}
+	replies := map[int]*StatusReply{
+		1: replica(0, 130, "aaaa"),
+		2: replica(0, 130, "aaaa"),
+		3: replica(0, 128, "bbbb"), // behind, so its digest is not compared
+		5: {Role: RoleLearner, Protocol: ProtocolPBFT, View: 3, LastExecuted: 130, StateDigest: "cccc"},
+	}
+	errs := map[int]error{4: errors.New("connection refused")}
+	row := func(out, name string) string {
+		for _, line := range strings.Split(out, "\n") {
+			if len(line) > 2 && strings.HasPrefix(line[2:], name+"  ") {
+				return line
+			}
+		}
+		t.Fatalf("no %q row:\n%s", name, out)
+		return ""
+	}
+
+	var buf bytes.Buffer
+	writeStatus(&buf, []int{1, 2, 3, 4, 5}, replies, errs, false)
+	out := buf.String()
+	for _, name := range []string{"view", "state digest", "last executed"} {
+		if strings.HasPrefix(row(out, name), "!") {
+			t.Errorf("%s marked as diverged:\n%s", name, out)
+		}
+	}
+	if !strings.Contains(out, "node 4: unreachable: connection refused") {
+		t.Errorf("unreachable node not reported:\n%s", out)
+	}
+
+	buf.Reset()
+	replies[2] = replica(1, 130, "dddd")
+	writeStatus(&buf, []int{1, 2, 3, 4, 5}, replies, errs, false)
+	out = buf.String()
+	for _, name := range []string{"view", "state digest"} {
+		if !strings.HasPrefix(row(out, name), "!") {
+			t.Errorf("%s not marked as diverged:\n%s", name, out)
+		}
+	}
+	if !strings.Contains(out, "! replicas disagree") {
+		t.Errorf("divergence not reported:\n%s", out)
+	}
+}
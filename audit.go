@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+)
+
+// Audit trail. With --audit every replica appends, for each batch it executes,
+// the batch and the 2f+1 signed Commits that committed it: the Commit messages
+// with their digestCommit payloads, or the shares of the commit quorum
+// certificate with --crypto multisig. `pbft audit export` merges the files of
+// any number of nodes into one bundle and `pbft audit verify` checks it against
+// the public keys in cluster.conf, without contacting the cluster (see
+// audit_bundle.go).
+//
+// Only signatures convince a third party: a MAC authenticator is checked with
+// keys the auditor does not have, so --audit needs ed25519 or multisig.
+
+const (
+	AUDIT_BUFFER         = 4096 // records waiting to be written before execution blocks
+	AUDIT_FLUSH_INTERVAL = 100 * time.Millisecond
+)
+
+// AuditVote is one replica's signed vote to commit a batch.
+type AuditVote struct {
+	NodeID    int    `json:"node"`
+	Payload   []byte `json:"payload"` // digestCommit, or digestVote for a quorum certificate share
+	Signature []byte `json:"signature"`
+}
+
+// AuditRecord proves that Batch committed at Seq.
+type AuditRecord struct {
+	Seq     int         `json:"seq"`
+	View    int         `json:"view"`
+	Digest  string      `json:"digest"`
+	Batch   []byte      `json:"batch"`
+	Commits []AuditVote `json:"commits"` // in node order
+}
+
+type auditor struct {
+	records chan AuditRecord
+	logging *logging
+}
+
+// checkAuditable rejects configurations whose commits cannot be audited.
+func (p *PBFT) checkAuditable() error {
+	switch {
+	case p.cryptoType == CryptoMAC:
+		return fmt.Errorf("--audit needs signatures; MACs cannot be checked by an auditor")
+	case p.protocol == ProtocolHotStuff:
+		return fmt.Errorf("--audit is not supported with --protocol hotstuff")
+	case p.speculative:
+		return fmt.Errorf("--audit is not supported with --speculative")
+	case p.learner:
+		return fmt.Errorf("learners see no Commits to audit")
+	}
+	return nil
+}
+
+// newAuditor appends records to path in the background. Unlike a trace, the
+// file survives restarts; a record torn by a crash is cut off first.
+func newAuditor(path string, logging *logging) (*auditor, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err == nil && len(data) > 0 && data[len(data)-1] != '\n' {
+		err = f.Truncate(int64(bytes.LastIndexByte(data, '\n') + 1))
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a := &auditor{records: make(chan AuditRecord, AUDIT_BUFFER), logging: logging}
+	go a.run(f)
+	return a, nil
+}
+
+// run writes records as they come and syncs them every AUDIT_FLUSH_INTERVAL.
+func (a *auditor) run(f *os.File) {
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	ticker := time.NewTicker(AUDIT_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	dirty := false
+	for {
+		select {
+		case rec := <-a.records:
+			if err := enc.Encode(rec); err != nil {
+				a.logging.log(LogExec, slog.LevelError, "Failed to write audit record", "seq", rec.Seq, "err", err)
+			}
+			dirty = true
+		case <-ticker.C:
+			if !dirty {
+				continue
+			}
+			if err := w.Flush(); err != nil {
+				a.logging.log(LogExec, slog.LevelError, "Failed to write audit trail", "err", err)
+			} else if err := f.Sync(); err != nil {
+				a.logging.log(LogExec, slog.LevelError, "Failed to sync audit trail", "err", err)
+			}
+			dirty = false
+		}
+	}
+}
+
+// auditLocked appends seq to the audit trail once it has executed here and
+// enough Commits for it are at hand. Our own Commit is signed outside the lock
+// and may come after the execution, so this also runs whenever a Commit is
+// stored.
+func (p *PBFT) auditLocked(seq int, state *RequestState) {
+	if p.audit == nil || state.Audited || seq > p.lastExecuted || state.PrePrepareMsg == nil {
+		return
+	}
+	pp := state.PrePrepareMsg
+	rec := AuditRecord{Seq: seq, View: pp.View, Digest: pp.Digest, Batch: p.batchLocked(pp)}
+	if qc := state.CommitQC; qc != nil && qc.View == pp.View && qc.Digest == pp.Digest {
+		payload := digestVote(PhaseCommit, qc.View, seq, qc.Digest)
+		for i, id := range qc.Signers {
+			rec.Commits = append(rec.Commits, AuditVote{NodeID: id, Payload: payload, Signature: qc.Shares[i]})
+		}
+	} else {
+		for id, c := range state.CommitProofs {
+			if c.View == pp.View && c.Digest == pp.Digest {
+				rec.Commits = append(rec.Commits, AuditVote{NodeID: id, Payload: digestCommit(c.View, seq, c.Digest, id), Signature: c.Signature})
+			}
+		}
+		if len(rec.Commits) < p.quorumSize() {
+			return
+		}
+		sort.Slice(rec.Commits, func(i, j int) bool { return rec.Commits[i].NodeID < rec.Commits[j].NodeID })
+	}
+	state.Audited = true
+	// Blocks when the writer falls behind: the trail must not have gaps
+	p.audit.records <- rec
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Audit bundles: the records of a range of sequence numbers, merged from the
+// --audit files of any nodes, plus the public keys they were checked with. A
+// bundle is checked against the replicas in cluster.conf: every record needs a
+// batch matching its digest and valid Commits from a quorum of distinct
+// replicas, sized by the number of replicas in the file (see quorumOf). The
+// config must therefore list the replica set the batches were committed by.
+
+// AuditBundle is what `pbft audit export` writes.
+type AuditBundle struct {
+	Keys    map[int][]byte `json:"keys"` // replica ID -> ed25519 public key
+	Records []AuditRecord  `json:"records"`
+}
+
+// auditKeys returns the public keys of the replicas in confPath.
+func auditKeys(confPath string) (map[int]ed25519.PublicKey, error) {
+	keys := make(map[int]ed25519.PublicKey)
+	for _, node := range parseClusterConfig(confPath) {
+		if node.Role == RoleLearner {
+			continue
+		}
+		pub, err := base64.StdEncoding.DecodeString(node.PublicKey)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("node %d has no valid public_key in %s (run `pbft keygen`)", node.ID, confPath)
+		}
+		keys[node.ID] = ed25519.PublicKey(pub)
+	}
+	return keys, nil
+}
+
+func auditQuorum(keys map[int]ed25519.PublicKey) int {
+	return quorumOf(len(keys))
+}
+
+// verifyAuditRecord checks that rec carries its batch and valid Commits for it
+// from a quorum of the replicas in keys.
+func verifyAuditRecord(rec *AuditRecord, keys map[int]ed25519.PublicKey) error {
+	if hash(rec.Batch) != rec.Digest {
+		return fmt.Errorf("batch does not match its digest")
+	}
+	voteData := digestVote(PhaseCommit, rec.View, rec.Seq, rec.Digest)
+	seen := make(map[int]bool)
+	for _, v := range rec.Commits {
+		if seen[v.NodeID] {
+			return fmt.Errorf("node %d committed twice", v.NodeID)
+		}
+		key, ok := keys[v.NodeID]
+		if !ok {
+			return fmt.Errorf("node %d is not a replica", v.NodeID)
+		}
+		if !bytes.Equal(v.Payload, digestCommit(rec.View, rec.Seq, rec.Digest, v.NodeID)) && !bytes.Equal(v.Payload, voteData) {
+			return fmt.Errorf("commit from %d is for another batch", v.NodeID)
+		}
+		if err := verify(key, v.Payload, v.Signature); err != nil {
+			return fmt.Errorf("commit from %d: %v", v.NodeID, err)
+		}
+		seen[v.NodeID] = true
+	}
+	if quorum := auditQuorum(keys); len(seen) < quorum {
+		return fmt.Errorf("only %d commits, need %d", len(seen), quorum)
+	}
+	return nil
+}
+
+// LoadAuditRecords reads the records of one or more --audit files. The last
+// line of a file may have been torn by a crash and is skipped if it does not
+// parse.
+func LoadAuditRecords(paths []string) ([]AuditRecord, error) {
+	var records []AuditRecord
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		var torn error
+		for line := 1; scanner.Scan(); line++ {
+			if torn != nil {
+				f.Close()
+				return nil, torn
+			}
+			var rec AuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				torn = fmt.Errorf("%s:%d: %v", path, line, err)
+				continue
+			}
+			records = append(records, rec)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// exportAudit keeps one valid record per sequence number in [from, to] (to 0:
+// no limit). Invalid records are reported and skipped, as another node may have
+// a valid one; two valid records with different batches for the same sequence
+// number mean the cluster lost safety and fail the export.
+func exportAudit(records []AuditRecord, keys map[int]ed25519.PublicKey, from int, to int) (*AuditBundle, []string, error) {
+	bySeq := make(map[int]AuditRecord)
+	var skipped []string
+	for i := range records {
+		rec := &records[i]
+		if rec.Seq < from || (to > 0 && rec.Seq > to) {
+			continue
+		}
+		if err := verifyAuditRecord(rec, keys); err != nil {
+			skipped = append(skipped, fmt.Sprintf("seq %d: %v", rec.Seq, err))
+			continue
+		}
+		if prev, ok := bySeq[rec.Seq]; ok {
+			if prev.Digest != rec.Digest {
+				return nil, skipped, fmt.Errorf("seq %d committed both %s and %s", rec.Seq, prev.Digest, rec.Digest)
+			}
+			continue
+		}
+		bySeq[rec.Seq] = *rec
+	}
+
+	bundle := &AuditBundle{Keys: make(map[int][]byte), Records: make([]AuditRecord, 0, len(bySeq))}
+	for id, key := range keys {
+		bundle.Keys[id] = key
+	}
+	for _, rec := range bySeq {
+		bundle.Records = append(bundle.Records, rec)
+	}
+	sort.Slice(bundle.Records, func(i, j int) bool { return bundle.Records[i].Seq < bundle.Records[j].Seq })
+	return bundle, skipped, nil
+}
+
+// verifyAuditBundle checks every record of bundle against keys and returns one
+// line per failure. The keys in the bundle must be those of the config: an
+// auditor trusts the config, not the bundle.
+func verifyAuditBundle(bundle *AuditBundle, keys map[int]ed25519.PublicKey) []string {
+	var failures []string
+	for id, key := range bundle.Keys {
+		if !bytes.Equal(key, keys[id]) {
+			failures = append(failures, fmt.Sprintf("the bundle's key of node %d differs from the config", id))
+		}
+	}
+	seqs := make(map[int]bool)
+	for i := range bundle.Records {
+		rec := &bundle.Records[i]
+		if seqs[rec.Seq] {
+			failures = append(failures, fmt.Sprintf("seq %d appears twice", rec.Seq))
+			continue
+		}
+		seqs[rec.Seq] = true
+		if err := verifyAuditRecord(rec, keys); err != nil {
+			failures = append(failures, fmt.Sprintf("seq %d: %v", rec.Seq, err))
+		}
+	}
+	return failures
+}
+
+// auditExportCommand merges audit files into a bundle at out.
+func auditExportCommand(confPath string, paths []string, out string, from int, to int) error {
+	keys, err := auditKeys(confPath)
+	if err != nil {
+		return err
+	}
+	records, err := LoadAuditRecords(paths)
+	if err != nil {
+		return err
+	}
+	bundle, skipped, err := exportAudit(records, keys, from, to)
+	for _, s := range skipped {
+		fmt.Printf("skipped %s\n", s)
+	}
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(out, data, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d sequence numbers%s to %s\n", len(bundle.Records), seqRange(bundle.Records), out)
+	return nil
+}
+
+// auditVerifyCommand checks a bundle offline.
+func auditVerifyCommand(confPath string, path string) error {
+	keys, err := auditKeys(confPath)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	bundle := &AuditBundle{}
+	if err := json.Unmarshal(data, bundle); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	failures := verifyAuditBundle(bundle, keys)
+	for _, failure := range failures {
+		fmt.Println(failure)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s: %d problem(s)", path, len(failures))
+	}
+	fmt.Printf("OK: %d sequence numbers%s committed by a quorum of %d of %d replicas\n",
+		len(bundle.Records), seqRange(bundle.Records), auditQuorum(keys), len(keys))
+	return nil
+}
+
+// seqRange describes the sequence numbers of sorted records, e.g. " (1-200, 3 missing)".
+func seqRange(records []AuditRecord) string {
+	if len(records) == 0 {
+		return ""
+	}
+	first, last := records[0].Seq, records[len(records)-1].Seq
+	if missing := last - first + 1 - len(records); missing > 0 {
+		return fmt.Sprintf(" (%d-%d, %d missing)", first, last, missing)
+	}
+	return fmt.Sprintf(" (%d-%d)", first, last)
+}
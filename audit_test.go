@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+)
+
+func TestAuditVerify(t *testing.T) {
+	keys := make(map[int]ed25519.PublicKey)
+	privs := make(map[int]ed25519.PrivateKey)
+	for id := 1; id <= 4; id++ {
+		priv, err := generateEd25519Key(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		privs[id], keys[id] = priv, priv.Public().(ed25519.PublicKey)
+	}
+	record := func(seq int, batch string, signers ...int) AuditRecord {
+		rec := AuditRecord{Seq: seq, View: 0, Digest: hash([]byte(batch)), Batch: []byte(batch)}
+		for _, id := range signers {
+			payload := digestCommit(rec.View, seq, rec.Digest, id)
+			rec.Commits = append(rec.Commits, AuditVote{NodeID: id, Payload: payload, Signature: ed25519.Sign(privs[id], payload)})
+		}
+		return rec
+	}
+
+	good := record(1, "set x 1", 1, 2, 3)
+	if err := verifyAuditRecord(&good, keys); err != nil {
+		t.Fatalf("valid record rejected: %v", err)
+	}
+	// A quorum certificate's shares sign the vote instead
+	qc := record(2, "set y 2")
+	for _, id := range []int{2, 3, 4} {
+		payload := digestVote(PhaseCommit, qc.View, qc.Seq, qc.Digest)
+		qc.Commits = append(qc.Commits, AuditVote{NodeID: id, Payload: payload, Signature: ed25519.Sign(privs[id], payload)})
+	}
+	if err := verifyAuditRecord(&qc, keys); err != nil {
+		t.Fatalf("multisig record rejected: %v", err)
+	}
+
+	short := record(3, "set z 3", 1, 2)
+	tampered := record(4, "set w 4", 1, 2, 3)
+	tampered.Batch = []byte("set w 5")
+	replayed := record(5, "set v 5", 1, 2)
+	replayed.Commits = append(replayed.Commits, good.Commits[2]) // node 3's Commit of seq 1
+	for name, rec := range map[string]AuditRecord{"short": short, "tampered": tampered, "replayed": replayed} {
+		if err := verifyAuditRecord(&rec, keys); err == nil {
+			t.Errorf("%s record accepted", name)
+		}
+	}
+
+	// Export keeps one valid record per sequence number, skipping invalid ones
+	bundle, skipped, err := exportAudit([]AuditRecord{qc, good, short, good}, keys, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle.Records) != 2 || bundle.Records[0].Seq != 1 || len(skipped) != 1 {
+		t.Fatalf("exported %d records, skipped %v", len(bundle.Records), skipped)
+	}
+	if failures := verifyAuditBundle(bundle, keys); len(failures) > 0 {
+		t.Fatalf("exported bundle does not verify: %v", failures)
+	}
+	bundle.Records[1].Commits = bundle.Records[1].Commits[:2]
+	if failures := verifyAuditBundle(bundle, keys); len(failures) != 1 || !strings.Contains(failures[0], "seq 2") {
+		t.Errorf("failures = %v, want seq 2 short of commits", failures)
+	}
+
+	// Two batches committed at one sequence number fail the export
+	if _, _, err := exportAudit([]AuditRecord{good, record(1, "set x 9", 2, 3, 4)}, keys, 0, 0); err == nil {
+		t.Error("conflicting records exported")
+	}
+}
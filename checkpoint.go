@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"sort"
+)
+
+// Checkpoints as in the PBFT paper: every CHECKPOINT_INTERVAL sequence numbers a
+// replica broadcasts a digest of its state, and a checkpoint with 2f+1 matching
+// digests is stable. Stable checkpoints bound how stale a --read-mode stale
+// answer can be. The log is not truncated yet.
+
+const (
+	RPCCheckpoint       = "PBFT.Checkpoint"
+	CHECKPOINT_INTERVAL = 128
+	LOG_WINDOW          = 2 * CHECKPOINT_INTERVAL // L: the high water mark is the stable checkpoint plus L
+)
+
+type CheckpointArgs struct {
+	SequenceNumber int
+	StateDigest    string
+	NodeID         int
+	Signature      []byte
+	Auth           Authenticator
+}
+
+type CheckpointReply struct {
+	Success bool
+}
+
+// stateDigestLocked hashes the state machine in key order, with the same
+// length-prefixed encoding as signed messages so that no two states collide.
+func (p *PBFT) stateDigestLocked() string {
+	return stateDigest(p.StateMachine)
+}
+
+func stateDigest(state map[string]string) string {
+	keys := make([]string, 0, len(state))
+	for k := range state {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	e := newCanonicalEncoder(TAG_STATE).putInt(len(keys))
+	for _, k := range keys {
+		e.putString(k).putString(state[k])
+	}
+	sum := sha256.Sum256(e.bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// maybeCheckpointLocked takes a checkpoint once execution crosses an interval
+// boundary. HotStuff skips heights of empty blocks, so it cannot wait for an
+// exact multiple.
+func (p *PBFT) maybeCheckpointLocked(seq int) {
+	if seq/CHECKPOINT_INTERVAL <= p.lastCheckpoint/CHECKPOINT_INTERVAL {
+		return
+	}
+	p.lastCheckpoint = seq
+	p.snapshotLocked(seq)
+
+	args := &CheckpointArgs{
+		SequenceNumber: seq,
+		StateDigest:    p.stateDigestLocked(),
+		NodeID:         p.id,
+	}
+	sig, auth, err := p.signMessage(digestCheckpoint(seq, args.StateDigest, p.id))
+	if err != nil {
+		p.logPutLocked(LogCheckpoint, slog.LevelError, "Error signing Checkpoint", "seq", seq, "err", err)
+		return
+	}
+	args.Signature = sig
+	args.Auth = auth
+
+	p.addCheckpointLocked(args)
+	for peerID := range p.replicas().peerIPPort {
+		if peerID != p.id {
+			go func(target int) {
+				reply := &CheckpointReply{}
+				p.sendRPC(target, RPCCheckpoint, args, reply)
+			}(peerID)
+		}
+	}
+}
+
+func (p *PBFT) Checkpoint(args *CheckpointArgs, reply *CheckpointReply) error {
+	err := p.verifier.Verify(func() error {
+		data := digestCheckpoint(args.SequenceNumber, args.StateDigest, args.NodeID)
+		return p.verifyMessage(args.NodeID, data, args.Signature, args.Auth)
+	})
+	if err != nil {
+		p.logPut(LogCheckpoint, slog.LevelWarn, "Signature verification failed for Checkpoint", "peer", args.NodeID, "seq", args.SequenceNumber, "err", err)
+		reply.Success = false
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.addCheckpointLocked(args)
+	reply.Success = true
+	return nil
+}
+
+func (p *PBFT) addCheckpointLocked(args *CheckpointArgs) {
+	seq := args.SequenceNumber
+	if seq <= p.stableCheckpoint {
+		return
+	}
+	votes, ok := p.checkpointVotes[seq]
+	if !ok {
+		votes = make(map[int]string)
+		p.checkpointVotes[seq] = votes
+	}
+	votes[args.NodeID] = args.StateDigest
+
+	count := 0
+	for _, d := range votes {
+		if d == args.StateDigest {
+			count++
+		}
+	}
+	if count < p.quorumSize() {
+		return
+	}
+
+	p.stableCheckpoint = seq
+	p.stableLocked(seq, args.StateDigest)
+	p.logPutLocked(LogCheckpoint, slog.LevelDebug, "Checkpoint is stable", "seq", seq, "matching", count)
+	for s := range p.checkpointVotes {
+		if s <= seq {
+			delete(p.checkpointVotes, s)
+		}
+	}
+}
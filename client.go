@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"math"
 	"math/rand"
 	"time"
 
@@ -19,8 +21,9 @@ const (
 )
 
 type Response struct {
-	success bool
-	value   string
+	success   bool
+	value     string
+	guarantee Guarantee
 }
 
 type WorkerResult struct {
@@ -62,23 +65,30 @@ func (p *PBFT) concClient() {
 
 	if !p.isPrimary() {
 		// Only primary generates load in this setup
-		fmt.Println("Not primary, not starting client.")
+		p.logPut(LogMain, slog.LevelInfo, "Not primary, not starting client")
 		return
 	}
 
-	fmt.Println("ConcClient starting experiment (Primary)...")
+	p.logPut(LogMain, slog.LevelInfo, "ConcClient starting experiment", "workers", p.workers, "duration", EXPERIMENT_DURATION)
 
 	ctx, cancel := context.WithTimeout(context.Background(), EXPERIMENT_DURATION)
 	defer cancel()
 
 	pool := pool.NewWithResults[WorkerResult]().WithErrors().WithMaxGoroutines(p.workers)
 	for i := 0; i < p.workers; i++ {
-		pool.Go(func() (WorkerResult, error) { return concClientWorker(ctx, p) })
+		clientID := i
+		pool.Go(func() (WorkerResult, error) { return concClientWorker(ctx, p, clientID) })
 	}
 	results, err := pool.Wait()
 
+	if p.history != nil && p.historyPath != "" {
+		if err := p.history.Save(p.historyPath); err != nil {
+			p.logPut(LogMain, slog.LevelError, "ConcClient failed to save history", "err", err)
+		}
+	}
+
 	if err != nil {
-		fmt.Println("ConcClient encountered error:", err)
+		p.logPut(LogMain, slog.LevelError, "ConcClient encountered error", "err", err)
 		return
 	}
 	totalCommands := 0
@@ -93,11 +103,9 @@ func (p *PBFT) concClient() {
 		avgLatency = float64(totalDuration.Milliseconds()) / float64(totalCommands)
 	}
 
-	fmt.Printf("ConcClient total commands processed: %d\n", totalCommands)
-	fmt.Printf("ConcClient throughput: %.2f commands/second\n", throughput)
-	fmt.Printf("ConcClient average latency: %.2f ms\n", avgLatency)
+	p.logPut(LogMain, slog.LevelInfo, "ConcClient total commands processed", "commands", totalCommands)
 
-	// CSV output for makefile to capture
+	// Summary for the makefile benchmark to capture
 	workloadName := "unknown"
 	switch p.workload {
 	case 50:
@@ -107,10 +115,21 @@ func (p *PBFT) concClient() {
 	case 0:
 		workloadName = "ycsb-c"
 	}
-	fmt.Printf("RESULT:%s,%d,%d,%d,%.2f,%.2f\n", workloadName, p.readBatchSize, p.writeBatchSize, p.workers, throughput, avgLatency)
+	avgBatch, avgLinger := p.batcher.summary()
+	p.logPut(LogMain, slog.LevelInfo, "RESULT",
+		"workload", workloadName,
+		"read_batch", p.readBatchSize,
+		"write_batch", p.writeBatchSize,
+		"workers", p.workers,
+		"window", p.windowSize,
+		"batching", p.batching,
+		"throughput", round2(throughput),
+		"latency_ms", round2(avgLatency),
+		"avg_batch", round2(avgBatch),
+		"avg_linger_ms", round2(float64(avgLinger.Microseconds())/1000))
 }
 
-func concClientWorker(ctx context.Context, p *PBFT) (WorkerResult, error) {
+func concClientWorker(ctx context.Context, p *PBFT, clientID int) (WorkerResult, error) {
 	client := &Client{
 		internalState: make(map[string]string),
 	}
@@ -125,8 +144,17 @@ func concClientWorker(ctx context.Context, p *PBFT) (WorkerResult, error) {
 		// Always submit if we are running this worker (checked isPrimary before starting)
 		command := client.createYCSBCommand(p.workload)
 		req := ClientRequest{
-			Command: command,
-			RespCh:  make(chan Response, 1),
+			ClientID: clientID,
+			Command:  command,
+			RespCh:   make(chan Response, 1),
+			Queued:   time.Now(),
+		}
+
+		// Record the invocation before the request can reach consensus, so the
+		// recorded interval always contains the real execution point.
+		opID := -1
+		if p.history != nil {
+			opID = p.history.Invoke(clientID, command)
 		}
 
 		start := time.Now()
@@ -141,6 +169,14 @@ func concClientWorker(ctx context.Context, p *PBFT) (WorkerResult, error) {
 			return res, nil
 		case resp := <-req.RespCh:
 			if resp.success {
+				if p.history != nil {
+					if resp.guarantee == GuaranteeStale {
+						// Not meant to be linearizable, so leave it out of the check
+						p.history.Discard(clientID, opID)
+					} else {
+						p.history.Complete(clientID, opID, resp.value)
+					}
+				}
 				res.count += 1
 				res.duration += time.Since(start)
 			} else {
@@ -150,3 +186,8 @@ func concClientWorker(ctx context.Context, p *PBFT) (WorkerResult, error) {
 		}
 	}
 }
+
+// round2 rounds to two decimals for the summary.
+func round2(x float64) float64 {
+	return math.Round(x*100) / 100
+}
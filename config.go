@@ -5,15 +5,28 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"path/filepath"
 )
 
 type Node struct {
 	ID   int    `json:"id"`
 	IP   string `json:"ip"`
 	Port int    `json:"port"`
+
+	// TLS: every node's certificate is pinned here. The key is only read by the
+	// node itself. Relative paths are resolved against the config file's directory.
+	TLSCert string `json:"tls_cert,omitempty"`
+	TLSKey  string `json:"tls_key,omitempty"`
+
+	// Signing keys written by `pbft keygen`
+	PublicKey string `json:"public_key,omitempty"` // base64 ed25519 public key
+	KeyFile   string `json:"key_file,omitempty"`
+
+	// "replica" (default) or "learner" (see learner.go)
+	Role string `json:"role,omitempty"`
 }
 
-func parseConfig(confPath string) map[int]string {
+func parseClusterConfig(confPath string) []Node {
 	file, err := ioutil.ReadFile(confPath)
 	if err != nil {
 		log.Fatalf("Failed to read config file: %v", err)
@@ -23,6 +36,19 @@ func parseConfig(confPath string) map[int]string {
 	if err := json.Unmarshal(file, &nodes); err != nil {
 		log.Fatalf("Failed to parse config file: %v", err)
 	}
+	return nodes
+}
+
+// resolveConfigPath interprets path relative to the directory of the config file.
+func resolveConfigPath(confPath string, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(confPath), path)
+}
+
+func parseConfig(confPath string) map[int]string {
+	nodes := parseClusterConfig(confPath)
 
 	peerIPs := make(map[int]string)
 	for _, node := range nodes {
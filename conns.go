@@ -1,57 +1,425 @@
 package main
 
 import (
-	"fmt"
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"log/slog"
+	"math/rand"
 	"net"
 	"net/rpc"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
-func (p *PBFT) dialRPCToPeer(peerID int) error {
-	if peerID == p.id {
-		return nil
+const (
+	DIAL_TIMEOUT     = 2 * time.Second
+	DIAL_BACKOFF_MIN = 100 * time.Millisecond
+	DIAL_BACKOFF_MAX = 5 * time.Second
+	RPC_TIMEOUT      = 2 * time.Second
+)
+
+var errPeerDown = errors.New("peer is down")
+
+// Replicas open every connection with a short hello carrying their node ID, so the
+// accepting side knows which link a connection belongs to. Connections without it
+// (test clients, admin tools) are served as peer 0.
+const (
+	HELLO_MAGIC = "PBFTHELO"
+	HELLO_SIZE  = len(HELLO_MAGIC) + 4
+)
+
+func writeHello(conn net.Conn, id int) error {
+	buf := make([]byte, HELLO_SIZE)
+	copy(buf, HELLO_MAGIC)
+	binary.BigEndian.PutUint32(buf[len(HELLO_MAGIC):], uint32(id))
+	_, err := conn.Write(buf)
+	return err
+}
+
+// bufferedConn keeps bytes peeked while looking for the hello.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func readHello(conn net.Conn) (net.Conn, int) {
+	r := bufio.NewReader(conn)
+	buf, err := r.Peek(HELLO_SIZE)
+	if err != nil || string(buf[:len(HELLO_MAGIC)]) != HELLO_MAGIC {
+		return &bufferedConn{Conn: conn, r: r}, 0
+	}
+	peerID := int(binary.BigEndian.Uint32(buf[len(HELLO_MAGIC):]))
+	r.Discard(HELLO_SIZE)
+	return &bufferedConn{Conn: conn, r: r}, peerID
+}
+
+func (p *PBFT) dialRPCToPeer(peerID int) (*rpc.Client, error) {
+	if p.faults != nil && p.faults.Partitioned(peerID) {
+		return nil, errors.Errorf("peer %d is partitioned", peerID)
 	}
-	client, err := rpc.Dial("tcp", p.peerIPPort[peerID])
+	conn, err := dialConn(p.addrOf(peerID), p.tls, peerID)
 	if err != nil {
-		logMsg := fmt.Sprintf("Failed to connect to peer %d at %s: %v", peerID, p.peerIPPort[peerID], err)
-		p.logPut(logMsg, PURPLE)
-		return errors.WithStack(err)
+		return nil, err
 	}
-	p.mu.Lock()
-	p.rpcConns[peerID] = client
-	p.mu.Unlock()
-	msg := fmt.Sprintf("Connected to peer %d at %s", peerID, p.peerIPPort[peerID])
-	p.logPut(msg, GREEN)
-	return nil
+	if err := writeHello(conn, p.id); err != nil {
+		conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	if p.faults != nil {
+		conn = p.faults.wrap(conn, peerID)
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// dialConn opens a connection to node peerID, over TLS when t is set.
+func dialConn(addr string, t *tlsSetup, peerID int) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, DIAL_TIMEOUT)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if t == nil {
+		return conn, nil
+	}
+	tconn := tls.Client(conn, t.clientConfig(peerID))
+	tconn.SetDeadline(time.Now().Add(DIAL_TIMEOUT))
+	if err := tconn.Handshake(); err != nil {
+		conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	tconn.SetDeadline(time.Time{})
+	return tconn, nil
+}
+
+// dialNode connects an admin tool to node target. With TLS enabled, as selects the
+// node identity (certificate and key) to authenticate with; 0 connects as an
+// unauthenticated client.
+func dialNode(confPath string, target int, as int) (*rpc.Client, error) {
+	nodes := parseClusterConfig(confPath)
+	t, err := loadTLS(confPath, as, nodes)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialConn(parseConfig(confPath)[target], t, target)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
 }
 
 func (p *PBFT) dialRPCToAllPeers() error {
-	for peerID := range p.peerIPPort {
+	for peerID, addr := range p.replicas().peerIPPort {
 		if peerID != p.id {
-			logMsg := fmt.Sprintf("Dialing RPC to peer %d at %s", peerID, p.peerIPPort[peerID])
-			p.logPut(logMsg, CYAN)
-			go p.dialRPCToPeer(peerID)
+			p.logPut(LogNet, slog.LevelDebug, "Dialing RPC to peer", "peer", peerID, "addr", addr)
+			p.conns.Start(peerID)
 		}
 	}
+	for learnerID, addr := range p.learners {
+		p.logPut(LogNet, slog.LevelDebug, "Dialing RPC to learner", "peer", learnerID, "addr", addr)
+		p.conns.Start(learnerID)
+	}
 	return nil
 }
 
 func (p *PBFT) listenRPC() error {
-	_ = rpc.Register(p)
-	l, err := net.Listen("tcp", p.peerIPPort[p.id])
+	// Replica-to-replica and admin services are only served to authenticated
+	// replicas when TLS is on; everyone else gets the client-facing service.
+	p.replicaServer = rpc.NewServer()
+	_ = p.replicaServer.Register(p)
+	_ = p.replicaServer.RegisterName("Faults", &FaultService{p: p})
+	_ = p.replicaServer.RegisterName("Cluster", &ClusterService{p: p})
+	_ = p.replicaServer.RegisterName("Log", &LogService{p: p})
+	_ = p.replicaServer.RegisterName("Admin", &AdminService{p: p})
+	_ = p.replicaServer.RegisterName("Client", &ClientService{p: p})
+	if p.hotstuff != nil {
+		_ = p.replicaServer.RegisterName("HotStuff", p.hotstuff)
+	}
+	p.clientServer = rpc.NewServer()
+	_ = p.clientServer.RegisterName("Client", &ClientService{p: p})
+
+	l, err := net.Listen("tcp", p.addrOf(p.id))
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	msg := fmt.Sprintf("Listening for RPC connections on %s", p.peerIPPort[p.id])
-	p.logPut(msg, PURPLE)
+	if p.tls != nil {
+		l = tls.NewListener(l, p.tls.serverConfig())
+	}
+	p.logPut(LogNet, slog.LevelInfo, "Listening for RPC connections", "addr", p.addrOf(p.id), "tls", p.tls != nil)
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			logMsg := fmt.Sprintf("Failed to accept RPC connection: %v", err)
-			p.logPut(logMsg, PURPLE)
+			p.logPut(LogNet, slog.LevelWarn, "Failed to accept RPC connection", "err", err)
 			continue
 		}
-		go rpc.ServeConn(conn)
+		go p.serveConn(conn)
+	}
+}
+
+func (p *PBFT) serveConn(conn net.Conn) {
+	server := p.replicaServer
+	if tconn, ok := conn.(*tls.Conn); ok {
+		tconn.SetDeadline(time.Now().Add(DIAL_TIMEOUT))
+		if err := tconn.Handshake(); err != nil {
+			p.logPut(LogNet, slog.LevelWarn, "TLS handshake failed", "remote", conn.RemoteAddr().String(), "err", err)
+			conn.Close()
+			return
+		}
+		tconn.SetDeadline(time.Time{})
+
+		certID := p.tls.peerFromTLS(tconn)
+		if certID == 0 {
+			server = p.clientServer
+		}
+		// Admin tools authenticate with a node certificate but send no hello;
+		// they are not a replica link and are never faulted.
+		var helloID int
+		conn, helloID = readHello(conn)
+		if helloID != 0 && helloID != certID {
+			p.logPut(LogNet, slog.LevelWarn, "Rejecting connection: hello does not match the certificate", "remote", conn.RemoteAddr().String(), "hello", helloID, "certificate", certID)
+			conn.Close()
+			return
+		}
+		conn = p.wrapFaults(conn, helloID)
+	} else {
+		var peerID int
+		conn, peerID = readHello(conn)
+		conn = p.wrapFaults(conn, peerID)
+	}
+	if conn == nil {
+		return
+	}
+	server.ServeConn(conn)
+}
+
+// wrapFaults applies fault injection to an accepted connection from peerID. It
+// returns nil if the peer is partitioned away.
+func (p *PBFT) wrapFaults(conn net.Conn, peerID int) net.Conn {
+	if p.faults == nil || peerID <= 0 {
+		return conn
+	}
+	if p.faults.Partitioned(peerID) {
+		conn.Close()
+		return nil
+	}
+	return p.faults.wrap(conn, peerID)
+}
+
+// ConnManager keeps one RPC client per peer. A background loop per peer dials with
+// exponential backoff, and callers never dial themselves: if a peer is down the
+// call fails fast. Clients that hit a transport error or a deadline are evicted,
+// which wakes the loop to reconnect.
+type ConnManager struct {
+	p     *PBFT
+	mu    sync.Mutex
+	peers map[int]*peerConn
+}
+
+type peerConn struct {
+	id       int
+	client   *rpc.Client
+	up       bool
+	since    time.Time // last up/down transition
+	failures int       // consecutive failed dials or calls
+	lastErr  error
+	evicted  chan struct{}
+	stopped  bool // the peer left the cluster
+}
+
+type PeerStatus struct {
+	ID        int
+	Up        bool
+	Since     time.Time
+	Failures  int
+	LastError string
+}
+
+func NewConnManager(p *PBFT) *ConnManager {
+	return &ConnManager{
+		p:     p,
+		peers: make(map[int]*peerConn),
+	}
+}
+
+// Start launches the reconnect loop for peerID. Calling it twice is a no-op.
+func (m *ConnManager) Start(peerID int) {
+	m.mu.Lock()
+	if _, ok := m.peers[peerID]; ok {
+		m.mu.Unlock()
+		return
+	}
+	pc := &peerConn{id: peerID, since: time.Now(), evicted: make(chan struct{}, 1)}
+	m.peers[peerID] = pc
+	m.mu.Unlock()
+
+	go m.maintain(pc)
+}
+
+func (m *ConnManager) maintain(pc *peerConn) {
+	backoff := DIAL_BACKOFF_MIN
+	for {
+		m.mu.Lock()
+		stopped := pc.stopped
+		m.mu.Unlock()
+		if stopped {
+			return
+		}
+
+		client, err := m.p.dialRPCToPeer(pc.id)
+		if err != nil {
+			m.mu.Lock()
+			pc.failures++
+			pc.lastErr = err
+			failures := pc.failures
+			m.mu.Unlock()
+			if failures == 1 || failures%10 == 0 {
+				m.p.logPut(LogNet, slog.LevelInfo, "Failed to connect to peer", "peer", pc.id, "addr", m.p.addrOf(pc.id), "attempt", failures, "err", err)
+			}
+
+			// Full jitter keeps restarted nodes from redialing in lockstep
+			time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+			backoff = min(backoff*2, DIAL_BACKOFF_MAX)
+			continue
+		}
+
+		m.mu.Lock()
+		if pc.stopped {
+			m.mu.Unlock()
+			client.Close()
+			return
+		}
+		pc.client = client
+		pc.up = true
+		pc.since = time.Now()
+		pc.failures = 0
+		pc.lastErr = nil
+		m.mu.Unlock()
+		backoff = DIAL_BACKOFF_MIN
+		m.p.logPut(LogNet, slog.LevelInfo, "Connected to peer", "peer", pc.id, "addr", m.p.addrOf(pc.id))
+
+		<-pc.evicted
+	}
+}
+
+// Stop ends the reconnect loop for peerID and closes its connection, once the
+// peer has left the cluster.
+func (m *ConnManager) Stop(peerID int) {
+	m.mu.Lock()
+	pc := m.peers[peerID]
+	if pc == nil {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.peers, peerID)
+	pc.stopped = true
+	client := pc.client
+	pc.client = nil
+	pc.up = false
+	m.mu.Unlock()
+
+	if client != nil {
+		client.Close()
+	}
+	select {
+	case pc.evicted <- struct{}{}:
+	default:
+	}
+}
+
+func (m *ConnManager) get(peerID int) (*peerConn, *rpc.Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pc := m.peers[peerID]
+	if pc == nil {
+		return nil, nil
+	}
+	return pc, pc.client
+}
+
+// evict drops client if it is still the current one for the peer and wakes the
+// reconnect loop. Pending calls on it fail with rpc.ErrShutdown.
+func (m *ConnManager) evict(pc *peerConn, client *rpc.Client, err error) {
+	m.mu.Lock()
+	if pc.client != client {
+		m.mu.Unlock()
+		return
+	}
+	pc.client = nil
+	pc.up = false
+	pc.since = time.Now()
+	pc.failures++
+	pc.lastErr = err
+	m.mu.Unlock()
+
+	client.Close()
+	select {
+	case pc.evicted <- struct{}{}:
+	default:
+	}
+	m.p.logPut(LogNet, slog.LevelWarn, "Lost connection to peer", "peer", pc.id, "err", err)
+}
+
+// Call invokes method on peerID with a deadline of RPC_TIMEOUT.
+func (m *ConnManager) Call(peerID int, method string, args interface{}, reply interface{}) error {
+	pc, client := m.get(peerID)
+	if client == nil {
+		m.p.metrics.rpcFailed(peerID, method)
+		return errPeerDown
+	}
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(RPC_TIMEOUT)
+	defer timer.Stop()
+
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			m.p.metrics.rpcFailed(peerID, method)
+			if isTransportError(call.Error) {
+				m.evict(pc, client, call.Error)
+			}
+		}
+		return call.Error
+	case <-timer.C:
+		// net/rpc cannot cancel a call, so a stuck connection is replaced
+		err := errors.Errorf("%s to peer %d timed out after %v", method, peerID, RPC_TIMEOUT)
+		m.p.metrics.rpcFailed(peerID, method)
+		m.evict(pc, client, err)
+		return err
+	}
+}
+
+// isTransportError tells connection failures apart from errors returned by the
+// remote handler, which leave the connection usable.
+func isTransportError(err error) bool {
+	_, remote := err.(rpc.ServerError)
+	return !remote
+}
+
+func (m *ConnManager) IsUp(peerID int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pc := m.peers[peerID]
+	return pc != nil && pc.up
+}
+
+func (m *ConnManager) Status() []PeerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	statuses := make([]PeerStatus, 0, len(m.peers))
+	for _, pc := range m.peers {
+		st := PeerStatus{ID: pc.id, Up: pc.up, Since: pc.since, Failures: pc.failures}
+		if pc.lastErr != nil {
+			st.LastError = pc.lastErr.Error()
+		}
+		statuses = append(statuses, st)
 	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type connTestService struct{}
+
+func (connTestService) Ping(args *int, reply *int) error {
+	*reply = *args
+	return nil
+}
+
+func (connTestService) Stall(args *int, reply *int) error {
+	time.Sleep(RPC_TIMEOUT + time.Second)
+	return nil
+}
+
+func (connTestService) Fail(args *int, reply *int) error {
+	return fmt.Errorf("handler failed")
+}
+
+// fakePeer is an RPC server that can be taken down and brought back on the
+// same address.
+type fakePeer struct {
+	addr   string
+	server *rpc.Server
+
+	mu    sync.Mutex
+	l     net.Listener
+	conns []net.Conn
+}
+
+func newFakePeer(t *testing.T) *fakePeer {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Test", connTestService{}); err != nil {
+		t.Fatal(err)
+	}
+	f := &fakePeer{addr: fmt.Sprintf("127.0.0.1:%d", freePort(t)), server: server}
+	f.up(t)
+	t.Cleanup(f.down)
+	return f
+}
+
+func (f *fakePeer) up(t *testing.T) {
+	l, err := net.Listen("tcp", f.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	f.l = l
+	f.mu.Unlock()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+			conn, _ = readHello(conn)
+			go f.server.ServeConn(conn)
+		}
+	}()
+}
+
+// down closes the listener and every connection, as a crashed peer would.
+func (f *fakePeer) down() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.l != nil {
+		f.l.Close()
+		f.l = nil
+	}
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+// newConnTestReplica returns node 1 of a two-node cluster whose node 2 is peer.
+func newConnTestReplica(t *testing.T, peer *fakePeer) *PBFT {
+	p := newTestReplica(t, 1, 2, CryptoEd25519)
+	rs := *p.replicas()
+	rs.peerIPPort = map[int]string{1: "127.0.0.1:0", 2: peer.addr}
+	p.replicaSet.Store(&rs)
+	p.conns = NewConnManager(p)
+	t.Cleanup(func() { p.conns.Stop(2) })
+	return p
+}
+
+func waitFor(t *testing.T, what string, timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func peerStatus(p *PBFT, id int) PeerStatus {
+	for _, st := range p.conns.Status() {
+		if st.ID == id {
+			return st
+		}
+	}
+	return PeerStatus{}
+}
+
+// A broken connection is evicted on the first failed call, calls fail fast
+// while the peer is down, and the background loop reconnects with backoff once
+// the peer is back.
+func TestConnManagerReconnects(t *testing.T) {
+	peer := newFakePeer(t)
+	p := newConnTestReplica(t, peer)
+	p.conns.Start(2)
+	waitFor(t, "the connection", DIAL_TIMEOUT, func() bool { return p.conns.IsUp(2) })
+
+	var reply int
+	if err := p.conns.Call(2, "Test.Ping", 7, &reply); err != nil || reply != 7 {
+		t.Fatalf("Ping: %v, %d", err, reply)
+	}
+
+	peer.down()
+	if err := p.conns.Call(2, "Test.Ping", 1, &reply); err == nil {
+		t.Fatalf("call on a closed connection succeeded")
+	}
+	if p.conns.IsUp(2) {
+		t.Fatalf("broken connection was not evicted")
+	}
+	start := time.Now()
+	if err := p.conns.Call(2, "Test.Ping", 1, &reply); err != errPeerDown {
+		t.Fatalf("call while down: got %v, want errPeerDown", err)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("call while down took %v, want it to fail fast", time.Since(start))
+	}
+
+	// Without backoff the loop would redial every DIAL_BACKOFF_MIN, 15 times in
+	// this window; doubling from it, with jitter, leaves room for only a few
+	time.Sleep(1500 * time.Millisecond)
+	st := peerStatus(p, 2)
+	if st.Up || st.LastError == "" {
+		t.Fatalf("status while down: %+v", st)
+	}
+	if st.Failures < 3 || st.Failures > 8 {
+		t.Fatalf("%d failures in 1.5s, want backoff between dials", st.Failures)
+	}
+	if time.Since(st.Since) < 1500*time.Millisecond {
+		t.Fatalf("down since %v, want the time of the eviction", st.Since)
+	}
+
+	peer.up(t)
+	waitFor(t, "the reconnection", DIAL_BACKOFF_MAX+time.Second, func() bool { return p.conns.IsUp(2) })
+	if err := p.conns.Call(2, "Test.Ping", 8, &reply); err != nil || reply != 8 {
+		t.Fatalf("Ping after reconnect: %v, %d", err, reply)
+	}
+	st = peerStatus(p, 2)
+	if !st.Up || st.Failures != 0 || st.LastError != "" {
+		t.Fatalf("status after reconnect: %+v", st)
+	}
+}
+
+// A call that outlives RPC_TIMEOUT fails at the deadline and replaces the
+// connection; an error returned by the handler keeps it.
+func TestConnManagerCallDeadline(t *testing.T) {
+	peer := newFakePeer(t)
+	p := newConnTestReplica(t, peer)
+	p.conns.Start(2)
+	waitFor(t, "the connection", DIAL_TIMEOUT, func() bool { return p.conns.IsUp(2) })
+
+	var reply int
+	_, before := p.conns.get(2)
+	if err := p.conns.Call(2, "Test.Fail", 1, &reply); err == nil || !strings.Contains(err.Error(), "handler failed") {
+		t.Fatalf("Fail: got %v", err)
+	}
+	if _, after := p.conns.get(2); after != before {
+		t.Fatalf("a handler error replaced the connection")
+	}
+
+	start := time.Now()
+	err := p.conns.Call(2, "Test.Stall", 1, &reply)
+	elapsed := time.Since(start)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Stall: got %v, want a timeout", err)
+	}
+	if elapsed < RPC_TIMEOUT || elapsed > RPC_TIMEOUT+500*time.Millisecond {
+		t.Fatalf("Stall returned after %v, want RPC_TIMEOUT (%v)", elapsed, RPC_TIMEOUT)
+	}
+
+	waitFor(t, "a new connection", DIAL_TIMEOUT, func() bool {
+		_, client := p.conns.get(2)
+		return client != nil && client != before
+	})
+	if err := p.conns.Call(2, "Test.Ping", 3, &reply); err != nil || reply != 3 {
+		t.Fatalf("Ping on the new connection: %v, %d", err, reply)
+	}
+}
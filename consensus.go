@@ -4,57 +4,71 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"log/slog"
 )
 
-func (p *PBFT) broadcastPrePrepare(seq int, command []byte) {
+func (p *PBFT) broadcastPrePrepare(view int, seq int, command []byte) {
 	p.mu.Lock()
-	view := p.view
+	if view != p.view {
+		// An epoch change took the sequence number away
+		p.mu.Unlock()
+		return
+	}
 	digest := hash(command)
 
 	// Store own state first
 	state := p.getRequestState(seq)
 	state.PrePrepared = true
-
-	// WAL
-	if err := p.storage.AppendEntry(LogEntry{View: view, Command: command}); err != nil {
-		p.logPutLocked("Failed to append to log", RED)
+	p.markLocked(state, TraceProposed)
+
+	// WAL. With --disseminate the batch goes out on its own and the PrePrepare
+	// carries only its digest.
+	if p.disseminate {
+		p.storeBatchLocked(command)
+		go p.sendBatch(seq, command)
+		command = nil
+	} else if err := p.storage.AppendEntry(LogEntry{View: view, Command: command}); err != nil {
+		p.logPutLocked(LogConsensus, slog.LevelError, "Failed to append to log", "seq", seq, "err", err)
 		p.mu.Unlock()
 		return
 	}
 
 	p.mu.Unlock()
 
-	p.logPut(fmt.Sprintf("Broadcasting PrePrepare for seq %d", seq), BLUE)
+	p.logPut(LogConsensus, slog.LevelDebug, "Broadcasting PrePrepare", "seq", seq)
 
-	for peerID := range p.peerIPPort {
-		if peerID != p.id {
-			go func(target int) {
-				// Sign with appropriate key
-				data := digestPrePrepare(view, seq, digest)
-				var sig []byte
-				var err error
-				if p.cryptoType == CryptoMAC {
-					sig, err = sign(p.macKeys[target], data)
-				} else {
-					sig, err = sign(p.privKey, data)
-				}
-				if err != nil {
-					p.logPut("Error signing PrePrepare", RED)
-					return
-				}
+	// Sign once: every backup receives the identical message
+	sig, auth, err := p.signMessage(digestPrePrepare(view, seq, digest, command))
+	if err != nil {
+		p.logPut(LogConsensus, slog.LevelError, "Error signing PrePrepare", "seq", seq, "err", err)
+		return
+	}
 
-				args := &PrePrepareArgs{
-					View:           view,
-					SequenceNumber: seq,
-					Digest:         digest,
-					Command:        command,
-					Signature:      sig,
-				}
+	args := &PrePrepareArgs{
+		View:           view,
+		SequenceNumber: seq,
+		Digest:         digest,
+		Command:        command,
+		Signature:      sig,
+		Auth:           auth,
+	}
 
-				p.mu.Lock()
-				state.PrePrepareMsg = args
-				p.mu.Unlock()
+	p.mu.Lock()
+	state.PrePrepareMsg = args
+	p.orderBatchLocked(args)
+	if p.speculative {
+		p.speculateLocked()
+	}
+	p.mu.Unlock()
 
+	// The primary's own share counts towards the prepare certificate
+	if p.linearVotes() && !p.speculative {
+		go p.sendVote(PhasePrepare, view, seq, digest)
+	}
+
+	for peerID := range p.replicas().peerIPPort {
+		if peerID != p.id {
+			go func(target int) {
 				reply := &PrePrepareReply{}
 				p.sendRPC(target, RPCPrePrepare, args, reply)
 			}(peerID)
@@ -64,31 +78,29 @@ func (p *PBFT) broadcastPrePrepare(seq int, command []byte) {
 }
 
 func (p *PBFT) broadcastPrepare(view int, seq int, digest string) {
-	data := digestPrepare(view, seq, digest, p.id)
+	sig, auth, err := p.signMessage(digestPrepare(view, seq, digest, p.id))
+	if err != nil {
+		p.logPut(LogConsensus, slog.LevelError, "Error signing Prepare", "seq", seq, "err", err)
+		return
+	}
 
-	for peerID := range p.peerIPPort {
-		if peerID != p.id {
-			go func(target int) {
-				var sig []byte
-				var err error
-				if p.cryptoType == CryptoMAC {
-					sig, err = sign(p.macKeys[target], data)
-				} else {
-					sig, err = sign(p.privKey, data)
-				}
-				if err != nil {
-					p.logPut("Error signing Prepare", RED)
-					return
-				}
+	args := &PrepareArgs{
+		View:           view,
+		SequenceNumber: seq,
+		Digest:         digest,
+		NodeID:         p.id,
+		Signature:      sig,
+		Auth:           auth,
+	}
 
-				args := &PrepareArgs{
-					View:           view,
-					SequenceNumber: seq,
-					Digest:         digest,
-					NodeID:         p.id,
-					Signature:      sig,
-				}
+	// Keep our own Prepare for the prepared certificate
+	p.mu.Lock()
+	p.getRequestState(seq).PrepareProofs[p.id] = args
+	p.mu.Unlock()
 
+	for peerID := range p.replicas().peerIPPort {
+		if peerID != p.id {
+			go func(target int) {
 				reply := &PrepareReply{}
 				p.sendRPC(target, RPCPrepare, args, reply)
 			}(peerID)
@@ -97,31 +109,33 @@ func (p *PBFT) broadcastPrepare(view int, seq int, digest string) {
 }
 
 func (p *PBFT) broadcastCommit(view int, seq int, digest string) {
-	data := digestCommit(view, seq, digest, p.id)
+	sig, auth, err := p.signMessage(digestCommit(view, seq, digest, p.id))
+	if err != nil {
+		p.logPut(LogConsensus, slog.LevelError, "Error signing Commit", "seq", seq, "err", err)
+		return
+	}
 
-	for peerID := range p.peerIPPort {
-		if peerID != p.id {
-			go func(target int) {
-				var sig []byte
-				var err error
-				if p.cryptoType == CryptoMAC {
-					sig, err = sign(p.macKeys[target], data)
-				} else {
-					sig, err = sign(p.privKey, data)
-				}
-				if err != nil {
-					p.logPut("Error signing Commit", RED)
-					return
-				}
+	args := &CommitArgs{
+		View:           view,
+		SequenceNumber: seq,
+		Digest:         digest,
+		NodeID:         p.id,
+		Signature:      sig,
+		Auth:           auth,
+	}
 
-				args := &CommitArgs{
-					View:           view,
-					SequenceNumber: seq,
-					Digest:         digest,
-					NodeID:         p.id,
-					Signature:      sig,
-				}
+	// Keep our own Commit for the audit trail
+	if p.audit != nil {
+		p.mu.Lock()
+		state := p.getRequestState(seq)
+		state.CommitProofs[p.id] = args
+		p.auditLocked(seq, state)
+		p.mu.Unlock()
+	}
 
+	for peerID := range p.replicas().peerIPPort {
+		if peerID != p.id {
+			go func(target int) {
 				reply := &CommitReply{}
 				p.sendRPC(target, RPCCommit, args, reply)
 			}(peerID)
@@ -129,6 +143,105 @@ func (p *PBFT) broadcastCommit(view int, seq int, digest string) {
 	}
 }
 
+// signMessage authenticates data for every replica at once: an ed25519 signature,
+// or an authenticator in MAC mode.
+func (p *PBFT) signMessage(data []byte) ([]byte, Authenticator, error) {
+	if p.cryptoType == CryptoMAC {
+		auth, err := newAuthenticator(p.macKeys.Load().current, data)
+		return nil, auth, err
+	}
+	sig, err := sign(p.privKey, data)
+	return sig, nil, err
+}
+
+// verifyMessage checks that data was sent by sender. In MAC mode only the entry
+// for this replica can be checked.
+func (p *PBFT) verifyMessage(sender int, data []byte, sig []byte, auth Authenticator) error {
+	if p.cryptoType == CryptoMAC {
+		keys := p.macKeys.Load()
+		key := keys.current[sender]
+		if key == nil {
+			return fmt.Errorf("no MAC key for node %d", sender)
+		}
+		err := auth.verify(p.id, key, data)
+		if err != nil {
+			// Keys being refreshed (see recovery.go)
+			for _, spare := range keys.spare(sender) {
+				if spare != nil && auth.verify(p.id, spare, data) == nil {
+					return nil
+				}
+			}
+		}
+		return err
+	}
+	key := p.replicas().pubKeys[sender]
+	if key == nil {
+		return fmt.Errorf("no public key for node %d", sender)
+	}
+	return verify(key, data, sig)
+}
+
+// preparedCertificateLocked returns the PrePrepare and 2f matching Prepares that
+// prove seq prepared at this replica, or nil if it has not prepared. This is the
+// P-set entry a ViewChange carries.
+func (p *PBFT) preparedCertificateLocked(seq int) *PreparedCertificate {
+	state, ok := p.reqState[seq]
+	if !ok || !state.Prepared || state.PrePrepareMsg == nil {
+		return nil
+	}
+	cert := &PreparedCertificate{PrePrepare: state.PrePrepareMsg, PrepareQC: state.PrepareQC}
+	for _, prep := range state.PrepareProofs {
+		if prep.Digest == state.PrePrepareMsg.Digest {
+			cert.Prepares = append(cert.Prepares, prep)
+		}
+	}
+	return cert
+}
+
+// verifyPreparedCertificate checks a certificate relayed by another replica. With
+// authenticators every message still carries an entry for us, so this works in
+// MAC mode as well as with signatures.
+func (p *PBFT) verifyPreparedCertificate(cert *PreparedCertificate) error {
+	pp := cert.PrePrepare
+	if pp == nil {
+		return fmt.Errorf("certificate has no PrePrepare")
+	}
+	primaryID := p.proposer(pp.View, pp.SequenceNumber)
+	if err := p.verifyMessage(primaryID, digestPrePrepare(pp.View, pp.SequenceNumber, pp.Digest, pp.Command), pp.Signature, pp.Auth); err != nil {
+		return fmt.Errorf("PrePrepare: %v", err)
+	}
+	if err := p.checkPayload(pp); err != nil {
+		return fmt.Errorf("PrePrepare %v", err)
+	}
+
+	if qc := cert.PrepareQC; qc != nil {
+		if qc.Phase != PhasePrepare || qc.View != pp.View || qc.SequenceNumber != pp.SequenceNumber || qc.Digest != pp.Digest {
+			return fmt.Errorf("quorum certificate does not match the PrePrepare")
+		}
+		return p.verifyQuorumCert(qc)
+	}
+
+	senders := make(map[int]bool)
+	for _, prep := range cert.Prepares {
+		if prep.View != pp.View || prep.SequenceNumber != pp.SequenceNumber || prep.Digest != pp.Digest {
+			return fmt.Errorf("Prepare from %d does not match the PrePrepare", prep.NodeID)
+		}
+		if prep.NodeID == primaryID || senders[prep.NodeID] {
+			continue
+		}
+		if err := p.verifyMessage(prep.NodeID, digestPrepare(prep.View, prep.SequenceNumber, prep.Digest, prep.NodeID), prep.Signature, prep.Auth); err != nil {
+			return fmt.Errorf("Prepare from %d: %v", prep.NodeID, err)
+		}
+		senders[prep.NodeID] = true
+	}
+
+	// The PrePrepare stands for the primary's vote
+	if need := p.quorumSize() - 1; len(senders) < need {
+		return fmt.Errorf("only %d valid Prepares, need %d", len(senders), need)
+	}
+	return nil
+}
+
 func (p *PBFT) checkPreparedLocked(state *RequestState, seq int, digest string) {
 	if state.Prepared {
 		return
@@ -146,13 +259,9 @@ func (p *PBFT) checkPreparedLocked(state *RequestState, seq int, digest string)
 		return
 	}
 
-	// We need 2f Prepares from *other* replicas.
-	// Actually, the condition is 2f+1 matches (including PrePrepare).
-	// Since we are consistent, let's just count how many unique nodes agreed (PrePrepare sender + Prepare senders).
-	// But PrePrepare sender is Primary.
-
-	f := (p.clusterSize - 1) / 3
-	quorum := 2 * f // We need 2f Prepares because PrePrepare counts as 1.
+	// A quorum of matching votes, the PrePrepare counting as the primary's:
+	// 2f Prepares from other replicas when N = 3f+1.
+	quorum := p.quorumSize() - 1
 
 	count := 0
 	for _, d := range state.PrepareMsgs {
@@ -163,7 +272,8 @@ func (p *PBFT) checkPreparedLocked(state *RequestState, seq int, digest string)
 
 	if count >= quorum {
 		state.Prepared = true
-		p.logPutLocked(fmt.Sprintf("Seq %d Prepared (Quorum %d). Broadcasting Commit.", seq, quorum), GREEN)
+		p.markLocked(state, TracePrepared)
+		p.logPutLocked(LogConsensus, slog.LevelDebug, "Prepared, broadcasting Commit", "seq", seq, "quorum", quorum)
 
 		// Add own Commit
 		state.CommitMsgs[p.id] = digest
@@ -183,8 +293,7 @@ func (p *PBFT) checkCommittedLocked(state *RequestState, seq int, digest string)
 		return
 	}
 
-	f := (p.clusterSize - 1) / 3
-	quorum := 2*f + 1
+	quorum := p.quorumSize()
 
 	count := 0
 	for _, d := range state.CommitMsgs {
@@ -195,12 +304,30 @@ func (p *PBFT) checkCommittedLocked(state *RequestState, seq int, digest string)
 
 	if count >= quorum {
 		state.Committed = true
-		p.logPutLocked(fmt.Sprintf("Seq %d Committed (Quorum %d). Executing.", seq, quorum), GREEN)
+		p.markLocked(state, TraceCommitted)
+		p.logPutLocked(LogConsensus, slog.LevelDebug, "Committed, executing", "seq", seq, "quorum", quorum)
 
-		// Execute
-		if state.PrePrepareMsg != nil {
-			p.executeLocked(seq, state.PrePrepareMsg.Command)
+		p.executeCommittedLocked()
+	}
+}
+
+// executeCommittedLocked executes committed requests in sequence order. A request
+// that commits before its predecessors waits for them, so every replica applies
+// the same sequence of batches. With --disseminate it also waits for the batch,
+// fetching it if needed.
+func (p *PBFT) executeCommittedLocked() {
+	for {
+		seq := p.lastExecuted + 1
+		state, ok := p.reqState[seq]
+		if !ok || !state.Committed || state.PrePrepareMsg == nil {
+			return
+		}
+		command := p.batchLocked(state.PrePrepareMsg)
+		if command == nil {
+			p.fetchBatchLocked(state.PrePrepareMsg.Digest)
+			return
 		}
+		p.executeLocked(seq, command)
 	}
 }
 
@@ -209,27 +336,24 @@ func (p *PBFT) executeLocked(seq int, command []byte) {
 	if seq > p.sequenceNumber {
 		p.sequenceNumber = seq
 	}
-
-	// Apply to State Machine
-	// Try to decode as batch. If it fails (e.g. single command from older version or test), fallback?
-	// But we changed processWriteBatch to always pack.
-	// So we assume it is a batch.
-
-	cmds, err := decodeBatch(command)
-	var results []string
-
-	if err != nil {
-		p.logPutLocked("Error decoding batch, treating as single command", RED)
-		val := p.applyCommandLocked(command)
-		results = append(results, val)
-	} else {
-		for _, cmd := range cmds {
-			val := p.applyCommandLocked(cmd)
-			results = append(results, val)
-		}
+	prev := p.lastExecuted
+	p.lastExecuted = seq
+
+	resultValue := p.applyBatchLocked(command)
+	if state, ok := p.reqState[seq]; ok {
+		p.markLocked(state, TraceExecuted)
+		p.traceDoneLocked(seq, state)
+		p.auditLocked(seq, state)
 	}
-
-	resultValue := encodeBatchResults(results)
+	p.metrics.executedBatch()
+	if p.learner {
+		// Learners answer nobody and take no checkpoints
+		p.welcome = nil
+		return
+	}
+	p.maybeCheckpointLocked(seq)
+	p.reconfiguredLocked(seq)
+	p.publishLocked(prev, seq, command)
 
 	if p.isPrimary() {
 		// Primary is local to the client in this simulation.
@@ -237,14 +361,20 @@ func (p *PBFT) executeLocked(seq int, command []byte) {
 		p.handleClientReplyLocked(seq, p.id, resultValue)
 	} else {
 		// Backup nodes send their reply to the Primary (who hosts the client)
-		// Find Primary ID
-		primaryID := (p.view % p.clusterSize) + 1
+		primaryID := p.primaryID()
 
 		args := &ClientReplyArgs{
 			SequenceNumber: seq,
 			NodeID:         p.id,
 			Value:          resultValue,
 		}
+		sig, auth, err := p.signMessage(digestClientReply(seq, p.id, resultValue))
+		if err != nil {
+			p.logPutLocked(LogClient, slog.LevelError, "Error signing ClientReply", "seq", seq, "err", err)
+			return
+		}
+		args.Signature = sig
+		args.Auth = auth
 
 		go func(target int, a *ClientReplyArgs) {
 			reply := &ClientReplyReply{}
@@ -253,25 +383,34 @@ func (p *PBFT) executeLocked(seq int, command []byte) {
 	}
 }
 
-func (p *PBFT) sendRPC(peerID int, method string, args interface{}, reply interface{}) bool {
-	p.mu.Lock()
-	client := p.rpcConns[peerID]
-	p.mu.Unlock()
+// applyBatchLocked applies every command in a batch to the state machine and
+// returns the encoded results.
+func (p *PBFT) applyBatchLocked(command []byte) string {
+	// Try to decode as batch. If it fails (e.g. single command from older version or test), fallback?
+	// But we changed processWriteBatch to always pack.
+	// So we assume it is a batch.
 
-	if client == nil {
-		// Try to connect (simple retry logic)
-		p.dialRPCToPeer(peerID)
-		p.mu.Lock()
-		client = p.rpcConns[peerID]
-		p.mu.Unlock()
-		if client == nil {
-			return false
+	cmds, err := decodeBatch(command)
+	var results []string
+
+	if err != nil {
+		p.logPutLocked(LogExec, slog.LevelError, "Error decoding batch, treating it as a single command", "err", err)
+		val := p.applyCommandLocked(command)
+		results = append(results, val)
+	} else {
+		for _, cmd := range cmds {
+			val := p.applyCommandLocked(cmd)
+			results = append(results, val)
 		}
 	}
 
-	err := client.Call(method, args, reply)
+	return encodeBatchResults(results)
+}
+
+func (p *PBFT) sendRPC(peerID int, method string, args interface{}, reply interface{}) bool {
+	err := p.conns.Call(peerID, method, args, reply)
 	if err != nil {
-		// p.logPut(fmt.Sprintf("RPC %s to %d failed: %v", method, peerID, err), PURPLE)
+		// p.logPut(LogNet, slog.LevelDebug, "RPC failed", "peer", peerID, "method", method, "err", err)
 		return false
 	}
 	return true
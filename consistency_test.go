@@ -16,8 +16,10 @@ const (
 	ConfFile   = "cluster.conf"
 )
 
-func buildBinary(t *testing.T) {
-	cmd := exec.Command("go", "build", "-o", TestBinary, ".")
+// buildBinary builds the node with the test-only fault RPCs.
+func buildBinary(t *testing.T, flags ...string) {
+	args := append([]string{"build", "-tags", "testfaults"}, flags...)
+	cmd := exec.Command("go", append(args, "-o", TestBinary, ".")...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
@@ -25,7 +27,7 @@ func buildBinary(t *testing.T) {
 	}
 }
 
-func startNode(t *testing.T, id int, workers int, logDir string) *exec.Cmd {
+func startNode(t *testing.T, id int, workers int, logDir string, extraArgs ...string) *exec.Cmd {
 	// Ensure log directory exists
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		t.Fatalf("Failed to create log dir: %v", err)
@@ -43,8 +45,11 @@ func startNode(t *testing.T, id int, workers int, logDir string) *exec.Cmd {
 		"--workers", fmt.Sprintf("%d", workers),
 		"--in-memory", // Use in-memory for speed and avoiding disk cleanup issues
 		"--crypto", "ed25519",
+		"--insecure-test-keys",
 		"--workload", "ycsb-a", // Default workload
+		"--history", historyPath(logDir, id),
 	}
+	args = append(args, extraArgs...)
 
 	cmd := exec.Command(TestBinary, args...)
 	cmd.Stdout = logFile
@@ -56,6 +61,10 @@ func startNode(t *testing.T, id int, workers int, logDir string) *exec.Cmd {
 	return cmd
 }
 
+func historyPath(logDir string, id int) string {
+	return filepath.Join(logDir, fmt.Sprintf("history_%d.json", id))
+}
+
 func waitForCompletion(t *testing.T, logPath string, timeout time.Duration) {
 	start := time.Now()
 	for {
@@ -74,15 +83,29 @@ func waitForCompletion(t *testing.T, logPath string, timeout time.Duration) {
 	}
 }
 
-func checkConsistency(t *testing.T) {
+// checkNoRaces fails if a node built with -race reported a data race.
+func checkNoRaces(t *testing.T, logDir string, ids []int) {
+	for _, id := range ids {
+		content, err := os.ReadFile(filepath.Join(logDir, fmt.Sprintf("node_%d.log", id)))
+		if err != nil {
+			t.Errorf("Failed to read log of node %d: %v", id, err)
+			continue
+		}
+		if i := strings.Index(string(content), "WARNING: DATA RACE"); i >= 0 {
+			t.Errorf("Node %d reported a data race:\n%s", id, content[i:min(len(content), i+4000)])
+		}
+	}
+}
+
+// checkConsistencyOf compares the state of the given nodes, leaving out crashed ones.
+func checkConsistencyOf(t *testing.T, ids []int) {
 	// Wait a bit for propagation
 	time.Sleep(2 * time.Second)
 
 	checksums := make(map[string][]int)
 	counts := make(map[int]int)
 
-	// Connect to all 4 nodes
-	for id := 1; id <= 4; id++ {
+	for _, id := range ids {
 		// Port is 6000 + id - 1
 		port := 6000 + id - 1
 		client, err := rpc.Dial("tcp", fmt.Sprintf("localhost:%d", port))
@@ -121,44 +144,204 @@ func checkConsistency(t *testing.T) {
 	}
 }
 
-func TestYCSBConsistency(t *testing.T) {
-	buildBinary(t)
-	defer os.Remove(TestBinary)
+func checkLinearizability(t *testing.T, path string) {
+	events, err := LoadHistory(path)
+	if err != nil {
+		t.Fatalf("Failed to load history %s: %v", path, err)
+	}
 
-	// workerCounts := []int{10, 50, 100, 200}
-	// For "10000+ commands", with 10s duration:
-	// 10 workers * 10s is likely > 1000 ops if >10ops/sec/worker.
-	// We want to be sure.
-	// Let's use a few increasing steps.
-	workerCounts := []int{10, 50, 100}
+	report := CheckHistory(events, 60*time.Second)
+	t.Logf("Linearizability check of %d events: %v", len(events), report.Result)
+	switch report.Result {
+	case CheckIllegal:
+		for _, v := range report.Violations {
+			t.Errorf("Linearizability violation (%d operations):\n%s", len(v), FormatViolation(KVModel, v))
+		}
+	case CheckUnknown:
+		t.Logf("Linearizability check timed out")
+	}
+}
 
-	for _, workers := range workerCounts {
-		t.Run(fmt.Sprintf("Workers-%d", workers), func(t *testing.T) {
-			logDir := filepath.Join("logs", fmt.Sprintf("test_workers_%d", workers))
-			cmds := make([]*exec.Cmd, 4)
+// clusterSpec describes a test cluster.
+type clusterSpec struct {
+	name    string // log directory under logs/
+	workers int
+	race    bool // build the nodes with the race detector and fail on a reported race
+}
 
-			// cleanup previous runs just in case
-			exec.Command("pkill", "-f", TestBinary).Run()
+func (s clusterSpec) logDir() string {
+	return filepath.Join("logs", s.name)
+}
+
+// file writes a file for the nodes into the log directory and returns its path.
+func (s clusterSpec) file(t *testing.T, name string, content string) string {
+	if err := os.MkdirAll(s.logDir(), 0755); err != nil {
+		t.Fatalf("Failed to create log dir: %v", err)
+	}
+	path := filepath.Join(s.logDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+	return path
+}
+
+// testCluster is a set of nodes running the test binary.
+type testCluster struct {
+	t      *testing.T
+	spec   clusterSpec
+	logDir string
+	cmds   map[int]*exec.Cmd
+}
+
+// runCluster builds the binary and starts nodes 1-4 of cluster.conf with args.
+// Further nodes (a joining replica, a learner) are started with start. Every
+// node is killed when the test ends.
+func runCluster(t *testing.T, spec clusterSpec, args ...string) *testCluster {
+	if spec.race {
+		buildBinary(t, "-race")
+	} else {
+		buildBinary(t)
+	}
+	exec.Command("pkill", "-f", TestBinary).Run()
 
-			for i := 1; i <= 4; i++ {
-				cmds[i-1] = startNode(t, i, workers, logDir)
+	c := &testCluster{t: t, spec: spec, logDir: spec.logDir(), cmds: make(map[int]*exec.Cmd)}
+	t.Cleanup(func() {
+		for _, cmd := range c.cmds {
+			if cmd.Process != nil {
+				cmd.Process.Kill()
 			}
+		}
+		exec.Command("pkill", "-f", TestBinary).Run()
+		os.Remove(TestBinary)
+	})
+	for id := 1; id <= 4; id++ {
+		c.start(id, args...)
+	}
+	return c
+}
 
-			// Ensure cleanup
-			defer func() {
-				for _, cmd := range cmds {
-					if cmd.Process != nil {
-						cmd.Process.Kill()
-					}
-				}
-				exec.Command("pkill", "-f", TestBinary).Run()
-			}()
+func (c *testCluster) start(id int, args ...string) {
+	c.cmds[id] = startNode(c.t, id, c.spec.workers, c.logDir, args...)
+}
+
+func (c *testCluster) kill(id int) {
+	c.cmds[id].Process.Kill()
+}
 
-			// Wait for Node 1 (Primary) to finish
-			primaryLog := filepath.Join(logDir, "node_1.log")
-			waitForCompletion(t, primaryLog, 30*time.Second)
+// command runs an admin subcommand of the binary against the cluster.
+func (c *testCluster) command(args ...string) {
+	out, err := exec.Command(TestBinary, args...).CombinedOutput()
+	if err != nil {
+		c.t.Fatalf("%v: %v\n%s", args, err, out)
+	}
+}
 
-			checkConsistency(t)
+// finish waits for the client on node 1 (the primary) to complete, then checks
+// that the nodes in ids agree on the state and that the history is linearizable.
+func (c *testCluster) finish(timeout time.Duration, ids ...int) {
+	waitForCompletion(c.t, filepath.Join(c.logDir, "node_1.log"), timeout)
+	checkConsistencyOf(c.t, ids)
+	checkLinearizability(c.t, historyPath(c.logDir, 1))
+	if c.spec.race {
+		checkNoRaces(c.t, c.logDir, ids)
+	}
+}
+
+func TestYCSBConsistency(t *testing.T) {
+	// For "10000+ commands" in the 10s run, with a few increasing steps
+	for _, workers := range []int{10, 50, 100} {
+		t.Run(fmt.Sprintf("Workers-%d", workers), func(t *testing.T) {
+			c := runCluster(t, clusterSpec{name: fmt.Sprintf("test_workers_%d", workers), workers: workers})
+			c.finish(30*time.Second, 1, 2, 3, 4)
 		})
 	}
 }
+
+func TestHotStuffConsistency(t *testing.T) {
+	// Node 1 hosts the client as with PBFT
+	c := runCluster(t, clusterSpec{name: "test_hotstuff", workers: 50}, "--protocol", "hotstuff")
+	c.finish(30*time.Second, 1, 2, 3, 4)
+}
+
+func TestSpeculativeConsistency(t *testing.T) {
+	c := runCluster(t, clusterSpec{name: "test_speculative", workers: 50}, "--speculative")
+	c.finish(30*time.Second, 1, 2, 3, 4)
+}
+
+func TestDisseminationConsistency(t *testing.T) {
+	c := runCluster(t, clusterSpec{name: "test_disseminate", workers: 50}, "--disseminate")
+	c.finish(30*time.Second, 1, 2, 3, 4)
+}
+
+func TestMultiLeaderConsistency(t *testing.T) {
+	c := runCluster(t, clusterSpec{name: "test_leaders", workers: 50}, "--leaders", "4")
+	c.finish(30*time.Second, 1, 2, 3, 4)
+}
+
+func TestMultiLeaderEpochChange(t *testing.T) {
+	c := runCluster(t, clusterSpec{name: "test_leaders_crash", workers: 50}, "--leaders", "4")
+
+	// Crash leader 3 while the client runs: its sequence numbers stall until
+	// the others move to an epoch without it
+	time.Sleep(CLIENT_START + 2*time.Second)
+	c.kill(3)
+
+	c.finish(60*time.Second, 1, 2, 4)
+}
+
+func TestMembershipChange(t *testing.T) {
+	spec := clusterSpec{name: "test_membership", workers: 10}
+	c := runCluster(t, spec)
+
+	// Node 5 only appears in the config the new replica and the admin tool use
+	conf := spec.file(t, "cluster5.conf", `[
+  { "id": 1, "ip": "localhost", "port": 6000},
+  { "id": 2, "ip": "localhost", "port": 6001},
+  { "id": 3, "ip": "localhost", "port": 6002},
+  { "id": 4, "ip": "localhost", "port": 6003},
+  { "id": 5, "ip": "localhost", "port": 6004}
+]`)
+	c.start(5, "--conf", conf, "--join")
+
+	// Change the replica set while the client runs
+	time.Sleep(CLIENT_START + 2*time.Second)
+	c.command("cluster", "--conf", conf, "add", "5")
+	time.Sleep(2 * time.Second)
+	c.command("cluster", "--conf", conf, "remove", "4")
+
+	c.finish(30*time.Second, 1, 2, 3, 5)
+}
+
+func TestLearner(t *testing.T) {
+	spec := clusterSpec{name: "test_learner", workers: 10}
+	conf := spec.file(t, "cluster_learner.conf", `[
+  { "id": 1, "ip": "localhost", "port": 6000},
+  { "id": 2, "ip": "localhost", "port": 6001},
+  { "id": 3, "ip": "localhost", "port": 6002},
+  { "id": 4, "ip": "localhost", "port": 6003},
+  { "id": 5, "ip": "localhost", "port": 6004, "role": "learner"}
+]`)
+
+	// Stale reads rotate through the learner as well
+	args := []string{"--conf", conf, "--read-mode", "stale(256)"}
+	c := runCluster(t, spec, args...)
+	c.start(5, args...)
+
+	c.finish(30*time.Second, 1, 2, 3, 4, 5)
+}
+
+func TestProactiveRecovery(t *testing.T) {
+	// Key refreshes swap the keys that signing and verification read without
+	// p.mu, so the nodes run with the race detector
+	spec := clusterSpec{name: "test_recovery", workers: 10, race: true}
+	faults := spec.file(t, "faults.json", "{}")
+
+	// Every replica recovers twice during the run, refreshing its MAC keys
+	c := runCluster(t, spec, "--crypto", "mac", "--recovery", "8s", "--faults", faults)
+
+	// Node 3's state drifts; its next recovery has to repair it
+	time.Sleep(CLIENT_START + time.Second)
+	c.command("faults", "--conf", ConfFile, "--id", "3", "corrupt", "corrupted", "yes")
+
+	c.finish(60*time.Second, 1, 2, 3, 4)
+}
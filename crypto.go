@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"fmt"
 	mrand "math/rand"
+	"sort"
 )
 
 // CryptoType represents the authentication scheme
@@ -14,10 +15,13 @@ type CryptoType string
 const (
 	CryptoEd25519 CryptoType = "ed25519"
 	CryptoMAC     CryptoType = "mac"
+	// CryptoMultiSig uses ed25519 keys, but replicas send their Prepare and Commit
+	// votes only to the primary, which combines them into quorum certificates.
+	CryptoMultiSig CryptoType = "multisig"
 )
 
 // DeterministicReader is a dummy reader for deterministic key generation (FOR TESTING ONLY)
-// In production, use crypto/rand.Reader
+// Real keys come from `pbft keygen`; these are only used with --insecure-test-keys.
 type DeterministicReader struct {
 	src mrand.Source
 }
@@ -83,15 +87,147 @@ func verify(key interface{}, data []byte, signature []byte) error {
 	}
 }
 
-// Helper to construct data for signing
-func digestPrePrepare(view int, seq int, digest string) []byte {
-	return []byte(fmt.Sprintf("%d:%d:%s", view, seq, digest))
+// Authenticator is a vector of MACs over the same message, one per replica, as in
+// the PBFT paper. The sender computes it once and sends the identical message to
+// everyone; each replica checks only its own entry. Since nothing in the message is
+// tailored to the receiver, it can be relayed inside certificates and every replica
+// can still check the entry meant for it.
+type Authenticator map[int][]byte
+
+func newAuthenticator(macKeys map[int][]byte, data []byte) (Authenticator, error) {
+	auth := make(Authenticator, len(macKeys))
+	for id, key := range macKeys {
+		mac, err := sign(key, data)
+		if err != nil {
+			return nil, err
+		}
+		auth[id] = mac
+	}
+	return auth, nil
+}
+
+// verify checks the entry for receiver, using the key receiver shares with the sender.
+func (a Authenticator) verify(receiver int, key []byte, data []byte) error {
+	mac, ok := a[receiver]
+	if !ok {
+		return fmt.Errorf("authenticator has no entry for node %d", receiver)
+	}
+	return verify(key, data, mac)
+}
+
+// Helpers to construct data for signing: the canonical encoding of each message
+// (see encoding.go), covering every field except the signature itself.
+func digestPrePrepare(view int, seq int, digest string, command []byte) []byte {
+	return newCanonicalEncoder(TAG_PREPREPARE).putInt(view).putInt(seq).putString(digest).putBytes(command).bytes()
 }
 
 func digestPrepare(view int, seq int, digest string, nodeID int) []byte {
-	return []byte(fmt.Sprintf("%d:%d:%s:%d", view, seq, digest, nodeID))
+	return newCanonicalEncoder(TAG_PREPARE).putInt(view).putInt(seq).putString(digest).putInt(nodeID).bytes()
 }
 
 func digestCommit(view int, seq int, digest string, nodeID int) []byte {
-	return []byte(fmt.Sprintf("%d:%d:%s:%d", view, seq, digest, nodeID))
+	return newCanonicalEncoder(TAG_COMMIT).putInt(view).putInt(seq).putString(digest).putInt(nodeID).bytes()
+}
+
+func digestClientReply(seq int, nodeID int, value string) []byte {
+	return newCanonicalEncoder(TAG_CLIENT_REPLY).putInt(seq).putInt(nodeID).putString(value).bytes()
+}
+
+// Vote shares for quorum certificates leave out the sender: every replica signs
+// the same bytes, so any 2f+1 shares form a certificate.
+func digestVote(phase VotePhase, view int, seq int, digest string) []byte {
+	tag := TAG_PREPARE_VOTE
+	switch phase {
+	case PhaseCommit:
+		tag = TAG_COMMIT_VOTE
+	case PhaseHotStuff:
+		tag = TAG_HOTSTUFF_VOTE
+	}
+	return newCanonicalEncoder(tag).putInt(view).putInt(seq).putString(digest).bytes()
+}
+
+func digestHotStuffBlock(view int, round int, height int, parent string, batchID string, command []byte, proposer int) []byte {
+	return newCanonicalEncoder(TAG_HOTSTUFF_BLOCK).putInt(view).putInt(round).putInt(height).putString(parent).putString(batchID).putBytes(command).putInt(proposer).bytes()
+}
+
+func digestHotStuffNewView(view int, round int, nodeID int, highQCRound int, highQCDigest string) []byte {
+	return newCanonicalEncoder(TAG_HOTSTUFF_NEW_VIEW).putInt(view).putInt(round).putInt(nodeID).putInt(highQCRound).putString(highQCDigest).bytes()
+}
+
+// digestHistory extends the history hash of everything executed before a batch
+// with that batch's digest.
+func digestHistory(prev string, digest string) string {
+	return hash(newCanonicalEncoder(TAG_HISTORY).putString(prev).putString(digest).bytes())
+}
+
+func digestSpecReply(view int, seq int, digest string, history string, nodeID int, value string) []byte {
+	return newCanonicalEncoder(TAG_SPEC_REPLY).putInt(view).putInt(seq).putString(digest).putString(history).putInt(nodeID).putString(value).bytes()
+}
+
+func digestLocalCommit(view int, seq int, digest string, history string, nodeID int) []byte {
+	return newCanonicalEncoder(TAG_LOCAL_COMMIT).putInt(view).putInt(seq).putString(digest).putString(history).putInt(nodeID).bytes()
+}
+
+func digestBatch(digest string, nodeID int, forward bool) []byte {
+	f := 0
+	if forward {
+		f = 1
+	}
+	return newCanonicalEncoder(TAG_BATCH).putString(digest).putInt(nodeID).putInt(f).bytes()
+}
+
+func digestReadReply(readID int, digest string, nodeID int, value string) []byte {
+	return newCanonicalEncoder(TAG_READ_REPLY).putInt(readID).putString(digest).putInt(nodeID).putString(value).bytes()
+}
+
+func digestCheckpoint(seq int, stateDigest string, nodeID int) []byte {
+	return newCanonicalEncoder(TAG_CHECKPOINT).putInt(seq).putString(stateDigest).putInt(nodeID).bytes()
+}
+
+// digestEpochChange covers a vote and the PrePrepare of every certificate in it;
+// the certificates carry their own signatures.
+func digestEpochChange(args *EpochChangeArgs) []byte {
+	e := newCanonicalEncoder(TAG_EPOCH_CHANGE).putInt(args.Epoch).putInt(len(args.Suspects))
+	for _, id := range args.Suspects {
+		e.putInt(id)
+	}
+	e.putInt(args.NodeID).putInt(args.Checkpoint).putInt(len(args.Prepared))
+	for _, cert := range args.Prepared {
+		pp := cert.PrePrepare
+		e.putInt(pp.View).putInt(pp.SequenceNumber).putString(pp.Digest)
+	}
+	return e.bytes()
+}
+
+// digestJoin covers a state handover: the replica set, and the state in key order.
+func digestJoin(args *JoinArgs) []byte {
+	e := newCanonicalEncoder(TAG_JOIN).putInt(args.SequenceNumber).putInt(args.View).putInt(len(args.Members))
+	for _, m := range args.Members {
+		e.putInt(m.ID).putString(m.Addr).putBytes(m.PublicKey).putBytes(m.TLSCert)
+	}
+	keys := make([]string, 0, len(args.State))
+	for k := range args.State {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	e.putInt(len(keys))
+	for _, k := range keys {
+		e.putString(k).putString(args.State[k])
+	}
+	return e.putInt(args.NodeID).bytes()
+}
+
+// digestLearn covers a report to the learners; the batch is checked against the digest.
+func digestLearn(args *LearnArgs) []byte {
+	return newCanonicalEncoder(TAG_LEARN).putInt(args.Previous).putInt(args.SequenceNumber).putString(args.Digest).putInt(args.StableCheckpoint).putInt(args.NodeID).bytes()
+}
+
+// digestNewKey covers a session key announcement (TAG_NEW_KEY), the answer to
+// announcement epoch (TAG_NEW_KEY_REPLY) or its confirmation (TAG_NEW_KEY_CONFIRM).
+func digestNewKey(tag string, nodeID int, epoch int, public []byte) []byte {
+	return newCanonicalEncoder(tag).putInt(nodeID).putInt(epoch).putBytes(public).bytes()
+}
+
+func digestStableCheckpoint(nonce int, seq int, stateDigest string, nodeID int) []byte {
+	return newCanonicalEncoder(TAG_STABLE_CHECKPOINT).putInt(nonce).putInt(seq).putString(stateDigest).putInt(nodeID).bytes()
 }
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestReplica(t *testing.T, id int, n int, cryptoType CryptoType) *PBFT {
+	nodes := make([]Node, n)
+	members := make([]int, n)
+	for i := range nodes {
+		nodes[i] = Node{ID: i + 1}
+		members[i] = i + 1
+	}
+	keys, err := insecureTestKeys(id, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &PBFT{
+		id:         id,
+		cryptoType: cryptoType,
+	}
+	p.macKeys.Store(&macKeySet{current: keys.macKeys})
+	pubKeys := make(map[int]interface{})
+	if cryptoType != CryptoMAC {
+		p.privKey = keys.priv
+		for peer, pub := range keys.pubKeys {
+			pubKeys[peer] = pub
+		}
+	}
+	p.replicaSet.Store(&replicaSet{members: members, pubKeys: pubKeys, clusterSize: n})
+	return p
+}
+
+// A prepared certificate assembled by one backup must be checkable by another,
+// including in MAC mode where messages carry authenticators.
+func TestPreparedCertificateRelay(t *testing.T) {
+	for _, cryptoType := range []CryptoType{CryptoMAC, CryptoEd25519} {
+		t.Run(string(cryptoType), func(t *testing.T) {
+			replicas := make(map[int]*PBFT)
+			for id := 1; id <= 4; id++ {
+				replicas[id] = newTestReplica(t, id, 4, cryptoType)
+			}
+
+			digest := hash([]byte("cmd"))
+			sig, auth, err := replicas[1].signMessage(digestPrePrepare(0, 1, digest, []byte("cmd")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert := &PreparedCertificate{
+				PrePrepare: &PrePrepareArgs{View: 0, SequenceNumber: 1, Digest: digest, Command: []byte("cmd"), Signature: sig, Auth: auth},
+			}
+			for _, id := range []int{2, 3} {
+				sig, auth, err := replicas[id].signMessage(digestPrepare(0, 1, digest, id))
+				if err != nil {
+					t.Fatal(err)
+				}
+				cert.Prepares = append(cert.Prepares, &PrepareArgs{View: 0, SequenceNumber: 1, Digest: digest, NodeID: id, Signature: sig, Auth: auth})
+			}
+
+			if err := replicas[4].verifyPreparedCertificate(cert); err != nil {
+				t.Fatalf("replica 4 rejected a valid certificate: %v", err)
+			}
+
+			// Tampering with the entry meant for replica 4 must be detected
+			forged := *cert.Prepares[0]
+			if cryptoType == CryptoMAC {
+				forged.Auth = Authenticator{}
+				for id, mac := range cert.Prepares[0].Auth {
+					forged.Auth[id] = mac
+				}
+				forged.Auth[4] = make([]byte, len(forged.Auth[4]))
+			} else {
+				forged.Signature = make([]byte, len(forged.Signature))
+			}
+			cert.Prepares[0] = &forged
+			if err := replicas[4].verifyPreparedCertificate(cert); err == nil {
+				t.Fatalf("replica 4 accepted a forged Prepare")
+			}
+		})
+	}
+}
+
+func TestSigningDomainSeparation(t *testing.T) {
+	p := newTestReplica(t, 2, 4, CryptoEd25519)
+	digest := hash([]byte("cmd"))
+
+	sig, _, err := p.signMessage(digestPrepare(0, 1, digest, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.verifyMessage(2, digestPrepare(0, 1, digest, 2), sig, nil); err != nil {
+		t.Fatalf("valid Prepare rejected: %v", err)
+	}
+	// Same fields, different message type
+	if err := p.verifyMessage(2, digestCommit(0, 1, digest, 2), sig, nil); err == nil {
+		t.Fatalf("Prepare signature accepted as a Commit")
+	}
+}
+
+// Keys and values may contain any byte, so states that only differ in where a
+// key ends must not hash the same.
+func TestStateDigestUnambiguous(t *testing.T) {
+	states := []map[string]string{
+		{"a": "b;c:d"},
+		{"a": "b", "c": "d"},
+		{"a:b": "c"},
+		{"a": "b:c"},
+		{},
+	}
+	seen := make(map[string]int)
+	for i, state := range states {
+		digest := stateDigest(state)
+		if j, ok := seen[digest]; ok {
+			t.Fatalf("states %v and %v have the same digest", states[j], state)
+		}
+		seen[digest] = i
+	}
+	if stateDigest(map[string]string{"x": "1", "y": "2"}) != stateDigest(map[string]string{"y": "2", "x": "1"}) {
+		t.Fatalf("digest depends on map order")
+	}
+}
+
+func TestPrePrepareDigestMustMatchCommand(t *testing.T) {
+	primary := newTestReplica(t, 1, 4, CryptoEd25519)
+	backup := newTestReplica(t, 2, 4, CryptoEd25519)
+
+	// A correctly signed PrePrepare whose digest is not the hash of its payload
+	digest := hash([]byte("honest"))
+	sig, _, err := primary.signMessage(digestPrePrepare(0, 1, digest, []byte("evil")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &PreparedCertificate{
+		PrePrepare: &PrePrepareArgs{View: 0, SequenceNumber: 1, Digest: digest, Command: []byte("evil"), Signature: sig},
+	}
+	if err := backup.verifyPreparedCertificate(cert); err == nil {
+		t.Fatalf("accepted a PrePrepare whose digest does not match its command")
+	}
+}
+
+// Verification jobs must run side by side: each of these blocks until all of
+// them have started, which deadlocks if the pool runs them one at a time.
+func TestVerifierRunsConcurrently(t *testing.T) {
+	const workers = 4
+	v := NewVerifier(workers)
+
+	var started sync.WaitGroup
+	started.Add(workers)
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			errs <- v.Verify(func() error {
+				started.Done()
+				started.Wait()
+				if i == 0 {
+					return fmt.Errorf("bad signature")
+				}
+				return nil
+			})
+		}(i)
+	}
+
+	failed := 0
+	for i := 0; i < workers; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				failed++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("verification jobs did not run concurrently")
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("got %d failed verifications, want 1", failed)
+	}
+}
+
+func TestQuorumCert(t *testing.T) {
+	const n = 7 // f = 2, quorum 5
+	replicas := make(map[int]*PBFT)
+	for id := 1; id <= n; id++ {
+		replicas[id] = newTestReplica(t, id, n, CryptoMultiSig)
+	}
+	digest := hash([]byte("batch"))
+	shares := make(map[int][]byte)
+	for id := 1; id <= 5; id++ {
+		share, err := sign(replicas[id].privKey, digestVote(PhasePrepare, 0, 1, digest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		shares[id] = share
+	}
+
+	qc := newQuorumCert(PhasePrepare, 0, 1, digest, shares)
+	if err := replicas[7].verifyQuorumCert(qc); err != nil {
+		t.Fatalf("valid certificate rejected: %v", err)
+	}
+
+	// Prepare shares are not valid commit votes
+	commit := *qc
+	commit.Phase = PhaseCommit
+	if err := replicas[7].verifyQuorumCert(&commit); err == nil {
+		t.Fatalf("prepare certificate accepted as a commit certificate")
+	}
+
+	// One replica counted twice does not make a quorum
+	delete(shares, 5)
+	short := newQuorumCert(PhasePrepare, 0, 1, digest, shares)
+	short.Signers = append(short.Signers, 1)
+	short.Shares = append(short.Shares, shares[1])
+	if err := replicas[7].verifyQuorumCert(short); err == nil {
+		t.Fatalf("certificate with a repeated signer accepted")
+	}
+}
+
+// Quorums must intersect in f+1 replicas for any N, not only N = 3f+1: after a
+// membership change from 4 to 5 replicas, 3 votes are no longer enough.
+func TestQuorumSize(t *testing.T) {
+	for n, want := range map[int]int{4: 3, 5: 4, 6: 4, 7: 5} {
+		if got := quorumOf(n); got != want {
+			t.Errorf("quorumOf(%d) = %d, want %d", n, got, want)
+		}
+	}
+	for n := 1; n <= 40; n++ {
+		q, f := quorumOf(n), maxFaulty(n)
+		if 2*q-n < f+1 || q > n-f {
+			t.Errorf("n=%d: quorum %d does not intersect in f+1=%d or exceeds n-f", n, q, f+1)
+		}
+	}
+
+	for _, n := range []int{5, 6} {
+		t.Run(fmt.Sprintf("n=%d", n), func(t *testing.T) {
+			replicas := make(map[int]*PBFT)
+			for id := 1; id <= n; id++ {
+				replicas[id] = newTestReplica(t, id, n, CryptoEd25519)
+			}
+			quorum := quorumOf(n)
+			digest := hash([]byte("cmd"))
+			sig, _, err := replicas[1].signMessage(digestPrePrepare(0, 1, digest, []byte("cmd")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert := &PreparedCertificate{
+				PrePrepare: &PrePrepareArgs{View: 0, SequenceNumber: 1, Digest: digest, Command: []byte("cmd"), Signature: sig},
+			}
+			shares := make(map[int][]byte)
+			for id := 2; id <= quorum; id++ {
+				sig, _, err := replicas[id].signMessage(digestPrepare(0, 1, digest, id))
+				if err != nil {
+					t.Fatal(err)
+				}
+				cert.Prepares = append(cert.Prepares, &PrepareArgs{View: 0, SequenceNumber: 1, Digest: digest, NodeID: id, Signature: sig})
+				if shares[id], err = sign(replicas[id].privKey, digestVote(PhaseCommit, 0, 1, digest)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			verifier := replicas[n]
+
+			// The primary and quorum-1 backups make a quorum, one backup fewer does not
+			if err := verifier.verifyPreparedCertificate(cert); err != nil {
+				t.Fatalf("certificate with %d votes rejected: %v", quorum, err)
+			}
+			cert.Prepares = cert.Prepares[1:]
+			if err := verifier.verifyPreparedCertificate(cert); err == nil {
+				t.Fatalf("certificate with %d of %d votes accepted", quorum-1, n)
+			}
+
+			if err := verifier.verifyQuorumCert(newQuorumCert(PhaseCommit, 0, 1, digest, shares)); err == nil {
+				t.Fatalf("quorum certificate with %d of %d shares accepted", len(shares), n)
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Dissemination layer for --disseminate: request batches travel separately from
+// ordering, so the primary does not ship every payload to every backup. The
+// primary hands each batch to one backup, rotating with the sequence number, and
+// that backup forwards it to the rest. The PrePrepare then carries only the batch
+// digest. Replicas agree on the digest as usual, and a replica that commits a
+// batch it has not received fetches it from its peers before executing.
+//
+// A replica only ever stores a payload under the digest it hashes to, and only
+// takes batches signed by a member. Batches are logged once a PrePrepare orders
+// them and dropped when the stable checkpoint passes their sequence number; one
+// that nothing orders counts as ordered at the high water mark of its arrival, so
+// it is dropped a log window later.
+
+const (
+	RPCBatch      = "PBFT.Batch"
+	RPCFetchBatch = "PBFT.FetchBatch"
+
+	FETCH_DELAY          = 10 * time.Millisecond // the relayed copy is usually on its way
+	FETCH_RETRIES        = 10
+	FETCH_RETRY_INTERVAL = 50 * time.Millisecond
+)
+
+type BatchArgs struct {
+	NodeID    int
+	Command   []byte
+	Forward   bool // pass it on to every replica except the sender
+	Signature []byte
+	Auth      Authenticator
+}
+
+type BatchReply struct {
+	Success bool
+}
+
+type FetchBatchArgs struct {
+	Digest string
+}
+
+type FetchBatchReply struct {
+	Success bool
+	Command []byte
+}
+
+// dissemBatch is a disseminated batch and the sequence number it is kept for.
+type dissemBatch struct {
+	command []byte // nil until it arrives
+	seq     int
+	ordered bool // a PrePrepare orders it, so it is in the WAL once it arrives
+}
+
+// batchLocked returns the batch a PrePrepare orders, or nil while the batch of a
+// digest-only PrePrepare has not arrived.
+func (p *PBFT) batchLocked(pp *PrePrepareArgs) []byte {
+	if len(pp.Command) > 0 {
+		return pp.Command
+	}
+	if b, ok := p.batches[pp.Digest]; ok {
+		return b.command
+	}
+	return nil
+}
+
+// hasBatchLocked reports whether the batch of digest has arrived.
+func (p *PBFT) hasBatchLocked(digest string) bool {
+	b, ok := p.batches[digest]
+	return ok && b.command != nil
+}
+
+// checkPayload checks that a PrePrepare's digest is the hash of its batch. Only
+// with --disseminate may a PrePrepare carry the digest alone; its batch is
+// checked when it is stored.
+func (p *PBFT) checkPayload(pp *PrePrepareArgs) error {
+	if len(pp.Command) == 0 && p.disseminate {
+		return nil
+	}
+	if hash(pp.Command) != pp.Digest {
+		return fmt.Errorf("digest does not match its command")
+	}
+	return nil
+}
+
+// storeBatchLocked keeps a disseminated batch and runs whatever was waiting for it.
+func (p *PBFT) storeBatchLocked(command []byte) {
+	digest := hash(command)
+	b, ok := p.batches[digest]
+	if ok && b.command != nil {
+		return
+	}
+	if !ok {
+		b = &dissemBatch{seq: p.stableCheckpoint + LOG_WINDOW}
+		p.batches[digest] = b
+	}
+	b.command = command
+	if b.ordered {
+		p.logBatchLocked(b)
+	}
+
+	if p.spec != nil {
+		p.speculateLocked()
+	} else {
+		p.executeCommittedLocked()
+	}
+}
+
+// orderBatchLocked notes that seq orders a digest-only PrePrepare's batch, which
+// keeps the batch until the stable checkpoint passes seq.
+func (p *PBFT) orderBatchLocked(pp *PrePrepareArgs) {
+	if len(pp.Command) > 0 {
+		return
+	}
+	b, ok := p.batches[pp.Digest]
+	if !ok {
+		b = &dissemBatch{}
+		p.batches[pp.Digest] = b
+	}
+	if b.ordered {
+		b.seq = max(b.seq, pp.SequenceNumber)
+		return
+	}
+	b.seq = pp.SequenceNumber
+	b.ordered = true
+	if b.command != nil {
+		p.logBatchLocked(b)
+	}
+}
+
+func (p *PBFT) logBatchLocked(b *dissemBatch) {
+	if err := p.storage.AppendEntry(LogEntry{View: p.view, Command: b.command}); err != nil {
+		p.logPutLocked(LogDissem, slog.LevelError, "Failed to append batch to log", "seq", b.seq, "err", err)
+	}
+}
+
+// pruneBatchesLocked drops the batches of sequence numbers below a new stable
+// checkpoint.
+func (p *PBFT) pruneBatchesLocked(stable int) {
+	for digest, b := range p.batches {
+		if b.seq < stable {
+			delete(p.batches, digest)
+		}
+	}
+}
+
+// sendBatch hands a batch to the backup that relays it for seq.
+func (p *PBFT) sendBatch(seq int, command []byte) {
+	relay := p.id
+	for i := 0; relay == p.id; i++ {
+		relay = p.memberAt(seq + i)
+	}
+	args, err := p.signedBatch(command, true)
+	if err != nil {
+		p.logPut(LogDissem, slog.LevelError, "Error signing Batch", "seq", seq, "err", err)
+		return
+	}
+	reply := &BatchReply{}
+	if !p.sendRPC(relay, RPCBatch, args, reply) {
+		p.logPut(LogDissem, slog.LevelWarn, "Relay did not take the batch", "peer", relay, "seq", seq)
+	}
+}
+
+func (p *PBFT) signedBatch(command []byte, forward bool) (*BatchArgs, error) {
+	sig, auth, err := p.signMessage(digestBatch(hash(command), p.id, forward))
+	if err != nil {
+		return nil, err
+	}
+	return &BatchArgs{NodeID: p.id, Command: command, Forward: forward, Signature: sig, Auth: auth}, nil
+}
+
+// Batch stores a batch from a member and, when asked to, relays it to the other
+// replicas.
+func (p *PBFT) Batch(args *BatchArgs, reply *BatchReply) error {
+	if !p.isMember(args.NodeID) {
+		p.logPut(LogDissem, slog.LevelWarn, "Batch from a node that is not a member", "peer", args.NodeID)
+		reply.Success = false
+		return nil
+	}
+	err := p.verifier.Verify(func() error {
+		return p.verifyMessage(args.NodeID, digestBatch(hash(args.Command), args.NodeID, args.Forward), args.Signature, args.Auth)
+	})
+	if err != nil {
+		p.logPut(LogDissem, slog.LevelWarn, "Signature verification failed for Batch", "peer", args.NodeID, "err", err)
+		reply.Success = false
+		return nil
+	}
+
+	p.mu.Lock()
+	p.storeBatchLocked(args.Command)
+	p.mu.Unlock()
+
+	if args.Forward {
+		fwd, err := p.signedBatch(args.Command, false)
+		if err != nil {
+			p.logPut(LogDissem, slog.LevelError, "Error signing Batch", "err", err)
+			reply.Success = false
+			return nil
+		}
+		for peerID := range p.replicas().peerIPPort {
+			if peerID != p.id && peerID != args.NodeID {
+				go func(target int) {
+					reply := &BatchReply{}
+					p.sendRPC(target, RPCBatch, fwd, reply)
+				}(peerID)
+			}
+		}
+	}
+	reply.Success = true
+	return nil
+}
+
+// FetchBatch serves a batch another replica is missing.
+func (p *PBFT) FetchBatch(args *FetchBatchArgs, reply *FetchBatchReply) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if b, ok := p.batches[args.Digest]; ok && b.command != nil {
+		reply.Success = true
+		reply.Command = b.command
+	}
+	return nil
+}
+
+// fetchBatchLocked starts fetching a batch unless a fetch is already running.
+func (p *PBFT) fetchBatchLocked(digest string) {
+	if p.fetching[digest] {
+		return
+	}
+	p.fetching[digest] = true
+	go p.fetchBatch(digest)
+}
+
+// fetchBatch asks every peer in turn for a batch, for a few rounds. If nobody has
+// it, the next replica that needs the batch starts over.
+func (p *PBFT) fetchBatch(digest string) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.fetching, digest)
+		p.mu.Unlock()
+	}()
+
+	time.Sleep(FETCH_DELAY)
+	for attempt := 0; attempt < FETCH_RETRIES; attempt++ {
+		for i := 1; i < p.replicas().clusterSize; i++ {
+			p.mu.RLock()
+			ok := p.hasBatchLocked(digest)
+			p.mu.RUnlock()
+			if ok {
+				return
+			}
+
+			target := p.memberAt(p.id - 1 + i)
+			reply := &FetchBatchReply{}
+			if !p.sendRPC(target, RPCFetchBatch, &FetchBatchArgs{Digest: digest}, reply) || !reply.Success {
+				continue
+			}
+			if hash(reply.Command) != digest {
+				p.logPut(LogDissem, slog.LevelWarn, "Fetched batch does not match its digest", "peer", target, "digest", digest)
+				continue
+			}
+			p.logPut(LogDissem, slog.LevelDebug, "Fetched batch", "peer", target, "digest", digest)
+			p.mu.Lock()
+			p.storeBatchLocked(reply.Command)
+			p.mu.Unlock()
+			return
+		}
+		time.Sleep(FETCH_RETRY_INTERVAL)
+	}
+	p.logPut(LogDissem, slog.LevelError, "Could not fetch batch from any replica", "digest", digest)
+}
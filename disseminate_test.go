@@ -0,0 +1,113 @@
+package main
+
+import "testing"
+
+func newDisseminateReplica(t *testing.T) *PBFT {
+	p := newTestPrimary(t, 4)
+	p.disseminate = true
+	p.batches = make(map[string]*dissemBatch)
+	p.fetching = make(map[string]bool)
+	p.verifier = NewVerifier(1)
+	return p
+}
+
+// Only batches signed by a member are stored.
+func TestBatchRequiresMember(t *testing.T) {
+	p := newDisseminateReplica(t)
+	node2 := newTestReplica(t, 2, 4, CryptoEd25519)
+	outsider := newTestReplica(t, 5, 5, CryptoEd25519)
+	command := encodeBatch([][]byte{[]byte("SET a 1")})
+
+	store := func(args *BatchArgs) bool {
+		reply := &BatchReply{}
+		if err := p.Batch(args, reply); err != nil {
+			t.Fatal(err)
+		}
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		return reply.Success && p.hasBatchLocked(hash(command))
+	}
+
+	if store(&BatchArgs{NodeID: 2, Command: command}) {
+		t.Fatalf("stored an unsigned batch")
+	}
+	args, err := outsider.signedBatch(command, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store(args) {
+		t.Fatalf("stored a batch from node 5, which is not a member")
+	}
+	args, err = node2.signedBatch(command, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args.Forward = true
+	if store(args) {
+		t.Fatalf("stored a batch whose Forward flag was changed after signing")
+	}
+	args.Forward = false
+	if !store(args) {
+		t.Fatalf("did not store a batch signed by node 2")
+	}
+}
+
+// Batches go once the stable checkpoint passes the sequence number that orders
+// them; a batch nothing orders goes a log window after it arrived.
+func TestBatchesPrunedAtStableCheckpoint(t *testing.T) {
+	p := newDisseminateReplica(t)
+	ordered := encodeBatch([][]byte{[]byte("SET a 1")})
+	unordered := encodeBatch([][]byte{[]byte("SET b 1")})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.storeBatchLocked(ordered)
+	p.storeBatchLocked(unordered)
+	p.orderBatchLocked(&PrePrepareArgs{SequenceNumber: 5, Digest: hash(ordered)})
+	entries, _, _ := p.storage.Size()
+	if entries != 1 {
+		t.Fatalf("%d batches in the WAL, want only the ordered one", entries)
+	}
+
+	p.stableCheckpoint = CHECKPOINT_INTERVAL
+	p.stableLocked(CHECKPOINT_INTERVAL, "")
+	if p.hasBatchLocked(hash(ordered)) {
+		t.Fatalf("batch ordered at 5 kept past stable checkpoint %d", CHECKPOINT_INTERVAL)
+	}
+	if !p.hasBatchLocked(hash(unordered)) {
+		t.Fatalf("unordered batch dropped before a log window passed")
+	}
+
+	p.stableCheckpoint = LOG_WINDOW + CHECKPOINT_INTERVAL
+	p.stableLocked(p.stableCheckpoint, "")
+	if len(p.batches) != 0 {
+		t.Fatalf("%d batches left after a log window", len(p.batches))
+	}
+}
+
+// A PrePrepare without its batch passes only with --disseminate.
+func TestCheckPayload(t *testing.T) {
+	p := newTestPrimary(t, 4)
+	command := encodeBatch([][]byte{[]byte("SET a 1")})
+	full := &PrePrepareArgs{Digest: hash(command), Command: command}
+	digestOnly := &PrePrepareArgs{Digest: hash(command)}
+	forged := &PrePrepareArgs{Digest: hash(command), Command: encodeBatch([][]byte{[]byte("SET a 2")})}
+
+	for _, disseminate := range []bool{false, true} {
+		p.disseminate = disseminate
+		if err := p.checkPayload(full); err != nil {
+			t.Fatalf("disseminate=%v: batch rejected: %v", disseminate, err)
+		}
+		if err := p.checkPayload(forged); err == nil {
+			t.Fatalf("disseminate=%v: batch that does not match its digest accepted", disseminate)
+		}
+	}
+	p.disseminate = false
+	if err := p.checkPayload(digestOnly); err == nil {
+		t.Fatalf("digest-only PrePrepare accepted without --disseminate")
+	}
+	p.disseminate = true
+	if err := p.checkPayload(digestOnly); err != nil {
+		t.Fatalf("digest-only PrePrepare rejected with --disseminate: %v", err)
+	}
+}
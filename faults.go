@@ -0,0 +1,509 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault injection for replica links. Every connection to or from a known peer is
+// wrapped in a faultConn that shapes what this node sends on it: one-way delay with
+// jitter, a bandwidth cap and packet loss. Since all traffic is TCP, a lost segment
+// shows up the way it does on a real network, as a retransmission stall on the
+// stream (Retransmit, default 200ms like Linux's minimum RTO), not as a missing
+// message. Partitions cut links completely: connections across the cut are closed
+// and redials are refused until the partition is lifted.
+
+const (
+	DEFAULT_RETRANSMIT = 200 * time.Millisecond
+	FAULT_QUEUE_SIZE   = 1024
+)
+
+// Duration that reads and writes as "25ms" in JSON.
+type faultDuration time.Duration
+
+func (d *faultDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = faultDuration(v)
+	return nil
+}
+
+func (d faultDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Bandwidth in bytes per second, written like tc rates ("100mbit", "512kbit").
+type faultRate int64
+
+func parseRate(s string) (faultRate, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	units := []struct {
+		suffix string
+		bits   float64
+	}{
+		{"gbit", 1e9},
+		{"mbit", 1e6},
+		{"kbit", 1e3},
+		{"bit", 1},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			v, err := strconv.ParseFloat(strings.TrimSuffix(s, u.suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid rate %q", s)
+			}
+			return faultRate(v * u.bits / 8), nil
+		}
+	}
+	// Plain number: bytes per second
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return faultRate(v), nil
+}
+
+func (r *faultRate) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := parseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
+
+func (r faultRate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%dkbit", int64(r)*8/1000))
+}
+
+type LinkFault struct {
+	Delay     faultDuration `json:"delay,omitempty"`
+	Jitter    faultDuration `json:"jitter,omitempty"`
+	Loss      float64       `json:"loss,omitempty"`      // probability per write
+	Bandwidth faultRate     `json:"bandwidth,omitempty"` // 0 = unlimited
+}
+
+func (l LinkFault) String() string {
+	return fmt.Sprintf("delay=%v jitter=%v loss=%.3f bandwidth=%dkbit", time.Duration(l.Delay), time.Duration(l.Jitter), l.Loss, int64(l.Bandwidth)*8/1000)
+}
+
+// FaultConfig is the JSON file passed with --faults. The same file is meant to be
+// deployed to every node; each node only applies the links it sends on.
+type FaultConfig struct {
+	Default    LinkFault            `json:"default"`
+	Links      map[string]LinkFault `json:"links"`      // "1->2": overrides Default for that direction
+	Partitions map[string][][]int   `json:"partitions"` // name -> groups of node IDs
+	Active     string               `json:"active"`     // partition active at startup
+	Retransmit faultDuration        `json:"retransmit"`
+}
+
+type FaultInjector struct {
+	self int
+
+	mu         sync.Mutex
+	def        LinkFault
+	links      map[[2]int]LinkFault
+	partitions map[string][][]int
+	active     string
+	retransmit time.Duration
+	conns      map[*faultConn]struct{}
+	rng        *rand.Rand
+}
+
+func NewFaultInjector(self int, path string) (*FaultInjector, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var conf FaultConfig
+	if err := json.Unmarshal(file, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse fault config: %v", err)
+	}
+
+	f := &FaultInjector{
+		self:       self,
+		def:        conf.Default,
+		links:      make(map[[2]int]LinkFault),
+		partitions: conf.Partitions,
+		retransmit: time.Duration(conf.Retransmit),
+		conns:      make(map[*faultConn]struct{}),
+		rng:        rand.New(rand.NewSource(time.Now().UnixNano() + int64(self))),
+	}
+	if f.partitions == nil {
+		f.partitions = make(map[string][][]int)
+	}
+	if f.retransmit == 0 {
+		f.retransmit = DEFAULT_RETRANSMIT
+	}
+	for spec, lf := range conf.Links {
+		var from, to int
+		if _, err := fmt.Sscanf(spec, "%d->%d", &from, &to); err != nil {
+			return nil, fmt.Errorf("invalid link %q, expected \"from->to\"", spec)
+		}
+		f.links[[2]int{from, to}] = lf
+	}
+	if conf.Active != "" {
+		if _, ok := f.partitions[conf.Active]; !ok {
+			return nil, fmt.Errorf("unknown partition %q", conf.Active)
+		}
+		f.active = conf.Active
+	}
+	return f, nil
+}
+
+func (f *FaultInjector) linkLocked(peer int) LinkFault {
+	if lf, ok := f.links[[2]int{f.self, peer}]; ok {
+		return lf
+	}
+	return f.def
+}
+
+// groupOfLocked returns the index of the group containing id in the active partition.
+// Nodes not listed in any group are cut off from everyone.
+func (f *FaultInjector) groupOfLocked(id int) int {
+	for i, group := range f.partitions[f.active] {
+		for _, member := range group {
+			if member == id {
+				return i
+			}
+		}
+	}
+	return -1 - id
+}
+
+func (f *FaultInjector) partitionedLocked(peer int) bool {
+	// Unknown peers (admin tools, test clients) are never cut off.
+	if f.active == "" || peer <= 0 {
+		return false
+	}
+	return f.groupOfLocked(f.self) != f.groupOfLocked(peer)
+}
+
+func (f *FaultInjector) Partitioned(peer int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.partitionedLocked(peer)
+}
+
+// SetPartition activates a named partition, or heals the network when name is empty.
+func (f *FaultInjector) SetPartition(name string) error {
+	f.mu.Lock()
+	if name != "" {
+		if _, ok := f.partitions[name]; !ok {
+			f.mu.Unlock()
+			return fmt.Errorf("unknown partition %q", name)
+		}
+	}
+	f.active = name
+
+	var cut []*faultConn
+	for c := range f.conns {
+		if f.partitionedLocked(c.peer) {
+			cut = append(cut, c)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, c := range cut {
+		c.Close()
+	}
+	return nil
+}
+
+func (f *FaultInjector) SetLink(from int, to int, lf LinkFault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if from == 0 && to == 0 {
+		f.def = lf
+		return
+	}
+	f.links[[2]int{from, to}] = lf
+}
+
+// schedule returns when a write of n bytes to peer should reach the wire.
+// Called with c.mu held so that chunks keep stream order.
+func (f *FaultInjector) schedule(c *faultConn, n int) time.Time {
+	f.mu.Lock()
+	lf := f.linkLocked(c.peer)
+	delay := time.Duration(lf.Delay)
+	if lf.Jitter > 0 {
+		delay += time.Duration(f.rng.Int63n(2*int64(lf.Jitter)+1)) - time.Duration(lf.Jitter)
+	}
+	if lf.Loss > 0 && f.rng.Float64() < lf.Loss {
+		delay += f.retransmit
+	}
+	f.mu.Unlock()
+
+	now := time.Now()
+	start := now
+	if c.nextFree.After(start) {
+		start = c.nextFree
+	}
+	if lf.Bandwidth > 0 {
+		c.nextFree = start.Add(time.Duration(float64(n) / float64(lf.Bandwidth) * float64(time.Second)))
+	} else {
+		c.nextFree = start
+	}
+
+	at := c.nextFree.Add(max(delay, 0))
+	// TCP delivers in order, so jitter can never reorder the stream.
+	if at.Before(c.lastAt) {
+		at = c.lastAt
+	}
+	c.lastAt = at
+	return at
+}
+
+func (f *FaultInjector) wrap(conn net.Conn, peer int) net.Conn {
+	c := &faultConn{
+		Conn:  conn,
+		inj:   f,
+		peer:  peer,
+		queue: make(chan faultChunk, FAULT_QUEUE_SIZE),
+		done:  make(chan struct{}),
+	}
+	f.mu.Lock()
+	f.conns[c] = struct{}{}
+	f.mu.Unlock()
+	go c.pump()
+	return c
+}
+
+type faultChunk struct {
+	data []byte
+	at   time.Time
+}
+
+type faultConn struct {
+	net.Conn
+	inj  *FaultInjector
+	peer int
+
+	mu       sync.Mutex
+	nextFree time.Time
+	lastAt   time.Time
+
+	queue     chan faultChunk
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	if c.inj.Partitioned(c.peer) {
+		c.Close()
+		return 0, fmt.Errorf("link to %d is partitioned", c.peer)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	chunk := faultChunk{data: append([]byte(nil), b...), at: c.inj.schedule(c, len(b))}
+	select {
+	case c.queue <- chunk:
+		return len(b), nil
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *faultConn) pump() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case chunk := <-c.queue:
+			if d := time.Until(chunk.at); d > 0 {
+				timer.Reset(d)
+				select {
+				case <-c.done:
+					return
+				case <-timer.C:
+				}
+			}
+			if _, err := c.Conn.Write(chunk.data); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *faultConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.inj.mu.Lock()
+		delete(c.inj.conns, c)
+		c.inj.mu.Unlock()
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// Admin RPC
+
+const (
+	RPCFaultsPartition = "Faults.Partition"
+	RPCFaultsSetLink   = "Faults.SetLink"
+	RPCFaultsStatus    = "Faults.Status"
+	RPCFaultsCorrupt   = "Faults.Corrupt"
+)
+
+type FaultService struct {
+	p *PBFT
+}
+
+type FaultsPartitionArgs struct {
+	Name string // empty heals
+}
+
+type FaultsSetLinkArgs struct {
+	From  int // From == To == 0 sets the default
+	To    int
+	Fault LinkFault
+}
+
+type FaultsStatusArgs struct{}
+
+// FaultsCorruptArgs is served only by binaries built with -tags testfaults (see
+// faults_corrupt.go).
+type FaultsCorruptArgs struct {
+	Key   string
+	Value string
+}
+
+type FaultsReply struct {
+	Enabled    bool
+	Active     string
+	Partitions []string
+	Default    LinkFault
+	Links      map[string]LinkFault
+}
+
+func (s *FaultService) injector() (*FaultInjector, error) {
+	if s.p.faults == nil {
+		return nil, fmt.Errorf("node %d was started without --faults", s.p.id)
+	}
+	return s.p.faults, nil
+}
+
+func (s *FaultService) Partition(args *FaultsPartitionArgs, reply *FaultsReply) error {
+	f, err := s.injector()
+	if err != nil {
+		return err
+	}
+	if err := f.SetPartition(args.Name); err != nil {
+		return err
+	}
+	if args.Name == "" {
+		s.p.logPut(LogFaults, slog.LevelWarn, "Network healed")
+	} else {
+		s.p.logPut(LogFaults, slog.LevelWarn, "Partition activated", "partition", args.Name)
+	}
+	return s.Status(&FaultsStatusArgs{}, reply)
+}
+
+func (s *FaultService) SetLink(args *FaultsSetLinkArgs, reply *FaultsReply) error {
+	f, err := s.injector()
+	if err != nil {
+		return err
+	}
+	f.SetLink(args.From, args.To, args.Fault)
+	return s.Status(&FaultsStatusArgs{}, reply)
+}
+
+func (s *FaultService) Status(args *FaultsStatusArgs, reply *FaultsReply) error {
+	f := s.p.faults
+	if f == nil {
+		reply.Enabled = false
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reply.Enabled = true
+	reply.Active = f.active
+	reply.Default = f.def
+	reply.Links = make(map[string]LinkFault)
+	for link, lf := range f.links {
+		reply.Links[fmt.Sprintf("%d->%d", link[0], link[1])] = lf
+	}
+	for name := range f.partitions {
+		reply.Partitions = append(reply.Partitions, name)
+	}
+	sort.Strings(reply.Partitions)
+	return nil
+}
+
+// faultsCommand sends a Faults RPC to every node in confPath (or only target) and
+// prints the resulting state of each node. With TLS enabled the tool has to
+// authenticate as a replica (as) to reach the Faults service.
+func faultsCommand(confPath string, target int, as int, method string, args interface{}) error {
+	peers := parseConfig(confPath)
+	ids := make([]int, 0, len(peers))
+	for id := range peers {
+		if target == 0 || id == target {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	failed := 0
+	for _, id := range ids {
+		client, err := dialNode(confPath, id, as)
+		if err != nil {
+			fmt.Printf("node %d: unreachable: %v\n", id, err)
+			failed++
+			continue
+		}
+		reply := &FaultsReply{}
+		err = client.Call(method, args, reply)
+		client.Close()
+		if err != nil {
+			fmt.Printf("node %d: %v\n", id, err)
+			failed++
+			continue
+		}
+		if !reply.Enabled {
+			fmt.Printf("node %d: fault injection disabled\n", id)
+			continue
+		}
+		active := reply.Active
+		if active == "" {
+			active = "(none)"
+		}
+		fmt.Printf("node %d: partition=%s available=%v\n", id, active, reply.Partitions)
+		fmt.Printf("  default: %v\n", reply.Default)
+		links := make([]string, 0, len(reply.Links))
+		for link := range reply.Links {
+			links = append(links, link)
+		}
+		sort.Strings(links)
+		for _, link := range links {
+			fmt.Printf("  %s: %v\n", link, reply.Links[link])
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d node(s) failed", failed)
+	}
+	return nil
+}
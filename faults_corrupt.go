@@ -0,0 +1,18 @@
+//go:build testfaults
+
+package main
+
+import "log/slog"
+
+// Corrupt changes the state machine behind consensus' back, like a compromised
+// replica would. It exists only in test builds.
+func (s *FaultService) Corrupt(args *FaultsCorruptArgs, reply *FaultsReply) error {
+	if _, err := s.injector(); err != nil {
+		return err
+	}
+	s.p.mu.Lock()
+	s.p.StateMachine[args.Key] = args.Value
+	s.p.logPutLocked(LogFaults, slog.LevelWarn, "State corrupted", "key", args.Key, "value", args.Value)
+	s.p.mu.Unlock()
+	return s.Status(&FaultsStatusArgs{}, reply)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestInjector(t *testing.T, self int, conf string) *FaultInjector {
+	path := filepath.Join(t.TempDir(), "faults.json")
+	if err := os.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFaultInjector(self, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFaultConnDelayKeepsOrder(t *testing.T) {
+	f := newTestInjector(t, 1, `{"links": {"1->2": {"delay": "30ms", "jitter": "20ms"}}}`)
+	a, b := net.Pipe()
+	conn := f.wrap(a, 2)
+	defer conn.Close()
+
+	start := time.Now()
+	go func() {
+		for i := 0; i < 10; i++ {
+			conn.Write([]byte{byte(i)})
+		}
+	}()
+
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(b, buf); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Fatalf("expected delayed delivery, got %v", elapsed)
+	}
+	for i, v := range buf {
+		if int(v) != i {
+			t.Fatalf("stream reordered: %v", buf)
+		}
+	}
+}
+
+func TestFaultPartition(t *testing.T) {
+	f := newTestInjector(t, 1, `{"partitions": {"split": [[1, 2], [3, 4]]}}`)
+	a, _ := net.Pipe()
+	conn := f.wrap(a, 3)
+
+	if f.Partitioned(3) {
+		t.Fatalf("no partition is active yet")
+	}
+	if err := f.SetPartition("split"); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Partitioned(3) || f.Partitioned(2) {
+		t.Fatalf("unexpected partition state")
+	}
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Fatalf("write across the partition should fail")
+	}
+	if f.Partitioned(0) {
+		t.Fatalf("unknown peers must never be partitioned")
+	}
+
+	f.SetPartition("")
+	if f.Partitioned(3) {
+		t.Fatalf("heal should lift the partition")
+	}
+	if err := f.SetPartition("missing"); err == nil {
+		t.Fatalf("expected error for unknown partition")
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	cases := map[string]faultRate{
+		"100mbit": 12500000,
+		"512kbit": 64000,
+		"1gbit":   125000000,
+		"2048":    2048,
+	}
+	for in, want := range cases {
+		got, err := parseRate(in)
+		if err != nil || got != want {
+			t.Errorf("parseRate(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+}
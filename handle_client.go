@@ -1,27 +1,151 @@
 package main
 
 import (
+	"fmt"
+	"log/slog"
+	"sync"
 	"time"
 )
 
 const (
-	READ_LINGER_TIME  = 15 * time.Millisecond
-	WRITE_LINGER_TIME = 15 * time.Millisecond
+	READ_LINGER_TIME       = 15 * time.Millisecond
+	WRITE_LINGER_TIME      = 15 * time.Millisecond
+	CLIENT_REQUEST_TIMEOUT = 10 * time.Second
+
+	BatchingStatic   = "static"
+	BatchingAdaptive = "adaptive"
+
+	// Bounds for --batching adaptive
+	ADAPTIVE_MIN_LINGER = 500 * time.Microsecond
+	ADAPTIVE_MAX_LINGER = 50 * time.Millisecond
+	ADAPTIVE_MAX_BATCH  = 1024
 )
 
+// batcher decides how many writes go into a batch and how long a partial batch
+// may linger. With --batching static both stay at --write-batch-size and
+// WRITE_LINGER_TIME. With --batching adaptive they are revised after every flush:
+//   - a batch that filled up while requests are queued or other batches are still
+//     committing doubles the size
+//   - a batch flushed by the timer at most half full with nothing else pending
+//     halves the size (but not below what it held) and halves the linger: load is
+//     light, so waiting only adds latency
+//   - any other batch flushed by the timer doubles the linger, up to half the
+//     observed commit latency, as waiting longer than that only delays requests
+//     that could be pipelined
+//
+// Both modes record every decision for the benchmark results.
+type batcher struct {
+	mu       sync.Mutex
+	adaptive bool
+	size     int
+	linger   time.Duration
+	latency  time.Duration // moving average of commit latency
+
+	flushes  int
+	batched  int           // writes flushed in total
+	lingered time.Duration // sum of the linger in force at each flush
+}
+
+func newBatcher(size int, adaptive bool) *batcher {
+	return &batcher{adaptive: adaptive, size: size, linger: WRITE_LINGER_TIME}
+}
+
+func (b *batcher) current() (int, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size, b.linger
+}
+
+// flushed records a batch of n writes leaving the batcher. full means it reached
+// the batch size before the linger ran out; backlog counts the requests still
+// queued plus the batches in flight ahead of it. It reports whether the size or
+// linger changed.
+func (b *batcher) flushed(n int, full bool, backlog int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushes++
+	b.batched += n
+	b.lingered += b.linger
+	if !b.adaptive {
+		return false
+	}
+
+	size, linger := b.size, b.linger
+	switch {
+	case full && backlog > 0:
+		b.size = min(b.size*2, ADAPTIVE_MAX_BATCH)
+	case full:
+	case backlog == 0 && n <= b.size/2:
+		b.size = max(b.size/2, n, 1)
+		b.linger = max(b.linger/2, ADAPTIVE_MIN_LINGER)
+	default:
+		limit := ADAPTIVE_MAX_LINGER
+		if b.latency > 0 {
+			limit = min(max(b.latency/2, ADAPTIVE_MIN_LINGER), ADAPTIVE_MAX_LINGER)
+		}
+		b.linger = min(b.linger*2, limit)
+	}
+	return b.size != size || b.linger != linger
+}
+
+// observe feeds in the commit latency of a write batch.
+func (b *batcher) observe(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.latency == 0 {
+		b.latency = d
+		return
+	}
+	b.latency += (d - b.latency) / 8
+}
+
+// summary returns the average batch size and linger over all flushes.
+func (b *batcher) summary() (float64, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.flushes == 0 {
+		return 0, 0
+	}
+	return float64(b.batched) / float64(b.flushes), b.lingered / time.Duration(b.flushes)
+}
+
 func (p *PBFT) handleClientRequest() {
-	writeBatchSize := p.writeBatchSize
-	// readBatchSize := p.readBatchSize // Unused now as we treat reads as writes for consistency
+	readBatchSize := p.readBatchSize
 
 	var writeReqs []ClientRequest
+	var readReqs []ClientRequest
+	writeReady := false // a write batch is waiting for room in the window
 
 	var writeTimer *time.Timer
 	var writeTimerCh <-chan time.Time
+	var readTimer *time.Timer
+	var readTimerCh <-chan time.Time
+
+	// With the window full the batch stays open and keeps growing until a slot
+	// frees up, so batches get larger under load
+	flushWrites := func(full bool) {
+		if len(writeReqs) == 0 {
+			return
+		}
+		if !p.windowOpen() {
+			writeReady = true
+			return
+		}
+		writeReady = false
+		n := len(writeReqs)
+		backlog := len(p.ReqCh) + p.inFlightBatches()
+		p.processWriteBatch(writeReqs)
+		writeReqs = nil
+		if p.batcher.flushed(n, full, backlog) {
+			size, linger := p.batcher.current()
+			p.logPut(LogClient, slog.LevelDebug, "Batcher adjusted", "write_batch", size, "linger", linger)
+		}
+	}
 
-	flushWrites := func() {
-		if len(writeReqs) > 0 {
-			p.processWriteBatch(writeReqs)
-			writeReqs = nil
+	flushReads := func() {
+		if len(readReqs) > 0 {
+			p.processReadBatch(readReqs)
+			readReqs = nil
 		}
 	}
 
@@ -35,25 +159,57 @@ func (p *PBFT) handleClientRequest() {
 	}
 
 	for {
+		writeBatchSize, writeLinger := p.batcher.current()
+
+		// A full batch waiting for the window stops intake: that backpressure
+		// reaches the clients through ReqCh
+		reqCh := p.ReqCh
+		if writeReady && len(writeReqs) >= writeBatchSize {
+			reqCh = nil
+		}
+
 		select {
-		case req := <-p.ReqCh:
-			// Treat all requests (including GET) as write requests to ensure linearizability via consensus
+		case req := <-reqCh:
+			if isReadOnly(req.Command) && !req.Ordered && p.readMode != GuaranteeLinearizable {
+				readReqs = append(readReqs, req)
+				if len(readReqs) >= readBatchSize {
+					flushReads()
+					if readTimer != nil {
+						stopTimer(readTimer)
+						readTimer = nil
+						readTimerCh = nil
+					}
+				} else if readTimer == nil {
+					readTimer = time.NewTimer(READ_LINGER_TIME)
+					readTimerCh = readTimer.C
+				}
+				continue
+			}
+
 			writeReqs = append(writeReqs, req)
 			if len(writeReqs) >= writeBatchSize {
-				flushWrites()
+				flushWrites(true)
 				if writeTimer != nil {
 					stopTimer(writeTimer)
 					writeTimer = nil
 					writeTimerCh = nil
 				}
 			} else if writeTimer == nil {
-				writeTimer = time.NewTimer(WRITE_LINGER_TIME)
+				writeTimer = time.NewTimer(writeLinger)
 				writeTimerCh = writeTimer.C
 			}
 		case <-writeTimerCh:
-			flushWrites()
+			flushWrites(len(writeReqs) >= writeBatchSize)
 			writeTimer = nil
 			writeTimerCh = nil
+		case <-p.windowFree:
+			if writeReady {
+				flushWrites(len(writeReqs) >= writeBatchSize)
+			}
+		case <-readTimerCh:
+			flushReads()
+			readTimer = nil
+			readTimerCh = nil
 		}
 	}
 }
@@ -65,33 +221,178 @@ func (p *PBFT) processWriteBatch(reqs []ClientRequest) {
 		// Drop or forward.
 		return
 	}
+	p.metrics.observeBatch("write", len(reqs))
 
-	cmds := make([][]byte, len(reqs))
+	if p.multi == nil {
+		p.orderBatch(p.id, reqs)
+		return
+	}
+
+	// With several leaders, each bucket of clients goes to its own leader
+	p.mu.Lock()
+	if p.multi.voted > p.view {
+		p.multi.stalled = append(p.multi.stalled, reqs...)
+		p.mu.Unlock()
+		return
+	}
+	groups := make(map[int][]ClientRequest)
+	for _, req := range reqs {
+		leader := p.bucketLeaderLocked(req.ClientID)
+		groups[leader] = append(groups[leader], req)
+	}
+	p.mu.Unlock()
+	for leader, group := range groups {
+		p.orderBatch(leader, group)
+	}
+}
+
+// orderBatch has leader order a batch: us, or with --leaders the leader of the
+// batch's bucket.
+func (p *PBFT) orderBatch(leader int, reqs []ClientRequest) {
 	chans := make([]chan Response, len(reqs))
 	for i, req := range reqs {
-		cmds[i] = req.Command
 		chans[i] = req.RespCh
 	}
 
-	packedCmd := encodeBatch(cmds)
+	packedCmd := encodeRequests(reqs)
 
 	p.mu.Lock()
-	p.sequenceNumber++
-	seq := p.sequenceNumber
+	p.inFlight++
+	p.batchStarted[chans[0]] = time.Now()
+	p.mu.Unlock()
+
+	if p.hotstuff != nil {
+		p.hotstuff.submit(packedCmd, chans)
+		return
+	}
+	if leader != p.id {
+		go p.forwardBatch(leader, packedCmd, reqs)
+		return
+	}
+
+	p.mu.Lock()
+	view := p.view
+	seq := p.nextSeqLocked()
 	p.pendingResponses[seq] = chans
+	if p.multi != nil {
+		p.multi.proposals[seq] = reqs
+	}
+	if queued := oldestQueued(reqs); !queued.IsZero() {
+		p.markAtLocked(p.getRequestState(seq), TraceBatched, queued)
+	}
 	p.mu.Unlock()
 
-	go p.broadcastPrePrepare(seq, packedCmd)
+	go p.broadcastPrePrepare(view, seq, packedCmd)
+}
+
+// windowOpen reports whether another write batch may start.
+func (p *PBFT) windowOpen() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.reconfiguring {
+		return false
+	}
+	return p.windowSize <= 0 || p.inFlight < p.windowSize
+}
+
+func (p *PBFT) inFlightBatches() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.inFlight
+}
+
+// batchDoneLocked frees the window slot of a write batch whose client has been
+// answered, and reports its commit latency to the batcher.
+func (p *PBFT) batchDoneLocked(chans []chan Response) {
+	if len(chans) > 0 {
+		if started, ok := p.batchStarted[chans[0]]; ok {
+			delete(p.batchStarted, chans[0])
+			p.batcher.observe(time.Since(started))
+		}
+	}
+	p.inFlight--
+	select {
+	case p.windowFree <- struct{}{}:
+	default:
+	}
 }
 
-// processReadBatch simulates handling a batch of read requests.
+// processReadBatch sends a batch of GETs to every replica (see read.go).
 func (p *PBFT) processReadBatch(reqs []ClientRequest) {
-	// In a real PBFT, this might just be local read if strong consistency isn't required
-	// or part of the protocol.
-	for _, req := range reqs {
-		select {
-		case req.RespCh <- Response{success: true, value: "val"}:
-		default:
+	p.metrics.observeBatch("read", len(reqs))
+	cmds := make([][]byte, len(reqs))
+	for i, req := range reqs {
+		cmds[i] = req.Command
+	}
+
+	p.mu.Lock()
+	p.nextReadID++
+	args := &ReadArgs{ReadID: p.nextReadID, Command: encodeBatch(cmds)}
+	p.mu.Unlock()
+
+	if p.readMode == GuaranteeStale {
+		args.Stale = true
+		args.MaxLag = p.readMaxLag
+		go p.readStale(args, reqs)
+		return
+	}
+	go p.readQuorum(args, reqs)
+}
+
+// ClientService is the RPC surface for external clients. It is the only service
+// served to callers that do not authenticate as a replica.
+type ClientService struct {
+	p *PBFT
+}
+
+type ClientRequestArgs struct {
+	ClientID int // picks the leader with --leaders
+	Command  []byte
+}
+
+type ClientRequestReply struct {
+	Value     string
+	Guarantee Guarantee // how the answer was served (see read.go)
+}
+
+// Request submits a command to the primary's batcher and waits for its answer.
+// Writes complete on f+1 matching replies; GETs follow --read-mode.
+func (s *ClientService) Request(args *ClientRequestArgs, reply *ClientRequestReply) error {
+	if !s.p.isPrimary() {
+		s.p.mu.RLock()
+		primaryID := s.p.primaryID()
+		s.p.mu.RUnlock()
+		return fmt.Errorf("node %d is not the primary, send to node %d", s.p.id, primaryID)
+	}
+
+	if isReconfig(args.Command) {
+		return fmt.Errorf("reconfigurations go through `pbft cluster`")
+	}
+
+	req := ClientRequest{
+		ClientID: args.ClientID,
+		Command:  args.Command,
+		RespCh:   make(chan Response, 1),
+		Queued:   time.Now(),
+	}
+	timeout := time.NewTimer(CLIENT_REQUEST_TIMEOUT)
+	defer timeout.Stop()
+
+	select {
+	case s.p.ReqCh <- req:
+	case <-timeout.C:
+		return fmt.Errorf("request queue is full")
+	}
+
+	select {
+	case resp := <-req.RespCh:
+		if !resp.success {
+			return fmt.Errorf("request failed")
 		}
+		reply.Value = resp.value
+		reply.Guarantee = resp.guarantee
+		return nil
+	case <-timeout.C:
+		return fmt.Errorf("request timed out after %v", CLIENT_REQUEST_TIMEOUT)
 	}
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestPrimary returns replica 1 of n, ready to order batches. Its WAL is in a
+// temporary directory and it has no connections, so its PrePrepares go nowhere
+// and every batch stays in flight.
+func newTestPrimary(t *testing.T, n int) *PBFT {
+	t.Chdir(t.TempDir())
+	p := newTestReplica(t, 1, n, CryptoEd25519)
+	storage, err := NewStorage(1, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.storage = storage
+	p.reqState = make(map[int]*RequestState)
+	p.pendingResponses = make(map[int][]chan Response)
+	p.batchStarted = make(map[chan Response]time.Time)
+	p.StateMachine = make(map[string]string)
+	p.conns = NewConnManager(p)
+	return p
+}
+
+func TestAdaptiveBatcher(t *testing.T) {
+	b := newBatcher(16, true)
+
+	// Backlog: full batches with more queued grow the batch size
+	b.flushed(16, true, 100)
+	b.flushed(32, true, 100)
+	if size, _ := b.current(); size != 64 {
+		t.Fatalf("size after backlog = %d, want 64", size)
+	}
+
+	// Light load: nearly empty batches on the timer shrink size and linger
+	b.flushed(2, false, 0)
+	if size, linger := b.current(); size != 32 || linger != WRITE_LINGER_TIME/2 {
+		t.Fatalf("after light load got size %d linger %v", size, linger)
+	}
+	for i := 0; i < 5; i++ {
+		b.flushed(1, false, 0)
+	}
+	if size, linger := b.current(); size != 1 || linger != ADAPTIVE_MIN_LINGER {
+		t.Fatalf("at idle got size %d linger %v", size, linger)
+	}
+	if b.flushed(1, true, 0) {
+		t.Fatal("a full batch without a backlog changed the decisions")
+	}
+
+	// Lingering is capped at half the commit latency
+	b = newBatcher(16, true)
+	b.observe(4 * time.Millisecond)
+	b.flushed(12, false, 0)
+	if _, linger := b.current(); linger != 2*time.Millisecond {
+		t.Fatalf("linger = %v, want half the commit latency", linger)
+	}
+
+	// Static batching never changes, but still records its flushes
+	b = newBatcher(16, false)
+	if b.flushed(1, false, 0) || b.flushed(16, true, 100) {
+		t.Fatal("static batcher changed its decisions")
+	}
+	if avg, linger := b.summary(); avg != 8.5 || linger != WRITE_LINGER_TIME {
+		t.Fatalf("summary = %.1f, %v", avg, linger)
+	}
+}
+
+// With the window full the open batch keeps taking requests up to the batch
+// size, then intake stops; a batch answered frees the slot for it.
+func TestWindowBackpressure(t *testing.T) {
+	p := newTestPrimary(t, 4)
+	p.windowSize = 2
+	p.windowFree = make(chan struct{}, 1)
+	p.ReqCh = make(chan ClientRequest, 100)
+	p.batcher = newBatcher(4, false)
+
+	var maxInFlight atomic.Int64
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if n := int64(p.inFlightBatches()); n > maxInFlight.Load() {
+				maxInFlight.Store(n)
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	go p.handleClientRequest()
+
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			p.ReqCh <- ClientRequest{ClientID: i, Command: []byte(fmt.Sprintf("SET k%d v", i)), RespCh: make(chan Response, 1)}
+		}
+	}
+	settle := func() { time.Sleep(2 * WRITE_LINGER_TIME) }
+	batchSizes := func() []int {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		sizes := make([]int, p.sequenceNumber)
+		for seq := 1; seq <= p.sequenceNumber; seq++ {
+			sizes[seq-1] = len(p.pendingResponses[seq])
+		}
+		return sizes
+	}
+
+	// Two full batches fill the window
+	send(8)
+	settle()
+	if n := p.inFlightBatches(); n != 2 {
+		t.Fatalf("%d batches in flight, want 2", n)
+	}
+
+	// A GET without a read quorum (there are no peers to ask) falls back to
+	// consensus behind the window, not around it
+	get := readRequests("GET k0")
+	p.readQuorum(readArgs(1, get), get)
+	settle()
+	if n := p.inFlightBatches(); n != 2 {
+		t.Fatalf("%d batches in flight after a read fell back, want 2", n)
+	}
+
+	// The next batch lingers out but cannot go: it stays open and grows to
+	// the batch size, then the rest waits in the queue
+	send(2)
+	settle()
+	send(5)
+	settle()
+	if n, queued := p.inFlightBatches(), len(p.ReqCh); n != 2 || queued != 4 {
+		t.Fatalf("with the window full: %d in flight, %d queued; want 2 and 4", n, queued)
+	}
+
+	// Answering the first batch lets the grown one go, and the queue fills
+	// the next one
+	p.mu.Lock()
+	p.batchDoneLocked(p.pendingResponses[1])
+	p.mu.Unlock()
+	settle()
+	if n, queued := p.inFlightBatches(), len(p.ReqCh); n != 2 || queued != 0 {
+		t.Fatalf("after a slot freed: %d in flight, %d queued; want 2 and 0", n, queued)
+	}
+	if sizes := batchSizes(); fmt.Sprint(sizes) != "[4 4 4]" {
+		t.Fatalf("batch sizes %v, want [4 4 4]", sizes)
+	}
+	p.mu.RLock()
+	ordered := p.pendingResponses[3][0] == get[0].RespCh
+	p.mu.RUnlock()
+	if !ordered {
+		t.Fatalf("the GET is not in the batch that waited for the window")
+	}
+	if n := maxInFlight.Load(); n > 2 {
+		t.Fatalf("%d batches were in flight at once with --window 2", n)
+	}
+}
+
+// Clients cannot change the replica set, however they space the command.
+func TestClientRequestRejectsReconfig(t *testing.T) {
+	p := newTestPrimary(t, 4)
+	p.ReqCh = make(chan ClientRequest, 10)
+	s := &ClientService{p: p}
+	for _, cmd := range []string{
+		"RECONFIG REMOVE 4",
+		" RECONFIG REMOVE 4",
+		"RECONFIG  REMOVE 4",
+		"  RECONFIG ADD 5 127.0.0.1:6004 - -",
+	} {
+		err := s.Request(&ClientRequestArgs{ClientID: 1, Command: []byte(cmd)}, &ClientRequestReply{})
+		if err == nil || !strings.Contains(err.Error(), "pbft cluster") {
+			t.Fatalf("%q: got %v, want it refused", cmd, err)
+		}
+	}
+	if n := len(p.ReqCh); n != 0 {
+		t.Fatalf("%d reconfigurations reached the batcher", n)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	HistoryInvoke   = "invoke"
+	HistoryComplete = "complete"
+	HistoryDiscard  = "discard"
+)
+
+// HistoryEvent is one invoke or complete event observed by a client worker.
+// Time is the monotonic offset in nanoseconds from the start of the recording.
+type HistoryEvent struct {
+	Kind     string `json:"kind"`
+	ClientID int    `json:"client"`
+	OpID     int    `json:"op"`
+	Time     int64  `json:"time"`
+	Op       string `json:"cmd,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Value    string `json:"value,omitempty"` // SET argument on invoke, result on complete
+}
+
+// History records client events so they can be checked for linearizability after a run.
+type History struct {
+	mu     sync.Mutex
+	start  time.Time
+	nextOp int
+	events []HistoryEvent
+}
+
+func NewHistory() *History {
+	return &History{start: time.Now()}
+}
+
+// Invoke records the start of a command and returns the operation ID to complete it with.
+func (h *History) Invoke(clientID int, command []byte) int {
+	parts := splitCommand(string(command))
+	ev := HistoryEvent{Kind: HistoryInvoke, ClientID: clientID}
+	if len(parts) > 0 {
+		ev.Op = parts[0]
+	}
+	if len(parts) > 1 {
+		ev.Key = parts[1]
+	}
+	if len(parts) > 2 {
+		ev.Value = parts[2]
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ev.OpID = h.nextOp
+	h.nextOp++
+	ev.Time = int64(time.Since(h.start))
+	h.events = append(h.events, ev)
+	return ev.OpID
+}
+
+// Complete records the result returned to the client for an invoked operation.
+func (h *History) Complete(clientID int, opID int, value string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, HistoryEvent{
+		Kind:     HistoryComplete,
+		ClientID: clientID,
+		OpID:     opID,
+		Time:     int64(time.Since(h.start)),
+		Value:    value,
+	})
+}
+
+// Discard records that an invoked operation should be left out of the check,
+// such as a read served with --read-mode stale.
+func (h *History) Discard(clientID int, opID int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, HistoryEvent{
+		Kind:     HistoryDiscard,
+		ClientID: clientID,
+		OpID:     opID,
+		Time:     int64(time.Since(h.start)),
+	})
+}
+
+func (h *History) Events() []HistoryEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]HistoryEvent(nil), h.events...)
+}
+
+func (h *History) Save(path string) error {
+	data, err := json.Marshal(h.Events())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func LoadHistory(path string) ([]HistoryEvent, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var events []HistoryEvent
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,703 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// Chained HotStuff (--protocol hotstuff), as an alternative engine on the same
+// batching, crypto, WAL and state machine as PBFT.
+//
+// Blocks are proposed one per round. Replicas vote for a block to its proposer,
+// which puts the resulting quorum certificate into its next block, so every
+// block carries the second phase of its parent and the third of its
+// grandparent. A block commits once it heads a chain of three certified blocks
+// from consecutive rounds (the DiemBFT form of the rule, since here a block's
+// parent is always the block its QC certifies). For HotStuff QCs, View is the
+// round of the certified block.
+//
+// Leadership is per view, not per round: the leader of view v, (v % N) + 1,
+// keeps proposing while it makes progress. When a round makes no progress
+// within HOTSTUFF_VIEW_TIMEOUT (doubling on consecutive timeouts) while batches
+// are waiting, the pacemaker moves the replica to the next round and view and
+// sends the new leader its highest QC. The new leader starts proposing once it
+// has 2f+1 of those. Rotating on timeouts rather than every round means one
+// crashed replica does not break every chain of three consecutive rounds.
+//
+// Clients stay on node 1 as with PBFT: it submits each batch to every replica,
+// so any leader can propose it, and replicas reply to node 1 with the height
+// the batch executed at.
+
+const (
+	RPCHotStuffPropose = "HotStuff.Propose"
+	RPCHotStuffVote    = "HotStuff.Vote"
+	RPCHotStuffNewView = "HotStuff.NewView"
+	RPCHotStuffSubmit  = "HotStuff.Submit"
+	RPCHotStuffFetch   = "HotStuff.Fetch"
+
+	HOTSTUFF_VIEW_TIMEOUT = 1 * time.Second
+	HOTSTUFF_MAX_BACKOFF  = 4  // timeouts double at most this many times
+	HOTSTUFF_MAX_FETCH    = 64 // missing ancestors fetched for one proposal
+)
+
+type HotStuffBlock struct {
+	View      int
+	Round     int
+	Height    int
+	Parent    string      // hash of the parent block
+	Justify   *QuorumCert // certifies the parent
+	BatchID   string      // "" for an empty block
+	Command   []byte
+	Proposer  int
+	Signature []byte
+}
+
+func (b *HotStuffBlock) encoding() []byte {
+	return digestHotStuffBlock(b.View, b.Round, b.Height, b.Parent, b.BatchID, b.Command, b.Proposer)
+}
+
+func (b *HotStuffBlock) Hash() string {
+	return hash(b.encoding())
+}
+
+type HotStuffProposeReply struct {
+	Success bool
+}
+
+type HotStuffNewViewArgs struct {
+	View      int
+	Round     int
+	NodeID    int
+	HighQC    *QuorumCert
+	Signature []byte
+}
+
+type HotStuffNewViewReply struct {
+	Success bool
+}
+
+type HotStuffSubmitArgs struct {
+	BatchID string
+	Command []byte
+}
+
+type HotStuffSubmitReply struct {
+	Success bool
+}
+
+type HotStuffFetchArgs struct {
+	Hash string
+}
+
+type HotStuffFetchReply struct {
+	Block *HotStuffBlock
+}
+
+// HotStuff is the engine state. Everything is guarded by p.mu, since committing
+// executes against the state machine.
+type HotStuff struct {
+	p *PBFT
+
+	genesisQC *QuorumCert
+	blocks    map[string]*HotStuffBlock
+
+	curView  int
+	curRound int
+	voted    int // highest round voted (or timed out) in
+	proposed int // highest round we proposed in
+	locked   *HotStuffBlock
+	executed *HotStuffBlock
+	highQC   *QuorumCert
+
+	votes    map[string]map[int][]byte            // block hash -> shares
+	newViews map[int]map[int]*HotStuffNewViewArgs // view -> sender -> NewView
+
+	// Mempool: batches submitted by node 1, in submission order
+	pending   []string
+	batches   map[string][]byte
+	done      map[string]bool
+	waiting   map[string][]chan Response // node 1 only: batch ID -> client channels
+	nextBatch int
+
+	timeouts int
+	progress chan struct{}
+}
+
+func NewHotStuff(p *PBFT) *HotStuff {
+	genesis := &HotStuffBlock{}
+	h := genesis.Hash()
+	genesisQC := &QuorumCert{Phase: PhaseHotStuff, Digest: h}
+	return &HotStuff{
+		p:         p,
+		genesisQC: genesisQC,
+		blocks:    map[string]*HotStuffBlock{h: genesis},
+		curRound:  1,
+		locked:    genesis,
+		executed:  genesis,
+		highQC:    genesisQC,
+		votes:     make(map[string]map[int][]byte),
+		newViews:  make(map[int]map[int]*HotStuffNewViewArgs),
+		batches:   make(map[string][]byte),
+		done:      make(map[string]bool),
+		waiting:   make(map[string][]chan Response),
+		progress:  make(chan struct{}, 1),
+	}
+}
+
+func (h *HotStuff) leader(view int) int {
+	return h.p.memberAt(view)
+}
+
+// run is the pacemaker.
+func (h *HotStuff) run() {
+	for {
+		h.p.mu.RLock()
+		timeout := HOTSTUFF_VIEW_TIMEOUT << min(h.timeouts, HOTSTUFF_MAX_BACKOFF)
+		h.p.mu.RUnlock()
+
+		select {
+		case <-h.progress:
+		case <-time.After(timeout):
+			h.p.mu.Lock()
+			if !h.hasWorkLocked() {
+				// Nothing to order, so a quiet leader is not a faulty one
+				h.p.mu.Unlock()
+				continue
+			}
+			h.timeouts++
+			h.voted = max(h.voted, h.curRound) // never vote in a round we gave up on
+			h.curRound++
+			h.curView++
+			h.p.logPutLocked(LogHotStuff, slog.LevelWarn, "Round timeout, moving on", "hotstuff_view", h.curView, "round", h.curRound)
+			nv := &HotStuffNewViewArgs{View: h.curView, Round: h.curRound, NodeID: h.p.id, HighQC: h.highQC}
+			var resend []*HotStuffSubmitArgs
+			for id := range h.waiting {
+				resend = append(resend, &HotStuffSubmitArgs{BatchID: id, Command: h.batches[id]})
+			}
+			h.p.mu.Unlock()
+			h.sendNewView(nv)
+			// Submissions are fire-and-forget, so send ours again in case the
+			// stall is replicas that never got them
+			for _, args := range resend {
+				h.broadcastSubmit(args)
+			}
+		}
+	}
+}
+
+func (h *HotStuff) signalProgress() {
+	select {
+	case h.progress <- struct{}{}:
+	default:
+	}
+}
+
+func (h *HotStuff) hasWorkLocked() bool {
+	for _, id := range h.pending {
+		if !h.done[id] {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HotStuff) verifyJustify(qc *QuorumCert) error {
+	if qc == nil {
+		return fmt.Errorf("missing QC")
+	}
+	if qc.Phase != PhaseHotStuff {
+		return fmt.Errorf("not a HotStuff QC")
+	}
+	if qc.View == 0 && qc.Digest == h.genesisQC.Digest {
+		return nil
+	}
+	return h.p.verifyQuorumCert(qc)
+}
+
+func (h *HotStuff) verifyBlock(b *HotStuffBlock) error {
+	if b.Justify == nil || b.Justify.Digest != b.Parent || b.Justify.View >= b.Round {
+		return fmt.Errorf("block does not justify its parent")
+	}
+	if b.Proposer != h.leader(b.View) {
+		return fmt.Errorf("node %d is not the leader of view %d", b.Proposer, b.View)
+	}
+	key, ok := h.p.replicas().pubKeys[b.Proposer].(ed25519.PublicKey)
+	if !ok {
+		return fmt.Errorf("no public key for node %d", b.Proposer)
+	}
+	if err := verify(key, b.encoding(), b.Signature); err != nil {
+		return err
+	}
+	return h.verifyJustify(b.Justify)
+}
+
+func (h *HotStuff) updateHighQCLocked(qc *QuorumCert) {
+	if qc.View > h.highQC.View {
+		h.highQC = qc
+	}
+}
+
+// Submit adds a batch to this replica's mempool.
+func (h *HotStuff) Submit(args *HotStuffSubmitArgs, reply *HotStuffSubmitReply) error {
+	h.p.mu.Lock()
+	defer h.p.mu.Unlock()
+	h.addBatchLocked(args.BatchID, args.Command)
+	h.tryProposeLocked()
+	reply.Success = true
+	return nil
+}
+
+func (h *HotStuff) addBatchLocked(id string, command []byte) {
+	if h.done[id] || h.batches[id] != nil {
+		return
+	}
+	h.batches[id] = command
+	h.pending = append(h.pending, id)
+}
+
+// submit is called by the batcher on node 1 in place of a PBFT PrePrepare.
+func (h *HotStuff) submit(command []byte, chans []chan Response) {
+	h.p.mu.Lock()
+	h.nextBatch++
+	id := fmt.Sprintf("%d-%d", h.p.id, h.nextBatch)
+	h.waiting[id] = chans
+	h.addBatchLocked(id, command)
+	h.tryProposeLocked()
+	h.p.mu.Unlock()
+
+	h.broadcastSubmit(&HotStuffSubmitArgs{BatchID: id, Command: command})
+}
+
+func (h *HotStuff) broadcastSubmit(args *HotStuffSubmitArgs) {
+	for peerID := range h.p.replicas().peerIPPort {
+		if peerID != h.p.id {
+			go func(target int) {
+				reply := &HotStuffSubmitReply{}
+				h.p.sendRPC(target, RPCHotStuffSubmit, args, reply)
+			}(peerID)
+		}
+	}
+}
+
+// nextBatchLocked picks the oldest batch that is neither executed nor already
+// on the uncommitted part of the chain ending at parent.
+func (h *HotStuff) nextBatchLocked(parent *HotStuffBlock) string {
+	inFlight := make(map[string]bool)
+	for b := parent; b != nil && b.Height > h.executed.Height; b = h.blocks[b.Parent] {
+		inFlight[b.BatchID] = true
+	}
+	live := h.pending[:0]
+	chosen := ""
+	for _, id := range h.pending {
+		if h.done[id] {
+			continue
+		}
+		live = append(live, id)
+		if chosen == "" && !inFlight[id] {
+			chosen = id
+		}
+	}
+	h.pending = live
+	return chosen
+}
+
+// hasUncommittedLocked reports whether the chain ending at b still has batches
+// waiting to commit, which keeps the leader proposing empty blocks to finish
+// their three-chain.
+func (h *HotStuff) hasUncommittedLocked(b *HotStuffBlock) bool {
+	for ; b != nil && b.Height > h.executed.Height; b = h.blocks[b.Parent] {
+		if b.BatchID != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HotStuff) tryProposeLocked() {
+	round := h.curRound
+	if h.leader(h.curView) != h.p.id || h.proposed >= round {
+		return
+	}
+	// Either continue our own chain, or start a view with 2f+1 NewViews
+	if h.highQC.View != round-1 && len(h.newViews[h.curView]) < h.p.quorumSize() {
+		return
+	}
+	parent := h.blocks[h.highQC.Digest]
+	if parent == nil {
+		return // wait for the certified block itself
+	}
+	batchID := h.nextBatchLocked(parent)
+	if batchID == "" && !h.hasUncommittedLocked(parent) {
+		return // idle: proposed again on the next Submit
+	}
+
+	b := &HotStuffBlock{
+		View:     h.curView,
+		Round:    round,
+		Height:   parent.Height + 1,
+		Parent:   h.highQC.Digest,
+		Justify:  h.highQC,
+		BatchID:  batchID,
+		Command:  h.batches[batchID],
+		Proposer: h.p.id,
+	}
+	sig, err := sign(h.p.privKey, b.encoding())
+	if err != nil {
+		h.p.logPutLocked(LogHotStuff, slog.LevelError, "Error signing block", "height", b.Height, "err", err)
+		return
+	}
+	b.Signature = sig
+	h.proposed = round
+	delete(h.newViews, h.curView) // from here on the view continues our own chain
+
+	h.p.logPutLocked(LogHotStuff, slog.LevelDebug, "Proposing", "height", b.Height, "round", round, "batch", batchID)
+	for peerID := range h.p.replicas().peerIPPort {
+		if peerID != h.p.id {
+			go func(target int) {
+				reply := &HotStuffProposeReply{}
+				h.p.sendRPC(target, RPCHotStuffPropose, b, reply)
+			}(peerID)
+		}
+	}
+	h.onProposalLocked(b)
+}
+
+// Propose handles a block from the leader of its view.
+func (h *HotStuff) Propose(args *HotStuffBlock, reply *HotStuffProposeReply) error {
+	if err := h.p.verifier.Verify(func() error { return h.verifyBlock(args) }); err != nil {
+		h.p.logPut(LogHotStuff, slog.LevelWarn, "Rejected block", "round", args.Round, "peer", args.Proposer, "err", err)
+		reply.Success = false
+		return nil
+	}
+	if err := h.fetchAncestors(args); err != nil {
+		h.p.logPut(LogHotStuff, slog.LevelWarn, "Cannot fetch ancestors of block", "round", args.Round, "err", err)
+		reply.Success = false
+		return nil
+	}
+
+	h.p.mu.Lock()
+	defer h.p.mu.Unlock()
+	reply.Success = h.onProposalLocked(args)
+	return nil
+}
+
+// fetchAncestors asks the proposer of b for any blocks between b and the chain we
+// already have, and feeds them in oldest first.
+func (h *HotStuff) fetchAncestors(b *HotStuffBlock) error {
+	var missing []*HotStuffBlock
+	parent := b.Parent
+	for len(missing) < HOTSTUFF_MAX_FETCH {
+		h.p.mu.RLock()
+		_, ok := h.blocks[parent]
+		h.p.mu.RUnlock()
+		if ok {
+			break
+		}
+		reply := &HotStuffFetchReply{}
+		if err := h.p.conns.Call(b.Proposer, RPCHotStuffFetch, &HotStuffFetchArgs{Hash: parent}, reply); err != nil {
+			return err
+		}
+		if reply.Block == nil || reply.Block.Hash() != parent {
+			return fmt.Errorf("node %d does not have block %s", b.Proposer, parent)
+		}
+		if err := h.verifyBlock(reply.Block); err != nil {
+			return err
+		}
+		missing = append(missing, reply.Block)
+		parent = reply.Block.Parent
+	}
+
+	h.p.mu.Lock()
+	defer h.p.mu.Unlock()
+	for i := len(missing) - 1; i >= 0; i-- {
+		h.onProposalLocked(missing[i])
+	}
+	return nil
+}
+
+func (h *HotStuff) Fetch(args *HotStuffFetchArgs, reply *HotStuffFetchReply) error {
+	h.p.mu.RLock()
+	defer h.p.mu.RUnlock()
+	reply.Block = h.blocks[args.Hash]
+	return nil
+}
+
+// onProposalLocked adds a verified block to the tree, votes for it if it is
+// safe, and applies the lock and commit rules. It reports whether we voted.
+func (h *HotStuff) onProposalLocked(b *HotStuffBlock) bool {
+	bHash := b.Hash()
+	if _, ok := h.blocks[bHash]; ok {
+		return false
+	}
+	parent := h.blocks[b.Parent]
+	if parent == nil || b.Height != parent.Height+1 {
+		return false
+	}
+	h.blocks[bHash] = b
+	if b.BatchID != "" {
+		h.addBatchLocked(b.BatchID, b.Command)
+		if err := h.p.storage.AppendEntry(LogEntry{View: b.View, Command: b.Command}); err != nil {
+			h.p.logPutLocked(LogHotStuff, slog.LevelError, "Failed to append to log", "err", err)
+			return false
+		}
+	}
+	// A block that certifies the round right before it, and nothing older than
+	// our own highest QC, shows its view's leader is followed by a quorum
+	live := b.Justify.View == b.Round-1 && b.Justify.View >= h.highQC.View
+	h.updateHighQCLocked(b.Justify)
+
+	// Lock on the grandparent; commit the great-grandparent if the three
+	// certified blocks are from consecutive rounds
+	if b2 := parent; b2.Justify != nil {
+		if b1 := h.blocks[b2.Justify.Digest]; b1 != nil {
+			if b1.Round > h.locked.Round {
+				h.locked = b1
+			}
+			if b1.Justify != nil {
+				if b0 := h.blocks[b1.Justify.Digest]; b0 != nil && b2.Round == b1.Round+1 && b1.Round == b0.Round+1 {
+					h.commitLocked(b0)
+				}
+			}
+		}
+	}
+
+	// Blocks from a leader we have already moved past only extend the tree,
+	// unless the rest of the cluster is still following it. Safety only depends
+	// on rounds, so going back to that view is fine.
+	if b.View < h.curView && !live {
+		return false
+	}
+	h.curView = b.View
+
+	voted := false
+	if b.Round > h.voted && b.Justify.View >= h.locked.Round {
+		h.voted = b.Round
+		voted = true
+		go h.sendVote(b.View, b.Round, b.Height, bHash)
+	}
+	if b.Round >= h.curRound {
+		h.curRound = b.Round + 1
+		h.signalProgress()
+	}
+	h.tryProposeLocked()
+	return voted
+}
+
+// commitLocked executes every block up to and including b.
+func (h *HotStuff) commitLocked(b *HotStuffBlock) {
+	if b.Height <= h.executed.Height {
+		return
+	}
+	var chain []*HotStuffBlock
+	for c := b; c != nil && c.Height > h.executed.Height; c = h.blocks[c.Parent] {
+		chain = append(chain, c)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		h.executeBlockLocked(chain[i])
+	}
+	h.executed = b
+	h.timeouts = 0
+}
+
+func (h *HotStuff) executeBlockLocked(b *HotStuffBlock) {
+	if b.BatchID == "" || h.done[b.BatchID] {
+		return
+	}
+	h.done[b.BatchID] = true
+	delete(h.batches, b.BatchID)
+	h.p.logPutLocked(LogHotStuff, slog.LevelDebug, "Committed, executing", "height", b.Height, "batch", b.BatchID)
+
+	if chans, ok := h.waiting[b.BatchID]; ok {
+		delete(h.waiting, b.BatchID)
+		h.p.pendingResponses[b.Height] = chans
+	}
+	h.p.executeLocked(b.Height, b.Command)
+}
+
+// sendVote sends our share for a block to its proposer.
+func (h *HotStuff) sendVote(view int, round int, height int, blockHash string) {
+	share, err := sign(h.p.privKey, digestVote(PhaseHotStuff, round, height, blockHash))
+	if err != nil {
+		h.p.logPut(LogHotStuff, slog.LevelError, "Error signing vote", "err", err)
+		return
+	}
+	args := &VoteArgs{
+		Phase:          PhaseHotStuff,
+		View:           round,
+		SequenceNumber: height,
+		Digest:         blockHash,
+		NodeID:         h.p.id,
+		Share:          share,
+	}
+	if target := h.leader(view); target != h.p.id {
+		reply := &VoteReply{}
+		h.p.sendRPC(target, RPCHotStuffVote, args, reply)
+		return
+	}
+	h.p.mu.Lock()
+	h.addVoteLocked(args)
+	h.p.mu.Unlock()
+}
+
+// Vote collects votes for the blocks we proposed.
+func (h *HotStuff) Vote(args *VoteArgs, reply *VoteReply) error {
+	err := h.p.verifier.Verify(func() error {
+		if args.Phase != PhaseHotStuff {
+			return fmt.Errorf("not a HotStuff vote")
+		}
+		key, ok := h.p.replicas().pubKeys[args.NodeID].(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("no public key for node %d", args.NodeID)
+		}
+		return verify(key, digestVote(PhaseHotStuff, args.View, args.SequenceNumber, args.Digest), args.Share)
+	})
+	if err != nil {
+		h.p.logPut(LogHotStuff, slog.LevelWarn, "Signature verification failed for vote", "peer", args.NodeID, "err", err)
+		reply.Success = false
+		return nil
+	}
+
+	h.p.mu.Lock()
+	defer h.p.mu.Unlock()
+	h.addVoteLocked(args)
+	reply.Success = true
+	return nil
+}
+
+func (h *HotStuff) addVoteLocked(args *VoteArgs) {
+	b, ok := h.blocks[args.Digest]
+	if !ok || b.Proposer != h.p.id || args.View <= h.highQC.View {
+		return
+	}
+	shares, ok := h.votes[args.Digest]
+	if !ok {
+		shares = make(map[int][]byte)
+		h.votes[args.Digest] = shares
+	}
+	shares[args.NodeID] = args.Share
+	if len(shares) < h.p.quorumSize() {
+		return
+	}
+
+	qc := newQuorumCert(PhaseHotStuff, args.View, args.SequenceNumber, args.Digest, shares)
+	delete(h.votes, args.Digest)
+	h.updateHighQCLocked(qc)
+	h.p.logPutLocked(LogHotStuff, slog.LevelDebug, "QC formed", "height", args.SequenceNumber, "round", args.View)
+	h.tryProposeLocked()
+}
+
+// sendNewView broadcasts that we moved to args.View. Everyone keeps count, so
+// replicas that fell out of step can catch up to the view the others are in.
+func (h *HotStuff) sendNewView(args *HotStuffNewViewArgs) {
+	sig, err := sign(h.p.privKey, digestHotStuffNewView(args.View, args.Round, args.NodeID, args.HighQC.View, args.HighQC.Digest))
+	if err != nil {
+		h.p.logPut(LogHotStuff, slog.LevelError, "Error signing NewView", "err", err)
+		return
+	}
+	args.Signature = sig
+	for peerID := range h.p.replicas().peerIPPort {
+		if peerID != h.p.id {
+			go func(target int) {
+				reply := &HotStuffNewViewReply{}
+				h.p.sendRPC(target, RPCHotStuffNewView, args, reply)
+			}(peerID)
+		}
+	}
+	h.p.mu.Lock()
+	join := h.addNewViewLocked(args)
+	h.p.mu.Unlock()
+	if join != nil {
+		h.sendNewView(join)
+	}
+}
+
+// NewView records that a replica moved to a view.
+func (h *HotStuff) NewView(args *HotStuffNewViewArgs, reply *HotStuffNewViewReply) error {
+	err := h.p.verifier.Verify(func() error {
+		if args.HighQC == nil {
+			return fmt.Errorf("missing QC")
+		}
+		key, ok := h.p.replicas().pubKeys[args.NodeID].(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("no public key for node %d", args.NodeID)
+		}
+		if err := verify(key, digestHotStuffNewView(args.View, args.Round, args.NodeID, args.HighQC.View, args.HighQC.Digest), args.Signature); err != nil {
+			return err
+		}
+		return h.verifyJustify(args.HighQC)
+	})
+	if err != nil {
+		h.p.logPut(LogHotStuff, slog.LevelWarn, "Rejected NewView", "peer", args.NodeID, "err", err)
+		reply.Success = false
+		return nil
+	}
+
+	h.p.mu.Lock()
+	join := h.addNewViewLocked(args)
+	h.p.mu.Unlock()
+	if join != nil {
+		h.sendNewView(join)
+	}
+	reply.Success = true
+	return nil
+}
+
+// addNewViewLocked counts a NewView. It returns our own NewView when f+1
+// replicas (so at least one correct one) have moved past our view, and we join
+// the highest view that f+1 of them have reached. The leader of a view takes
+// over once it has 2f+1 NewViews for it.
+func (h *HotStuff) addNewViewLocked(args *HotStuffNewViewArgs) *HotStuffNewViewArgs {
+	if args.View < h.curView {
+		return nil
+	}
+	msgs, ok := h.newViews[args.View]
+	if !ok {
+		msgs = make(map[int]*HotStuffNewViewArgs)
+		h.newViews[args.View] = msgs
+	}
+	msgs[args.NodeID] = args
+	h.updateHighQCLocked(args.HighQC)
+
+	latest := make(map[int]int) // node -> highest view it announced
+	for v, vmsgs := range h.newViews {
+		for id := range vmsgs {
+			latest[id] = max(latest[id], v)
+		}
+	}
+	views := make([]int, 0, len(latest))
+	for _, v := range latest {
+		views = append(views, v)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(views)))
+
+	var join *HotStuffNewViewArgs
+	f := maxFaulty(h.p.replicas().clusterSize)
+	if len(views) > f && views[f] > h.curView {
+		h.voted = max(h.voted, h.curRound)
+		h.curRound++
+		h.curView = views[f]
+		for _, m := range h.newViews[h.curView] {
+			h.curRound = max(h.curRound, m.Round)
+		}
+		h.p.logPutLocked(LogHotStuff, slog.LevelInfo, "Joining view", "hotstuff_view", h.curView, "round", h.curRound)
+		join = &HotStuffNewViewArgs{View: h.curView, Round: h.curRound, NodeID: h.p.id, HighQC: h.highQC}
+		h.signalProgress()
+	}
+	for v := range h.newViews {
+		if v < h.curView {
+			delete(h.newViews, v)
+		}
+	}
+
+	// Take over the view, in a round none of the quorum has voted in yet
+	if msgs := h.newViews[h.curView]; h.leader(h.curView) == h.p.id && len(msgs) >= h.p.quorumSize() {
+		for _, m := range msgs {
+			h.curRound = max(h.curRound, m.Round)
+		}
+		h.tryProposeLocked()
+	}
+	return join
+}
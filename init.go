@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"log/slog"
 	"os"
+	"strconv"
 
 	"github.com/urfave/cli/v2"
 )
@@ -20,7 +23,6 @@ func main() {
 					writeBatchSize := c.Int("write-batch-size")
 					readBatchSize := c.Int("read-batch-size")
 					workers := c.Int("workers")
-					debug := c.Bool("debug")
 					asyncLog := c.Bool("async-log")
 					inMemory := c.Bool("in-memory")
 					workloadStr := c.String("workload")
@@ -40,8 +42,118 @@ func main() {
 						cryptoType = CryptoEd25519
 					case "mac":
 						cryptoType = CryptoMAC
+					case "multisig":
+						cryptoType = CryptoMultiSig
+					}
+					protocol := c.String("protocol")
+					switch protocol {
+					case ProtocolPBFT:
+					case ProtocolHotStuff:
+						// Quorum certificates have to be transferable
+						if cryptoType == CryptoMAC {
+							return fmt.Errorf("--protocol hotstuff needs signatures, not --crypto mac")
+						}
+					default:
+						return fmt.Errorf("unknown protocol %q (pbft, hotstuff)", protocol)
+					}
+					speculative := c.Bool("speculative")
+					if speculative && protocol != ProtocolPBFT {
+						return fmt.Errorf("--speculative only applies to --protocol pbft")
+					}
+					leaders := c.Int("leaders")
+					if leaders < 1 {
+						return fmt.Errorf("--leaders must be at least 1")
+					}
+					if leaders > 1 {
+						// Votes, speculative replies and HotStuff all assume one leader per view
+						if protocol != ProtocolPBFT || speculative || cryptoType == CryptoMultiSig {
+							return fmt.Errorf("--leaders only applies to --protocol pbft without --speculative or --crypto multisig")
+						}
+					}
+					// HotStuff already spreads batches through its own mempool
+					disseminate := c.Bool("disseminate")
+					if disseminate && protocol != ProtocolPBFT {
+						return fmt.Errorf("--disseminate only applies to --protocol pbft")
+					}
+					readMode, readMaxLag, err := parseReadMode(c.String("read-mode"))
+					if err != nil {
+						return err
+					}
+					if speculative && readMode != GuaranteeLinearizable {
+						// Speculative state can still be rolled back
+						if c.IsSet("read-mode") {
+							return fmt.Errorf("--speculative only supports --read-mode linearizable")
+						}
+						readMode = GuaranteeLinearizable
+					}
+					batching := c.String("batching")
+					if batching != BatchingStatic && batching != BatchingAdaptive {
+						return fmt.Errorf("unknown batching %q (static, adaptive)", batching)
+					}
+					// Recovery replays the PBFT log; speculative state can still roll back
+					recoveryInterval := c.Duration("recovery")
+					if recoveryInterval < 0 {
+						return fmt.Errorf("--recovery must not be negative")
+					}
+					if recoveryInterval > 0 && (protocol != ProtocolPBFT || speculative) {
+						return fmt.Errorf("--recovery only applies to --protocol pbft without --speculative")
+					}
+					levels, err := parseLogLevels(c.String("log-level"))
+					if err != nil {
+						return err
+					}
+					if c.Bool("debug") {
+						levels[""] = slog.LevelDebug
+					}
+					logging, err := newLogging(id, c.String("log-format"), levels, os.Stderr)
+					if err != nil {
+						return err
+					}
+					testKeys := c.Bool("insecure-test-keys")
+					p := NewPBFT(id, conf, writeBatchSize, readBatchSize, workers, logging, workload, asyncLog, inMemory, cryptoType, testKeys)
+					if n := p.replicas().clusterSize; leaders > n {
+						return fmt.Errorf("--leaders %d exceeds the %d replicas", leaders, n)
+					}
+					p.verifyWorkers = c.Int("verify-workers")
+					p.leaders = leaders
+					p.joining = c.Bool("join")
+					p.protocol = protocol
+					p.speculative = speculative
+					p.disseminate = disseminate
+					p.readMode = readMode
+					p.readMaxLag = readMaxLag
+					p.windowSize = c.Int("window")
+					p.batching = batching
+					p.recoveryInterval = recoveryInterval
+					p.metricsAddr = c.String("metrics-addr")
+					if historyPath := c.String("history"); historyPath != "" {
+						p.history = NewHistory()
+						p.historyPath = historyPath
+					}
+					if faultsPath := c.String("faults"); faultsPath != "" {
+						faults, err := NewFaultInjector(id, faultsPath)
+						if err != nil {
+							return err
+						}
+						p.faults = faults
+					}
+					if tracePath := c.String("trace"); tracePath != "" {
+						tracer, err := newTracer(tracePath, logging)
+						if err != nil {
+							return err
+						}
+						p.tracer = tracer
+					}
+					if auditPath := c.String("audit"); auditPath != "" {
+						if err := p.checkAuditable(); err != nil {
+							return err
+						}
+						audit, err := newAuditor(auditPath, logging)
+						if err != nil {
+							return err
+						}
+						p.audit = audit
 					}
-					p := NewPBFT(id, conf, writeBatchSize, readBatchSize, workers, debug, workload, asyncLog, inMemory, cryptoType)
 					p.Run()
 					return nil
 				},
@@ -69,11 +181,51 @@ func main() {
 						Usage: "Number of concurrent clients",
 						Value: 256,
 					},
+					&cli.BoolFlag{
+						Name:  "join",
+						Usage: "Start as a new replica and wait for `pbft cluster add` to hand over the state",
+						Value: false,
+					},
+					&cli.IntFlag{
+						Name:  "leaders",
+						Usage: "Number of replicas ordering requests in parallel, each for its own bucket of clients",
+						Value: 1,
+					},
+					&cli.BoolFlag{
+						Name:  "disseminate",
+						Usage: "Spread batches through backups and order only their digests",
+						Value: false,
+					},
+					&cli.StringFlag{
+						Name:  "batching",
+						Usage: "Write batching: static (--write-batch-size, fixed linger) or adaptive",
+						Value: BatchingStatic,
+					},
+					&cli.IntFlag{
+						Name:  "window",
+						Usage: "Maximum number of write batches in flight (0: unlimited)",
+						Value: 0,
+					},
+					&cli.DurationFlag{
+						Name:  "recovery",
+						Usage: "Recover proactively every interval, one replica at a time: refresh session keys and check the state against a stable checkpoint (0: off)",
+						Value: 0,
+					},
 					&cli.BoolFlag{
 						Name:  "debug",
-						Usage: "Enable debug logging",
+						Usage: "Log everything at debug level (same as --log-level debug)",
 						Value: false,
 					},
+					&cli.StringFlag{
+						Name:  "log-level",
+						Usage: "Log level, optionally per component: info, or e.g. warn,consensus=debug,net=error",
+						Value: "info",
+					},
+					&cli.StringFlag{
+						Name:  "log-format",
+						Usage: "Log format: text or json",
+						Value: LogFormatText,
+					},
 					&cli.BoolFlag{
 						Name:  "async-log",
 						Usage: "Enable asynchronous disk writes",
@@ -91,9 +243,343 @@ func main() {
 					},
 					&cli.StringFlag{
 						Name:  "crypto",
-						Usage: "Cryptographic scheme (ed25519, mac)",
+						Usage: "Cryptographic scheme (ed25519, mac, multisig: ed25519 with votes to the primary and quorum certificates)",
 						Value: "ed25519",
 					},
+					&cli.StringFlag{
+						Name:  "protocol",
+						Usage: "Consensus engine (pbft, hotstuff)",
+						Value: ProtocolPBFT,
+					},
+					&cli.BoolFlag{
+						Name:  "speculative",
+						Usage: "Execute on PrePrepare and complete on 3f+1 matching replies (Zyzzyva), with a commit-certificate fallback",
+						Value: false,
+					},
+					&cli.StringFlag{
+						Name:  "read-mode",
+						Usage: "How GETs are served: linearizable (consensus), quorum (2f+1 matching replies) or stale(maxLag) (one replica within maxLag of the stable checkpoint)",
+						Value: string(GuaranteeQuorum),
+					},
+					&cli.IntFlag{
+						Name:  "verify-workers",
+						Usage: "Number of goroutines verifying incoming signatures (0: one per CPU)",
+						Value: 0,
+					},
+					&cli.StringFlag{
+						Name:  "metrics-addr",
+						Usage: "Serve Prometheus metrics on http://<addr>/metrics (e.g. :9100; empty: off)",
+					},
+					&cli.StringFlag{
+						Name:  "trace",
+						Usage: "Write the phase timestamps of every executed sequence number to this file (see `pbft trace`)",
+					},
+					&cli.StringFlag{
+						Name:  "audit",
+						Usage: "Append every executed batch with its signed commit certificate to this file (see `pbft audit`)",
+					},
+					&cli.StringFlag{
+						Name:  "history",
+						Usage: "Record client invoke/complete events to this file for linearizability checking",
+					},
+					&cli.StringFlag{
+						Name:  "faults",
+						Usage: "Fault injection config (delays, loss, bandwidth, partitions) for replica links",
+					},
+					&cli.BoolFlag{
+						Name:  "insecure-test-keys",
+						Usage: "Derive keys from node IDs instead of loading key files (TESTING ONLY: anyone can compute them)",
+						Value: false,
+					},
+				},
+			},
+			{
+				Name:      "trace",
+				Usage:     "Merge --trace files of all nodes into a per-phase latency breakdown and timelines",
+				ArgsUsage: "<trace file>...",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "slowest",
+						Usage: "Number of slowest sequence numbers to draw timelines for",
+						Value: 5,
+					},
+					&cli.IntSliceFlag{
+						Name:  "seq",
+						Usage: "Also draw the timeline of this sequence number (repeatable)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() == 0 {
+						return fmt.Errorf("expected at least one trace file")
+					}
+					records, err := LoadTraces(c.Args().Slice())
+					if err != nil {
+						return err
+					}
+					writeTraceReport(os.Stdout, mergeTraces(records), c.Int("slowest"), c.IntSlice("seq"))
+					return nil
+				},
+			},
+			{
+				Name:  "keygen",
+				Usage: "Generate signing, MAC and TLS keys for every node and reference them in the config",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "conf",
+						Usage: "Path to config file (rewritten with public keys and key paths)",
+						Value: "cluster.conf",
+					},
+					&cli.StringFlag{
+						Name:  "out",
+						Usage: "Directory for key files, relative to the config file",
+						Value: "keys",
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Overwrite existing key files",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if err := generateClusterKeys(c.String("conf"), c.String("out"), c.Bool("force")); err != nil {
+						return err
+					}
+					fmt.Printf("Wrote keys to %s and updated %s\n", c.String("out"), c.String("conf"))
+					return nil
+				},
+			},
+			{
+				Name:  "cluster",
+				Usage: "Add or remove replicas through consensus",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "conf",
+						Usage: "Path to config file (with the entry of a node to add)",
+						Value: "cluster.conf",
+					},
+					&cli.IntFlag{
+						Name:  "primary",
+						Usage: "Node to send the reconfiguration to",
+						Value: 1,
+					},
+					&cli.IntFlag{
+						Name:  "as",
+						Usage: "Authenticate with this node's TLS certificate (required when TLS is enabled)",
+					},
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:      "add",
+						Usage:     "Add the node with this ID from the config file; start it with --join first",
+						ArgsUsage: "<id>",
+						Action: func(c *cli.Context) error {
+							id, err := strconv.Atoi(c.Args().First())
+							if err != nil || c.NArg() != 1 {
+								return fmt.Errorf("expected a node ID")
+							}
+							for _, node := range parseClusterConfig(c.String("conf")) {
+								if node.ID != id {
+									continue
+								}
+								command, err := reconfigCommand(c.String("conf"), node)
+								if err != nil {
+									return err
+								}
+								return clusterCommand(c.String("conf"), c.Int("primary"), c.Int("as"), command)
+							}
+							return fmt.Errorf("node %d is not in %s", id, c.String("conf"))
+						},
+					},
+					{
+						Name:      "remove",
+						Usage:     "Remove the node with this ID",
+						ArgsUsage: "<id>",
+						Action: func(c *cli.Context) error {
+							id, err := strconv.Atoi(c.Args().First())
+							if err != nil || c.NArg() != 1 {
+								return fmt.Errorf("expected a node ID")
+							}
+							command, _ := reconfigCommand(c.String("conf"), Node{ID: id})
+							return clusterCommand(c.String("conf"), c.Int("primary"), c.Int("as"), command)
+						},
+					},
+				},
+			},
+			{
+				Name:      "log-level",
+				Usage:     "Print or change the log levels of running nodes",
+				ArgsUsage: "[level spec, e.g. info or warn,consensus=debug]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "conf",
+						Usage: "Path to config file",
+						Value: "cluster.conf",
+					},
+					&cli.IntFlag{
+						Name:  "id",
+						Usage: "Only talk to this node (default: all nodes)",
+					},
+					&cli.IntFlag{
+						Name:  "as",
+						Usage: "Authenticate with this node's TLS certificate (required when TLS is enabled)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() > 1 {
+						return fmt.Errorf("expected one level spec")
+					}
+					levels, err := parseLogLevels(c.Args().First())
+					if err != nil {
+						return err
+					}
+					return logLevelCommand(c.String("conf"), c.Int("id"), c.Int("as"), levels)
+				},
+			},
+			{
+				Name:  "audit",
+				Usage: "Export and check proofs that batches were committed by a quorum",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "conf",
+						Usage: "Path to config file with the public keys of the replicas",
+						Value: "cluster.conf",
+					},
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:      "export",
+						Usage:     "Merge --audit files of any nodes into a self-contained bundle",
+						ArgsUsage: "<audit file>...",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "out", Usage: "Bundle to write", Value: "audit_bundle.json"},
+							&cli.IntFlag{Name: "from", Usage: "First sequence number to export"},
+							&cli.IntFlag{Name: "to", Usage: "Last sequence number to export (0: all)"},
+						},
+						Action: func(c *cli.Context) error {
+							if c.NArg() == 0 {
+								return fmt.Errorf("expected at least one audit file")
+							}
+							return auditExportCommand(c.String("conf"), c.Args().Slice(), c.String("out"), c.Int("from"), c.Int("to"))
+						},
+					},
+					{
+						Name:      "verify",
+						Usage:     "Check a bundle against the public keys in the config, without contacting the cluster",
+						ArgsUsage: "<bundle>",
+						Action: func(c *cli.Context) error {
+							if c.NArg() != 1 {
+								return fmt.Errorf("expected a bundle")
+							}
+							return auditVerifyCommand(c.String("conf"), c.Args().First())
+						},
+					},
+				},
+			},
+			{
+				Name:  "status",
+				Usage: "Print the state of every node side by side, marking divergence",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "conf",
+						Usage: "Path to config file",
+						Value: "cluster.conf",
+					},
+					&cli.IntFlag{
+						Name:  "as",
+						Usage: "Authenticate with this node's TLS certificate (required when TLS is enabled)",
+					},
+					&cli.BoolFlag{
+						Name:  "instances",
+						Usage: "List every in-flight sequence number with its phase",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return statusCommand(c.String("conf"), c.Int("as"), c.Bool("instances"))
+				},
+			},
+			{
+				Name:  "faults",
+				Usage: "Inspect or change fault injection on running nodes",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "conf",
+						Usage: "Path to config file",
+						Value: "cluster.conf",
+					},
+					&cli.IntFlag{
+						Name:  "id",
+						Usage: "Only talk to this node (default: all nodes)",
+					},
+					&cli.IntFlag{
+						Name:  "as",
+						Usage: "Authenticate with this node's TLS certificate (required when TLS is enabled)",
+					},
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:  "show",
+						Usage: "Print the active partition and link faults",
+						Action: func(c *cli.Context) error {
+							return faultsCommand(c.String("conf"), c.Int("id"), c.Int("as"), RPCFaultsStatus, &FaultsStatusArgs{})
+						},
+					},
+					{
+						Name:      "partition",
+						Usage:     "Activate a named partition from the fault config",
+						ArgsUsage: "<name>",
+						Action: func(c *cli.Context) error {
+							if c.NArg() != 1 {
+								return fmt.Errorf("expected a partition name")
+							}
+							return faultsCommand(c.String("conf"), c.Int("id"), c.Int("as"), RPCFaultsPartition, &FaultsPartitionArgs{Name: c.Args().First()})
+						},
+					},
+					{
+						Name:  "heal",
+						Usage: "Lift the active partition",
+						Action: func(c *cli.Context) error {
+							return faultsCommand(c.String("conf"), c.Int("id"), c.Int("as"), RPCFaultsPartition, &FaultsPartitionArgs{})
+						},
+					},
+					{
+						Name:      "corrupt",
+						Usage:     "Overwrite a key in the state machine, bypassing consensus (to exercise --recovery; needs a node built with -tags testfaults)",
+						ArgsUsage: "<key> <value>",
+						Action: func(c *cli.Context) error {
+							if c.NArg() != 2 {
+								return fmt.Errorf("expected a key and a value")
+							}
+							args := &FaultsCorruptArgs{Key: c.Args().Get(0), Value: c.Args().Get(1)}
+							return faultsCommand(c.String("conf"), c.Int("id"), c.Int("as"), RPCFaultsCorrupt, args)
+						},
+					},
+					{
+						Name:  "link",
+						Usage: "Set delay/jitter/loss/bandwidth for one direction (or the default with no --from/--to)",
+						Flags: []cli.Flag{
+							&cli.IntFlag{Name: "from", Usage: "Sending node"},
+							&cli.IntFlag{Name: "to", Usage: "Receiving node"},
+							&cli.DurationFlag{Name: "delay", Usage: "One-way delay"},
+							&cli.DurationFlag{Name: "jitter", Usage: "Uniform jitter around the delay"},
+							&cli.Float64Flag{Name: "loss", Usage: "Loss probability per write (0-1)"},
+							&cli.StringFlag{Name: "bandwidth", Usage: "Rate cap, e.g. 100mbit (empty = unlimited)"},
+						},
+						Action: func(c *cli.Context) error {
+							lf := LinkFault{
+								Delay:  faultDuration(c.Duration("delay")),
+								Jitter: faultDuration(c.Duration("jitter")),
+								Loss:   c.Float64("loss"),
+							}
+							if bw := c.String("bandwidth"); bw != "" {
+								rate, err := parseRate(bw)
+								if err != nil {
+									return err
+								}
+								lf.Bandwidth = rate
+							}
+							args := &FaultsSetLinkArgs{From: c.Int("from"), To: c.Int("to"), Fault: lf}
+							return faultsCommand(c.String("conf"), c.Int("id"), c.Int("as"), RPCFaultsSetLink, args)
+						},
+					},
 				},
 			},
 		},
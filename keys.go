@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Key files written by `pbft keygen`. A node's key file is PEM and holds its
+// ed25519 private key followed by one "PBFT MAC KEY" block per peer (the shared
+// secret for --crypto mac). The same file doubles as the TLS key, since Go's TLS
+// loader skips blocks that are not private keys. Public keys are published in
+// cluster.conf, so the key file never leaves its node.
+
+const (
+	PEM_PRIVATE_KEY = "PRIVATE KEY"
+	PEM_MAC_KEY     = "PBFT MAC KEY"
+	PEM_CERTIFICATE = "CERTIFICATE"
+	MAC_KEY_SIZE    = 32
+	CERT_VALIDITY   = 10 * 365 * 24 * time.Hour
+)
+
+type nodeKeys struct {
+	priv    ed25519.PrivateKey
+	pubKeys map[int]ed25519.PublicKey
+	macKeys map[int][]byte
+}
+
+// generateClusterKeys creates keys for every node in confPath under outDir and
+// rewrites confPath to reference them.
+func generateClusterKeys(confPath string, outDir string, force bool) error {
+	nodes := parseClusterConfig(confPath)
+	absOut := resolveConfigPath(confPath, outDir)
+	if err := os.MkdirAll(absOut, 0700); err != nil {
+		return err
+	}
+
+	privs := make(map[int]ed25519.PrivateKey)
+	for _, node := range nodes {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		privs[node.ID] = priv
+	}
+
+	// One shared secret per unordered pair, including each node with itself
+	macKeys := make(map[[2]int][]byte)
+	for _, a := range nodes {
+		for _, b := range nodes {
+			pair := [2]int{min(a.ID, b.ID), max(a.ID, b.ID)}
+			if _, ok := macKeys[pair]; ok {
+				continue
+			}
+			key := make([]byte, MAC_KEY_SIZE)
+			if _, err := rand.Read(key); err != nil {
+				return err
+			}
+			macKeys[pair] = key
+		}
+	}
+
+	for i, node := range nodes {
+		keyFile := filepath.Join(outDir, fmt.Sprintf("node%d.key", node.ID))
+		certFile := filepath.Join(outDir, fmt.Sprintf("node%d.crt", node.ID))
+		for _, f := range []string{keyFile, certFile} {
+			if _, err := os.Stat(resolveConfigPath(confPath, f)); err == nil && !force {
+				return fmt.Errorf("%s already exists (use --force to overwrite)", f)
+			}
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(privs[node.ID])
+		if err != nil {
+			return err
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: PEM_PRIVATE_KEY, Bytes: der})
+		for _, peer := range nodes {
+			pair := [2]int{min(node.ID, peer.ID), max(node.ID, peer.ID)}
+			data = append(data, pem.EncodeToMemory(&pem.Block{
+				Type:    PEM_MAC_KEY,
+				Headers: map[string]string{"Peer": strconv.Itoa(peer.ID)},
+				Bytes:   macKeys[pair],
+			})...)
+		}
+		if err := os.WriteFile(resolveConfigPath(confPath, keyFile), data, 0600); err != nil {
+			return err
+		}
+
+		cert, err := selfSignedCertificate(node.ID, privs[node.ID])
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(resolveConfigPath(confPath, certFile), pem.EncodeToMemory(&pem.Block{Type: PEM_CERTIFICATE, Bytes: cert}), 0644); err != nil {
+			return err
+		}
+
+		nodes[i].PublicKey = base64.StdEncoding.EncodeToString(privs[node.ID].Public().(ed25519.PublicKey))
+		nodes[i].KeyFile = keyFile
+		nodes[i].TLSCert = certFile
+		nodes[i].TLSKey = keyFile
+	}
+
+	conf, err := json.MarshalIndent(nodes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(confPath, append(conf, '\n'), 0644)
+}
+
+// selfSignedCertificate returns a DER certificate for node id. It is pinned in
+// cluster.conf, so the only thing that matters is that it is bound to the key.
+func selfSignedCertificate(id int, priv ed25519.PrivateKey) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("node-%d", id)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(CERT_VALIDITY),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	return x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+}
+
+// loadKeys loads the keys written by `pbft keygen`, or derives throwaway ones
+// for tests if testKeys (--insecure-test-keys) is set. Missing or broken key
+// files are an error, never a reason to fall back to the derived keys.
+func loadKeys(confPath string, id int, nodes []Node, testKeys bool) (*nodeKeys, error) {
+	if testKeys {
+		return insecureTestKeys(id, nodes)
+	}
+	return loadNodeKeys(confPath, id, nodes)
+}
+
+// loadNodeKeys reads node id's key file and every node's public key from the config.
+func loadNodeKeys(confPath string, id int, nodes []Node) (*nodeKeys, error) {
+	keys := &nodeKeys{
+		pubKeys: make(map[int]ed25519.PublicKey),
+		macKeys: make(map[int][]byte),
+	}
+
+	keyFile := ""
+	for _, node := range nodes {
+		if node.PublicKey == "" {
+			return nil, fmt.Errorf("node %d has no public_key in %s (run `pbft keygen`)", node.ID, confPath)
+		}
+		pub, err := base64.StdEncoding.DecodeString(node.PublicKey)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("node %d has an invalid public_key", node.ID)
+		}
+		keys.pubKeys[node.ID] = ed25519.PublicKey(pub)
+		if node.ID == id {
+			keyFile = node.KeyFile
+		}
+	}
+	if keyFile == "" {
+		return nil, fmt.Errorf("node %d has no key_file in %s (run `pbft keygen`)", id, confPath)
+	}
+
+	data, err := os.ReadFile(resolveConfigPath(confPath, keyFile))
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case PEM_PRIVATE_KEY:
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", keyFile, err)
+			}
+			priv, ok := key.(ed25519.PrivateKey)
+			if !ok {
+				return nil, fmt.Errorf("%s: not an ed25519 key", keyFile)
+			}
+			keys.priv = priv
+		case PEM_MAC_KEY:
+			peer, err := strconv.Atoi(block.Headers["Peer"])
+			if err != nil {
+				return nil, fmt.Errorf("%s: MAC key without a valid Peer header", keyFile)
+			}
+			keys.macKeys[peer] = block.Bytes
+		}
+	}
+
+	if keys.priv == nil {
+		return nil, fmt.Errorf("%s: no private key", keyFile)
+	}
+	if !keys.priv.Public().(ed25519.PublicKey).Equal(keys.pubKeys[id]) {
+		return nil, fmt.Errorf("%s does not match the public_key of node %d", keyFile, id)
+	}
+	for _, node := range nodes {
+		if _, ok := keys.macKeys[node.ID]; !ok {
+			return nil, fmt.Errorf("%s: no MAC key shared with node %d", keyFile, node.ID)
+		}
+	}
+	return keys, nil
+}
+
+// insecureTestKeys derives every key from node IDs. Anyone can recompute them, so
+// this is only for tests and local experiments (--insecure-test-keys).
+func insecureTestKeys(id int, nodes []Node) (*nodeKeys, error) {
+	keys := &nodeKeys{
+		pubKeys: make(map[int]ed25519.PublicKey),
+		macKeys: make(map[int][]byte),
+	}
+	for _, node := range nodes {
+		priv, err := generateEd25519Key(node.ID)
+		if err != nil {
+			return nil, err
+		}
+		if node.ID == id {
+			keys.priv = priv
+		}
+		keys.pubKeys[node.ID] = priv.Public().(ed25519.PublicKey)
+		keys.macKeys[node.ID] = generateMACKey(id, node.ID)
+	}
+	return keys, nil
+}
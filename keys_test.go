@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeClusterConfig(t *testing.T, confPath string, nodes []Node) {
+	data, err := json.Marshal(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(confPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Every node can load what keygen wrote for it, and the keys fit together: the
+// signing key matches the published public key, MAC keys are shared pairwise
+// and the certificate is bound to the node.
+func TestKeygenRoundTrip(t *testing.T) {
+	confPath := keygenCluster(t, 4)
+	nodes := parseClusterConfig(confPath)
+
+	keys := make(map[int]*nodeKeys)
+	for _, node := range nodes {
+		k, err := loadNodeKeys(confPath, node.ID, nodes)
+		if err != nil {
+			t.Fatalf("node %d: %v", node.ID, err)
+		}
+		keys[node.ID] = k
+		if _, err := loadTLS(confPath, node.ID, nodes); err != nil {
+			t.Fatalf("node %d: %v", node.ID, err)
+		}
+	}
+	for a, ka := range keys {
+		sig := ed25519.Sign(ka.priv, []byte("msg"))
+		for b, kb := range keys {
+			if !ed25519.Verify(kb.pubKeys[a], []byte("msg"), sig) {
+				t.Fatalf("node %d cannot verify node %d", b, a)
+			}
+			if !bytes.Equal(ka.macKeys[b], kb.macKeys[a]) {
+				t.Fatalf("nodes %d and %d do not share a MAC key", a, b)
+			}
+			if a != b && bytes.Equal(ka.macKeys[b], ka.macKeys[a]) {
+				t.Fatalf("node %d uses the same MAC key with %d and itself", a, b)
+			}
+		}
+	}
+}
+
+func TestLoadNodeKeysRejectsMismatchedKey(t *testing.T) {
+	confPath := keygenCluster(t, 4)
+	nodes := parseClusterConfig(confPath)
+	nodes[0].KeyFile = nodes[1].KeyFile
+	writeClusterConfig(t, confPath, nodes)
+
+	_, err := loadNodeKeys(confPath, 1, nodes)
+	if err == nil || !strings.Contains(err.Error(), "does not match the public_key") {
+		t.Fatalf("got %v, want a public_key mismatch", err)
+	}
+}
+
+func TestLoadNodeKeysMissingFile(t *testing.T) {
+	confPath := keygenCluster(t, 4)
+	nodes := parseClusterConfig(confPath)
+	if err := os.Remove(resolveConfigPath(confPath, nodes[0].KeyFile)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadNodeKeys(confPath, 1, nodes); err == nil {
+		t.Fatalf("loaded keys from a missing file")
+	}
+
+	nodes[0].KeyFile = ""
+	if _, err := loadNodeKeys(confPath, 1, nodes); err == nil {
+		t.Fatalf("loaded keys without a key_file")
+	}
+}
+
+// Without --insecure-test-keys a node runs with its key file or not at all; it
+// never derives the keys anyone can compute.
+func TestLoadKeysNeverDerivesTestKeys(t *testing.T) {
+	confPath := filepath.Join(t.TempDir(), "cluster.conf")
+	nodes := []Node{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}}
+	writeClusterConfig(t, confPath, nodes)
+	if _, err := loadKeys(confPath, 1, nodes, false); err == nil {
+		t.Fatalf("started without key files")
+	}
+
+	confPath = keygenCluster(t, 4)
+	nodes = parseClusterConfig(confPath)
+	derived, err := insecureTestKeys(1, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadKeys(confPath, 1, nodes, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.priv.Equal(derived.priv) || bytes.Equal(keys.macKeys[2], derived.macKeys[2]) {
+		t.Fatalf("loaded the derived test keys instead of the key file")
+	}
+	keys, err = loadKeys(confPath, 1, nodes, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keys.priv.Equal(derived.priv) {
+		t.Fatalf("--insecure-test-keys did not derive the keys")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+)
+
+// Learners, after the Paxos role: read replicas that follow the cluster without
+// voting. A node listed with "role": "learner" in cluster.conf is not a member,
+// never receives PrePrepares and never sends Prepare or Commit, and f and the
+// quorums are computed over the replicas alone.
+//
+// Every replica tells each learner what it executed after what: the batch's
+// digest and the sequence number executed before it, since HotStuff skips the
+// heights of empty blocks. Only the f+1 replicas designated by the sequence
+// number send the batch itself. A learner applies a batch through executeLocked
+// once f+1 replicas report it, so at least one correct replica executed it, and
+// answers nobody but --read-mode stale reads.
+//
+// Speculative batches can still be rolled back, so --speculative publishes
+// nothing to learners.
+
+const (
+	RPCLearn = "PBFT.Learn"
+
+	RoleReplica = "replica"
+	RoleLearner = "learner"
+
+	LEARN_WINDOW = 2 * CHECKPOINT_INTERVAL // how far ahead of its execution a learner buffers
+)
+
+type LearnArgs struct {
+	Previous         int // sequence number the sender executed before this batch
+	SequenceNumber   int
+	Digest           string
+	Command          []byte // only from the designated replicas
+	StableCheckpoint int    // the sender's latest stable checkpoint
+	NodeID           int
+	Signature        []byte
+	Auth             Authenticator
+}
+
+type LearnReply struct {
+	Success bool
+}
+
+// learnVote is what one replica reported it executed after a sequence number.
+type learnVote struct {
+	seq    int
+	digest string
+}
+
+type learnedBatch struct {
+	votes   map[int]learnVote // NodeID -> report
+	batches map[int][]byte    // NodeID -> batch, from designated replicas
+}
+
+// learning is a learner's view of the batches it has not applied yet.
+type learning struct {
+	pending map[int]*learnedBatch // keyed by the sequence number executed before
+	stable  map[int]int           // NodeID -> stable checkpoint it last reported
+}
+
+func newLearning() *learning {
+	return &learning{
+		pending: make(map[int]*learnedBatch),
+		stable:  make(map[int]int),
+	}
+}
+
+// isLearner reports whether node id is listed as a learner.
+func (p *PBFT) isLearner(id int) bool {
+	_, ok := p.learners[id]
+	return ok
+}
+
+// addrOf returns the address of a replica or learner.
+func (p *PBFT) addrOf(id int) string {
+	if addr, ok := p.replicas().peerIPPort[id]; ok {
+		return addr
+	}
+	return p.learners[id]
+}
+
+// staleReaderAt picks the node for a stale read, rotating through the replicas
+// and then the learners.
+func (p *PBFT) staleReaderAt(i int) int {
+	readers := append([]int(nil), p.replicas().members...)
+	learners := make([]int, 0, len(p.learners))
+	for id := range p.learners {
+		learners = append(learners, id)
+	}
+	sort.Ints(learners)
+	readers = append(readers, learners...)
+	return readers[i%len(readers)]
+}
+
+// signForLearners authenticates data for the learners: learner keys are kept
+// apart from the replicas', so that a learner can never vote.
+func (p *PBFT) signForLearners(data []byte) ([]byte, Authenticator, error) {
+	if p.cryptoType == CryptoMAC {
+		macKeys := make(map[int][]byte, len(p.learnerKeys))
+		for id, key := range p.learnerKeys {
+			macKeys[id] = key.([]byte)
+		}
+		auth, err := newAuthenticator(macKeys, data)
+		return nil, auth, err
+	}
+	sig, err := sign(p.privKey, data)
+	return sig, nil, err
+}
+
+// verifyLearnerMessage checks that data was sent by learner sender.
+func (p *PBFT) verifyLearnerMessage(sender int, data []byte, sig []byte, auth Authenticator) error {
+	key := p.learnerKeys[sender]
+	if key == nil {
+		return fmt.Errorf("no key for learner %d", sender)
+	}
+	if p.cryptoType == CryptoMAC {
+		return auth.verify(p.id, key.([]byte), data)
+	}
+	return verify(key, data, sig)
+}
+
+// publishLocked tells the learners that command executed as seq, right after prev.
+func (p *PBFT) publishLocked(prev int, seq int, command []byte) {
+	if len(p.learners) == 0 {
+		return
+	}
+	args := &LearnArgs{
+		Previous:         prev,
+		SequenceNumber:   seq,
+		Digest:           hash(command),
+		StableCheckpoint: p.stableCheckpoint,
+		NodeID:           p.id,
+	}
+	sig, auth, err := p.signForLearners(digestLearn(args))
+	if err != nil {
+		p.logPutLocked(LogLearner, slog.LevelError, "Error signing Learn", "seq", seq, "err", err)
+		return
+	}
+	args.Signature = sig
+	args.Auth = auth
+
+	f := maxFaulty(p.replicas().clusterSize)
+	for i := 0; i <= f; i++ {
+		if p.memberAt(seq+i) == p.id {
+			args.Command = command
+		}
+	}
+	for id := range p.learners {
+		go func(target int) {
+			reply := &LearnReply{}
+			p.sendRPC(target, RPCLearn, args, reply)
+		}(id)
+	}
+}
+
+// Learn takes a replica's report of an executed batch.
+func (p *PBFT) Learn(args *LearnArgs, reply *LearnReply) error {
+	if !p.learner {
+		reply.Success = false
+		return nil
+	}
+	err := p.verifier.Verify(func() error {
+		return p.verifyMessage(args.NodeID, digestLearn(args), args.Signature, args.Auth)
+	})
+	if err != nil {
+		p.logPut(LogLearner, slog.LevelWarn, "Signature verification failed for Learn", "peer", args.NodeID, "seq", args.SequenceNumber, "err", err)
+		reply.Success = false
+		return nil
+	}
+	if args.Command != nil && hash(args.Command) != args.Digest {
+		p.logPut(LogLearner, slog.LevelWarn, "Learned batch does not match its digest", "peer", args.NodeID, "seq", args.SequenceNumber)
+		reply.Success = false
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.learnLocked(args)
+	reply.Success = true
+	return nil
+}
+
+func (p *PBFT) learnLocked(args *LearnArgs) {
+	l := p.learn
+	l.stable[args.NodeID] = args.StableCheckpoint
+	p.updateStableLocked()
+
+	if args.Previous < p.lastExecuted || args.SequenceNumber <= args.Previous {
+		return
+	}
+	if args.Previous >= p.lastExecuted+LEARN_WINDOW {
+		p.logPutLocked(LogLearner, slog.LevelWarn, "Learner is too far behind", "seq", args.SequenceNumber, "executed", p.lastExecuted)
+		return
+	}
+	b, ok := l.pending[args.Previous]
+	if !ok {
+		b = &learnedBatch{votes: make(map[int]learnVote), batches: make(map[int][]byte)}
+		l.pending[args.Previous] = b
+	}
+	b.votes[args.NodeID] = learnVote{seq: args.SequenceNumber, digest: args.Digest}
+	if args.Command != nil {
+		b.batches[args.NodeID] = args.Command
+	}
+	p.applyLearnedLocked()
+}
+
+// updateStableLocked takes the f+1-th highest stable checkpoint the replicas
+// reported: at least one correct replica has reached it.
+func (p *PBFT) updateStableLocked() {
+	rs := p.replicas()
+	f := maxFaulty(rs.clusterSize)
+	marks := make([]int, 0, len(rs.members))
+	for _, id := range rs.members {
+		marks = append(marks, p.learn.stable[id])
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(marks)))
+	if len(marks) > f && marks[f] > p.stableCheckpoint {
+		p.stableCheckpoint = marks[f]
+	}
+}
+
+// applyLearnedLocked executes, in order, every batch that f+1 replicas reported
+// after the last one executed here.
+func (p *PBFT) applyLearnedLocked() {
+	f := maxFaulty(p.replicas().clusterSize)
+	for {
+		prev := p.lastExecuted
+		b, ok := p.learn.pending[prev]
+		if !ok {
+			return
+		}
+		count := make(map[learnVote]int)
+		var decided *learnVote
+		for _, v := range b.votes {
+			count[v]++
+			if count[v] > f {
+				v := v
+				decided = &v
+				break
+			}
+		}
+		if decided == nil {
+			return
+		}
+		var command []byte
+		for id, batch := range b.batches {
+			if b.votes[id] == *decided {
+				command = batch
+				break
+			}
+		}
+		if command == nil {
+			return
+		}
+
+		delete(p.learn.pending, prev)
+		p.executeLocked(decided.seq, command)
+		if decided.seq/CHECKPOINT_INTERVAL > prev/CHECKPOINT_INTERVAL {
+			// Drop reports that were never confirmed
+			for k := range p.learn.pending {
+				if k < p.lastExecuted {
+					delete(p.learn.pending, k)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Linearizability checking in the style of Porcupine: the history is split into
+// independent partitions (one per key for the KV store) and each partition is
+// searched with the Wing & Gong / Lowe algorithm, memoizing (linearized set, state)
+// pairs so that equivalent search branches are only explored once.
+
+// Operation is a completed (or pending) client operation. Pending operations have
+// Return == math.MaxInt64 and a nil Output, meaning the outcome is unknown.
+type Operation struct {
+	ClientID int
+	Input    interface{}
+	Call     int64
+	Output   interface{}
+	Return   int64
+}
+
+// Model is the sequential specification a history is checked against.
+type Model struct {
+	Partition         func(ops []Operation) [][]Operation
+	Init              func() interface{}
+	Step              func(state interface{}, input interface{}, output interface{}) (bool, interface{})
+	Equal             func(a, b interface{}) bool
+	DescribeOperation func(input interface{}, output interface{}) string
+
+	// SelfContained reports whether every output in ops can be explained by
+	// operations inside ops. Minimization only keeps such sub-histories, otherwise
+	// every violation would shrink to a lone read of a value nobody wrote.
+	SelfContained func(ops []Operation) bool
+}
+
+type CheckResult int
+
+const (
+	CheckOk CheckResult = iota
+	CheckIllegal
+	CheckUnknown // timed out before reaching a verdict
+)
+
+func (r CheckResult) String() string {
+	switch r {
+	case CheckOk:
+		return "ok"
+	case CheckIllegal:
+		return "illegal"
+	default:
+		return "unknown"
+	}
+}
+
+// LinearizabilityReport holds the verdict and, when illegal, one minimal violating
+// sub-history per failing partition. Removing any single operation from a reported
+// sub-history makes it linearizable again (or leaves a read nothing explains).
+type LinearizabilityReport struct {
+	Result     CheckResult
+	Violations [][]Operation
+}
+
+// KV model
+
+type kvInput struct {
+	Op    string
+	Key   string
+	Value string
+}
+
+type kvState struct {
+	present bool
+	value   string
+}
+
+var KVModel = Model{
+	Partition: func(ops []Operation) [][]Operation {
+		byKey := make(map[string][]Operation)
+		var keys []string
+		for _, op := range ops {
+			key := op.Input.(kvInput).Key
+			if _, ok := byKey[key]; !ok {
+				keys = append(keys, key)
+			}
+			byKey[key] = append(byKey[key], op)
+		}
+		sort.Strings(keys)
+		partitions := make([][]Operation, 0, len(keys))
+		for _, k := range keys {
+			partitions = append(partitions, byKey[k])
+		}
+		return partitions
+	},
+	Init: func() interface{} {
+		return kvState{}
+	},
+	Step: func(state interface{}, input interface{}, output interface{}) (bool, interface{}) {
+		st := state.(kvState)
+		in := input.(kvInput)
+		out, known := output.(string)
+		switch in.Op {
+		case "SET":
+			return !known || out == "OK", kvState{present: true, value: in.Value}
+		case "DELETE":
+			return !known || out == "OK", kvState{}
+		case "GET":
+			if !known {
+				return true, st
+			}
+			if st.present {
+				return out == st.value, st
+			}
+			return out == "Key not found", st
+		default:
+			// Unknown commands do not touch the state machine.
+			return true, st
+		}
+	},
+	Equal: func(a, b interface{}) bool {
+		return a.(kvState) == b.(kvState)
+	},
+	SelfContained: func(ops []Operation) bool {
+		written := make(map[string]bool)
+		for _, op := range ops {
+			if in := op.Input.(kvInput); in.Op == "SET" {
+				written[in.Value] = true
+			}
+		}
+		for _, op := range ops {
+			out, known := op.Output.(string)
+			if in := op.Input.(kvInput); in.Op == "GET" && known && out != "Key not found" && !written[out] {
+				return false
+			}
+		}
+		return true
+	},
+	DescribeOperation: func(input interface{}, output interface{}) string {
+		in := input.(kvInput)
+		out, known := output.(string)
+		if !known {
+			out = "?"
+		}
+		switch in.Op {
+		case "SET":
+			return fmt.Sprintf("SET %s %s -> %s", in.Key, in.Value, out)
+		default:
+			return fmt.Sprintf("%s %s -> %s", in.Op, in.Key, out)
+		}
+	},
+}
+
+// historyOperations pairs invoke and complete events into KV operations.
+// Invocations without a completion are kept as pending operations; discarded
+// ones are dropped.
+func historyOperations(events []HistoryEvent) []Operation {
+	byID := make(map[int]int)
+	discarded := make(map[int]bool)
+	var ops []Operation
+	for _, ev := range events {
+		switch ev.Kind {
+		case HistoryInvoke:
+			byID[ev.OpID] = len(ops)
+			ops = append(ops, Operation{
+				ClientID: ev.ClientID,
+				Input:    kvInput{Op: ev.Op, Key: ev.Key, Value: ev.Value},
+				Call:     ev.Time,
+				Return:   math.MaxInt64,
+			})
+		case HistoryComplete:
+			if i, ok := byID[ev.OpID]; ok {
+				ops[i].Output = ev.Value
+				ops[i].Return = ev.Time
+			}
+		case HistoryDiscard:
+			if i, ok := byID[ev.OpID]; ok {
+				discarded[i] = true
+			}
+		}
+	}
+	if len(discarded) == 0 {
+		return ops
+	}
+	kept := ops[:0]
+	for i, op := range ops {
+		if !discarded[i] {
+			kept = append(kept, op)
+		}
+	}
+	return kept
+}
+
+// CheckHistory checks recorded client events against the KV model.
+func CheckHistory(events []HistoryEvent, timeout time.Duration) LinearizabilityReport {
+	return CheckOperations(KVModel, historyOperations(events), timeout)
+}
+
+// CheckOperations checks a history against model. A zero timeout means no limit.
+// Minimizing violations shares the same deadline; if it runs out, the reported
+// sub-history is still violating but may not be minimal.
+func CheckOperations(model Model, history []Operation, timeout time.Duration) LinearizabilityReport {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	partitions := [][]Operation{history}
+	if model.Partition != nil {
+		partitions = model.Partition(history)
+	}
+
+	report := LinearizabilityReport{Result: CheckOk}
+	for _, part := range partitions {
+		switch checkPartition(model, part, deadline) {
+		case CheckIllegal:
+			report.Result = CheckIllegal
+			report.Violations = append(report.Violations, minimizeViolation(model, part, deadline))
+		case CheckUnknown:
+			if report.Result == CheckOk {
+				report.Result = CheckUnknown
+			}
+		}
+	}
+	return report
+}
+
+// minimizeViolation shrinks an illegal history with delta debugging until no
+// single operation can be removed without the history becoming linearizable.
+func minimizeViolation(model Model, ops []Operation, deadline time.Time) []Operation {
+	// A read of a value that was never written is its own witness.
+	selfContained := model.SelfContained != nil && model.SelfContained(ops)
+
+	n := 2
+	for len(ops) >= 2 {
+		chunk := (len(ops) + n - 1) / n
+		reduced := false
+		for start := 0; start < len(ops); start += chunk {
+			end := min(start+chunk, len(ops))
+			candidate := make([]Operation, 0, len(ops)-(end-start))
+			candidate = append(candidate, ops[:start]...)
+			candidate = append(candidate, ops[end:]...)
+			if selfContained && !model.SelfContained(candidate) {
+				continue
+			}
+			res := checkPartition(model, candidate, deadline)
+			if res == CheckUnknown {
+				return ops
+			}
+			if res == CheckIllegal {
+				ops = candidate
+				n = max(n-1, 2)
+				reduced = true
+				break
+			}
+		}
+		if !reduced {
+			if n >= len(ops) {
+				break
+			}
+			n = min(n*2, len(ops))
+		}
+	}
+	return ops
+}
+
+// FormatViolation renders a violating sub-history ordered by invocation time.
+func FormatViolation(model Model, ops []Operation) string {
+	sorted := append([]Operation(nil), ops...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Call < sorted[j].Call })
+
+	var sb strings.Builder
+	for _, op := range sorted {
+		ret := "pending"
+		if op.Return != math.MaxInt64 {
+			ret = fmt.Sprintf("%.3fms", float64(op.Return)/1e6)
+		}
+		fmt.Fprintf(&sb, "  client %d [%.3fms, %s] %s\n", op.ClientID, float64(op.Call)/1e6, ret, model.DescribeOperation(op.Input, op.Output))
+	}
+	return sb.String()
+}
+
+// Search structures
+
+type linNode struct {
+	value interface{}
+	match *linNode // call nodes point to their return node
+	id    int
+	prev  *linNode
+	next  *linNode
+}
+
+type linEvent struct {
+	isCall bool
+	id     int
+	value  interface{}
+	time   int64
+}
+
+func makeLinList(ops []Operation) *linNode {
+	events := make([]linEvent, 0, 2*len(ops))
+	for i, op := range ops {
+		events = append(events, linEvent{isCall: true, id: i, value: op.Input, time: op.Call})
+		events = append(events, linEvent{isCall: false, id: i, value: op.Output, time: op.Return})
+	}
+	// On equal timestamps calls go first, which treats the operations as concurrent.
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].time != events[j].time {
+			return events[i].time < events[j].time
+		}
+		return events[i].isCall && !events[j].isCall
+	})
+
+	head := &linNode{id: -1}
+	returns := make(map[int]*linNode)
+	var next *linNode
+	for i := len(events) - 1; i >= 0; i-- {
+		ev := events[i]
+		n := &linNode{value: ev.value, id: ev.id, next: next}
+		if ev.isCall {
+			n.match = returns[ev.id]
+		} else {
+			returns[ev.id] = n
+		}
+		if next != nil {
+			next.prev = n
+		}
+		next = n
+	}
+	head.next = next
+	if next != nil {
+		next.prev = head
+	}
+	return head
+}
+
+func (n *linNode) lift() {
+	n.prev.next = n.next
+	n.next.prev = n.prev
+	m := n.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+func (n *linNode) unlift() {
+	m := n.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	n.prev.next = n
+	n.next.prev = n
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int) bitset {
+	b[i/64] |= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) clear(i int) bitset {
+	b[i/64] &^= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) clone() bitset {
+	return append(bitset(nil), b...)
+}
+
+func (b bitset) equals(o bitset) bool {
+	for i := range b {
+		if b[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	h := uint64(14695981039346656037)
+	for _, w := range b {
+		h ^= w
+		h *= 1099511628211
+	}
+	return h
+}
+
+// LIN_CACHE_LIMIT bounds the memory the search spends on memoized states per
+// partition. Past it the verdict is unknown, as on a timeout.
+const LIN_CACHE_LIMIT = 512 << 20
+
+type linCacheEntry struct {
+	linearized bitset
+	state      interface{}
+}
+
+type linFrame struct {
+	node  *linNode
+	state interface{}
+}
+
+func checkPartition(model Model, ops []Operation, deadline time.Time) CheckResult {
+	if len(ops) == 0 {
+		return CheckOk
+	}
+	head := makeLinList(ops)
+	linearized := newBitset(len(ops))
+	cache := make(map[uint64][]linCacheEntry)
+	cacheBytes := 0
+	var calls []linFrame
+	state := model.Init()
+
+	seen := func(b bitset, s interface{}) bool {
+		h := b.hash()
+		for _, e := range cache[h] {
+			if e.linearized.equals(b) && model.Equal(e.state, s) {
+				return true
+			}
+		}
+		cache[h] = append(cache[h], linCacheEntry{linearized: b, state: s})
+		cacheBytes += 8 * len(b)
+		return false
+	}
+
+	entry := head.next
+	for iter := 0; head.next != nil; iter++ {
+		if iter&0xfff == 0 && (cacheBytes > LIN_CACHE_LIMIT || !deadline.IsZero() && time.Now().After(deadline)) {
+			return CheckUnknown
+		}
+		if entry.match != nil {
+			ok, newState := model.Step(state, entry.value, entry.match.value)
+			if ok && !seen(linearized.clone().set(entry.id), newState) {
+				calls = append(calls, linFrame{node: entry, state: state})
+				state = newState
+				linearized.set(entry.id)
+				entry.lift()
+				entry = head.next
+			} else {
+				entry = entry.next
+			}
+		} else {
+			// Reached a return whose call cannot be linearized yet: backtrack.
+			if len(calls) == 0 {
+				return CheckIllegal
+			}
+			top := calls[len(calls)-1]
+			calls = calls[:len(calls)-1]
+			state = top.state
+			linearized.clear(top.node.id)
+			top.node.unlift()
+			entry = top.node.next
+		}
+	}
+	return CheckOk
+}
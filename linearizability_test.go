@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func kvOp(client int, op, key, value string, call int64, output interface{}, ret int64) Operation {
+	return Operation{
+		ClientID: client,
+		Input:    kvInput{Op: op, Key: key, Value: value},
+		Call:     call,
+		Output:   output,
+		Return:   ret,
+	}
+}
+
+func TestKVLinearizable(t *testing.T) {
+	ops := []Operation{
+		kvOp(0, "SET", "x", "1", 0, "OK", 10),
+		kvOp(1, "GET", "x", "", 5, "Key not found", 8), // concurrent with the SET
+		kvOp(1, "GET", "x", "", 12, "1", 15),
+		kvOp(2, "SET", "y", "2", 0, "OK", 3),
+		kvOp(0, "DELETE", "y", "", 4, "OK", 6),
+		kvOp(2, "GET", "y", "", 7, "Key not found", 9),
+	}
+	report := CheckOperations(KVModel, ops, 0)
+	if report.Result != CheckOk {
+		t.Fatalf("expected ok, got %v: %v", report.Result, report.Violations)
+	}
+}
+
+func TestKVStaleReadIsIllegal(t *testing.T) {
+	ops := []Operation{
+		kvOp(0, "SET", "x", "1", 0, "OK", 10),
+		kvOp(0, "SET", "x", "2", 20, "OK", 30),
+		kvOp(1, "GET", "x", "", 2, "1", 4),
+		kvOp(1, "GET", "x", "", 40, "1", 50), // stale: SET 2 finished before
+		kvOp(2, "SET", "y", "3", 0, "OK", 10),
+		kvOp(2, "GET", "y", "", 20, "3", 30),
+	}
+	report := CheckOperations(KVModel, ops, time.Second)
+	if report.Result != CheckIllegal {
+		t.Fatalf("expected illegal, got %v", report.Result)
+	}
+	if len(report.Violations) != 1 {
+		t.Fatalf("expected one violating partition, got %d", len(report.Violations))
+	}
+
+	// Both SETs and the stale GET form the minimal witness; the early GET and
+	// the other key are irrelevant.
+	v := report.Violations[0]
+	if len(v) != 3 {
+		t.Fatalf("expected a 3-operation violation, got:\n%s", FormatViolation(KVModel, v))
+	}
+	for _, op := range v {
+		in := op.Input.(kvInput)
+		if in.Key != "x" || (in.Op == "GET" && op.Call != 40) {
+			t.Fatalf("unexpected operation in violation:\n%s", FormatViolation(KVModel, v))
+		}
+	}
+}
+
+func TestKVPendingOperation(t *testing.T) {
+	// A write whose reply never arrived may take effect at any later point.
+	ops := []Operation{
+		kvOp(0, "SET", "x", "1", 0, nil, math.MaxInt64),
+		kvOp(1, "GET", "x", "", 5, "Key not found", 6),
+		kvOp(1, "GET", "x", "", 10, "1", 12),
+	}
+	if res := CheckOperations(KVModel, ops, 0).Result; res != CheckOk {
+		t.Fatalf("expected ok, got %v", res)
+	}
+
+	// But once observed it cannot be undone.
+	ops = append(ops, kvOp(1, "GET", "x", "", 20, "Key not found", 22))
+	if res := CheckOperations(KVModel, ops, 0).Result; res != CheckIllegal {
+		t.Fatalf("expected illegal, got %v", res)
+	}
+}
+
+func TestHistoryOperations(t *testing.T) {
+	h := NewHistory()
+	set := h.Invoke(0, []byte("SET x 1"))
+	get := h.Invoke(1, []byte("GET x"))
+	h.Complete(0, set, "OK")
+	h.Invoke(2, []byte("DELETE x")) // never completes
+
+	ops := historyOperations(h.Events())
+	if len(ops) != 3 {
+		t.Fatalf("expected 3 operations, got %d", len(ops))
+	}
+	if in := ops[0].Input.(kvInput); in.Op != "SET" || in.Key != "x" || in.Value != "1" || ops[0].Output != "OK" {
+		t.Fatalf("unexpected SET operation: %+v", ops[0])
+	}
+	if ops[1].Return != math.MaxInt64 || ops[2].Return != math.MaxInt64 {
+		t.Fatalf("operations without completion should be pending")
+	}
+	_ = get
+
+	if res := CheckHistory(h.Events(), 0).Result; res != CheckOk {
+		t.Fatalf("expected ok, got %v", res)
+	}
+}
+
+// Stale reads are discarded from the history rather than checked.
+func TestHistoryDiscard(t *testing.T) {
+	h := NewHistory()
+	set := h.Invoke(0, []byte("SET x 1"))
+	h.Complete(0, set, "OK")
+	stale := h.Invoke(1, []byte("GET x"))
+	h.Discard(1, stale)
+
+	ops := historyOperations(h.Events())
+	if len(ops) != 1 || ops[0].Input.(kvInput).Op != "SET" {
+		t.Fatalf("expected only the SET to remain, got %+v", ops)
+	}
+}
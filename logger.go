@@ -1,52 +1,274 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"sort"
+	"strings"
 )
 
+// Logging goes through log/slog as text or JSON lines. Every component logs at
+// its own level, which `pbft log-level` changes while the node runs. Records
+// carry the node, the component and the current view; call sites add seq, peer,
+// phase and the like as key/value pairs. A disabled level costs no formatting
+// and no lock.
+
 const (
-	BLUE = iota
-	GREEN
-	RED
-	YELLOW
-	WHITE
-	CYAN
-	PURPLE
-	MAGENTA
-	ORANGE
-	EMERALD
+	LogMain        = "main" // startup and the client workload
+	LogNet         = "net"  // connections and TLS
+	LogConsensus   = "consensus"
+	LogExec        = "exec" // the state machine
+	LogCheckpoint  = "checkpoint"
+	LogClient      = "client" // batching and client replies
+	LogRead        = "read"
+	LogHotStuff    = "hotstuff"
+	LogSpeculative = "speculative"
+	LogDissem      = "disseminate"
+	LogEpoch       = "epoch" // --leaders
+	LogReconfig    = "reconfig"
+	LogLearner     = "learner"
+	LogRecovery    = "recovery"
+	LogFaults      = "faults"
+	LogMetrics     = "metrics" // metrics and traces
+
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	RPCLogSetLevels = "Log.SetLevels"
 )
 
-func (p *PBFT) logPut(msg string, colour int) {
+var logComponents = []string{
+	LogMain, LogNet, LogConsensus, LogExec, LogCheckpoint, LogClient, LogRead, LogHotStuff,
+	LogSpeculative, LogDissem, LogEpoch, LogReconfig, LogLearner, LogRecovery, LogFaults, LogMetrics,
+}
+
+// levelHandler gates a handler on a level that can change at runtime.
+type levelHandler struct {
+	level *slog.LevelVar
+	slog.Handler
+}
+
+func (h *levelHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, Handler: h.Handler.WithGroup(name)}
+}
+
+// logging holds a logger per component. The maps are filled once and only the
+// levels change afterwards, so they are read without a lock. Every method is a
+// no-op on nil, which keeps replicas built in tests quiet.
+type logging struct {
+	levels  map[string]*slog.LevelVar
+	loggers map[string]*slog.Logger
+}
+
+// newLogging logs as node id to w. levels maps components to their level; the
+// "" entry applies to all the others.
+func newLogging(id int, format string, levels map[string]slog.Level, w io.Writer) (*logging, error) {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug - 4} // levelHandler filters
+	var base slog.Handler
+	switch format {
+	case LogFormatText:
+		base = slog.NewTextHandler(w, opts)
+	case LogFormatJSON:
+		base = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q (text, json)", format)
+	}
+	l := &logging{
+		levels:  make(map[string]*slog.LevelVar),
+		loggers: make(map[string]*slog.Logger),
+	}
+	for _, c := range logComponents {
+		level := new(slog.LevelVar)
+		l.levels[c] = level
+		l.loggers[c] = slog.New(&levelHandler{
+			level:   level,
+			Handler: base.WithAttrs([]slog.Attr{slog.Int("node", id), slog.String("component", c)}),
+		})
+	}
+	if err := l.setLevels(levels); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// parseLogLevels reads "info" or "warn,consensus=debug,net=error": a default
+// level and per-component ones.
+func parseLogLevels(spec string) (map[string]slog.Level, error) {
+	levels := make(map[string]slog.Level)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		component, name := "", item
+		if i := strings.Index(item, "="); i >= 0 {
+			component, name = item[:i], item[i+1:]
+			if !isLogComponent(component) {
+				return nil, fmt.Errorf("unknown log component %q (%s)", component, strings.Join(logComponents, ", "))
+			}
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(name)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q (debug, info, warn, error)", name)
+		}
+		levels[component] = level
+	}
+	return levels, nil
+}
+
+func isLogComponent(component string) bool {
+	for _, c := range logComponents {
+		if c == component {
+			return true
+		}
+	}
+	return false
+}
+
+// setLevels applies the "" entry of levels to every component, then the
+// per-component ones.
+func (l *logging) setLevels(levels map[string]slog.Level) error {
+	if l == nil {
+		return nil
+	}
+	for c := range levels {
+		if c != "" && !isLogComponent(c) {
+			return fmt.Errorf("unknown log component %q", c)
+		}
+	}
+	if level, ok := levels[""]; ok {
+		for _, lv := range l.levels {
+			lv.Set(level)
+		}
+	}
+	for c, level := range levels {
+		if c != "" {
+			l.levels[c].Set(level)
+		}
+	}
+	return nil
+}
+
+// currentLevels returns the level of every component.
+func (l *logging) currentLevels() map[string]string {
+	levels := make(map[string]string)
+	if l == nil {
+		return levels
+	}
+	for c, lv := range l.levels {
+		levels[c] = lv.Level().String()
+	}
+	return levels
+}
+
+// enabled returns the logger of component if it logs at level, or nil.
+func (l *logging) enabled(component string, level slog.Level) *slog.Logger {
+	if l == nil {
+		return nil
+	}
+	logger := l.loggers[component]
+	if !logger.Enabled(context.Background(), level) {
+		return nil
+	}
+	return logger
+}
+
+// log writes a record that carries no view.
+func (l *logging) log(component string, level slog.Level, msg string, args ...interface{}) {
+	if logger := l.enabled(component, level); logger != nil {
+		logger.Log(context.Background(), level, msg, args...)
+	}
+}
+
+func (p *PBFT) logPut(component string, level slog.Level, msg string, args ...interface{}) {
+	logger := p.logging.enabled(component, level)
+	if logger == nil {
+		return
+	}
 	p.mu.RLock()
-	defer p.mu.RUnlock()
-	p.logPutLocked(msg, colour)
+	view := p.view
+	p.mu.RUnlock()
+	logger.Log(context.Background(), level, msg, append([]interface{}{"view", view}, args...)...)
 }
 
-func (p *PBFT) logPutLocked(msg string, colour int) {
-	if !p.debug {
+func (p *PBFT) logPutLocked(component string, level slog.Level, msg string, args ...interface{}) {
+	logger := p.logging.enabled(component, level)
+	if logger == nil {
 		return
 	}
-	colors := map[int]string{
-		BLUE:    "\033[34m",
-		GREEN:   "\033[32m",
-		RED:     "\033[31m",
-		YELLOW:  "\033[33m",
-		WHITE:   "\033[37m",
-		CYAN:    "\033[36m",
-		PURPLE:  "\033[35m",
-		MAGENTA: "\033[95m",
+	logger.Log(context.Background(), level, msg, append([]interface{}{"view", p.view}, args...)...)
+}
+
+type LogSetLevelsArgs struct {
+	Levels map[string]slog.Level // "" for every component
+}
+
+type LogLevelsReply struct {
+	Levels map[string]string // component -> level
+}
+
+// LogService changes log levels at runtime (`pbft log-level`).
+type LogService struct {
+	p *PBFT
+}
+
+func (s *LogService) SetLevels(args *LogSetLevelsArgs, reply *LogLevelsReply) error {
+	if err := s.p.logging.setLevels(args.Levels); err != nil {
+		return err
 	}
-	color, ok := colors[colour]
-	if !ok {
-		color = "\033[0m"
+	reply.Levels = s.p.logging.currentLevels()
+	return nil
+}
+
+// logLevelCommand sets log levels on every node in confPath (or only target)
+// and prints the resulting level of each component. An empty levels only
+// prints them.
+func logLevelCommand(confPath string, target int, as int, levels map[string]slog.Level) error {
+	peers := parseConfig(confPath)
+	ids := make([]int, 0, len(peers))
+	for id := range peers {
+		if target == 0 || id == target {
+			ids = append(ids, id)
+		}
 	}
-	reset := "\033[0m"
+	sort.Ints(ids)
 
-	logPrefix := fmt.Sprintf("[Node %d | View %d] ", p.id, p.view)
-	log.Printf("%s%s%s", color, logPrefix+msg, reset)
+	failed := 0
+	for _, id := range ids {
+		client, err := dialNode(confPath, id, as)
+		if err != nil {
+			fmt.Printf("node %d: unreachable: %v\n", id, err)
+			failed++
+			continue
+		}
+		reply := &LogLevelsReply{}
+		err = client.Call(RPCLogSetLevels, &LogSetLevelsArgs{Levels: levels}, reply)
+		client.Close()
+		if err != nil {
+			fmt.Printf("node %d: %v\n", id, err)
+			failed++
+			continue
+		}
+		items := make([]string, 0, len(logComponents))
+		for _, c := range logComponents {
+			items = append(items, c+"="+reply.Levels[c])
+		}
+		fmt.Printf("node %d: %s\n", id, strings.Join(items, " "))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d node(s) failed", failed)
+	}
+	return nil
 }
 
 func (p *PBFT) printStateMachineAsStringLocked() string {
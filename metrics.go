@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Metrics in the Prometheus text exposition format, served on /metrics at
+// --metrics-addr. Counters and histograms are collected as the replica runs;
+// gauges are read from the replica state when scraped. Every method on *metrics
+// is a no-op on nil, so call sites need no check when metrics are off.
+
+const METRICS_PATH = "/metrics"
+
+var (
+	latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+	sizeBuckets    = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+)
+
+type histogram struct {
+	buckets []float64 // upper bounds
+	counts  []uint64  // observations per bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write prints the series of h; labels is empty or `name="value",...`.
+func (h *histogram) write(w io.Writer, name string, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+type rpcFailureKey struct {
+	peer   int
+	method string
+}
+
+type metrics struct {
+	mu          sync.Mutex
+	phases      map[string]*histogram // prepare, commit, execute (see markAtLocked)
+	batchSizes  map[string]*histogram // read, write
+	walAppend   *histogram
+	walFsync    *histogram
+	rpcFailures map[rpcFailureKey]uint64
+	executed    uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		phases:      make(map[string]*histogram),
+		batchSizes:  make(map[string]*histogram),
+		walAppend:   newHistogram(latencyBuckets),
+		walFsync:    newHistogram(latencyBuckets),
+		rpcFailures: make(map[rpcFailureKey]uint64),
+	}
+}
+
+func (m *metrics) observePhase(phase string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.phases[phase]
+	if !ok {
+		h = newHistogram(latencyBuckets)
+		m.phases[phase] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (m *metrics) observeBatch(kind string, size int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.batchSizes[kind]
+	if !ok {
+		h = newHistogram(sizeBuckets)
+		m.batchSizes[kind] = h
+	}
+	h.observe(float64(size))
+}
+
+// observeWAL records one log append; nothing is synced with --async-log.
+func (m *metrics) observeWAL(write time.Duration, fsync time.Duration, synced bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.walAppend.observe(write.Seconds())
+	if synced {
+		m.walFsync.observe(fsync.Seconds())
+	}
+}
+
+func (m *metrics) rpcFailed(peer int, method string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rpcFailures[rpcFailureKey{peer: peer, method: method}]++
+}
+
+func (m *metrics) executedBatch() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.executed++
+}
+
+func (p *PBFT) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.HandleFunc(METRICS_PATH, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		p.writeMetrics(w)
+	})
+	p.logPut(LogMetrics, slog.LevelInfo, "Serving metrics", "url", "http://"+p.metricsAddr+METRICS_PATH)
+	if err := http.ListenAndServe(p.metricsAddr, mux); err != nil {
+		p.logPut(LogMetrics, slog.LevelError, "Metrics server failed", "err", err)
+	}
+}
+
+func (p *PBFT) writeMetrics(w io.Writer) {
+	p.mu.RLock()
+	gauges := []struct {
+		name, help string
+		value      int
+	}{
+		{"pbft_view", "Current view (epoch with --leaders).", p.view},
+		{"pbft_last_executed_sequence", "Highest sequence number applied to the state machine.", p.lastExecuted},
+		{"pbft_stable_checkpoint", "Latest stable checkpoint.", p.stableCheckpoint},
+		{"pbft_request_queue_depth", "Client requests waiting to be batched.", len(p.ReqCh)},
+		{"pbft_write_batches_in_flight", "Write batches proposed and not executed yet.", p.inFlight},
+	}
+	p.mu.RUnlock()
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.value)
+	}
+
+	m := p.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP pbft_executed_batches_total Batches executed.\n# TYPE pbft_executed_batches_total counter\npbft_executed_batches_total %d\n", m.executed)
+
+	writeHistograms(w, "pbft_phase_duration_seconds", "Time a sequence number spent in each phase, from its PrePrepare.", "phase", m.phases)
+	writeHistograms(w, "pbft_batch_size_requests", "Requests per client batch.", "kind", m.batchSizes)
+
+	fmt.Fprintf(w, "# HELP pbft_wal_append_seconds Time to write a log entry.\n# TYPE pbft_wal_append_seconds histogram\n")
+	m.walAppend.write(w, "pbft_wal_append_seconds", "")
+	fmt.Fprintf(w, "# HELP pbft_wal_fsync_seconds Time to fsync the log.\n# TYPE pbft_wal_fsync_seconds histogram\n")
+	m.walFsync.write(w, "pbft_wal_fsync_seconds", "")
+
+	fmt.Fprintf(w, "# HELP pbft_rpc_failures_total Failed RPCs to each peer.\n# TYPE pbft_rpc_failures_total counter\n")
+	keys := make([]rpcFailureKey, 0, len(m.rpcFailures))
+	for k := range m.rpcFailures {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].peer != keys[j].peer {
+			return keys[i].peer < keys[j].peer
+		}
+		return keys[i].method < keys[j].method
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "pbft_rpc_failures_total{peer=\"%d\",method=\"%s\"} %d\n", k.peer, k.method, m.rpcFailures[k])
+	}
+}
+
+// writeHistograms prints one histogram family with a label per histogram.
+func writeHistograms(w io.Writer, name string, help string, label string, hs map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	values := make([]string, 0, len(hs))
+	for v := range hs {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		hs[v].write(w, name, fmt.Sprintf("%s=\"%s\"", label, v))
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramExposition(t *testing.T) {
+	h := newHistogram([]float64{1, 2, 4})
+	for _, v := range []float64{0.5, 1, 3, 10} {
+		h.observe(v)
+	}
+	var buf bytes.Buffer
+	h.write(&buf, "x", `kind="write"`)
+	want := `x_bucket{kind="write",le="1"} 2
+x_bucket{kind="write",le="2"} 2
+x_bucket{kind="write",le="4"} 3
+x_bucket{kind="write",le="+Inf"} 4
+x_sum{kind="write"} 14.5
+x_count{kind="write"} 4
+`
+	if buf.String() != want {
+		t.Fatalf("exposition:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	p := newTestReplica(t, 2, 4, CryptoEd25519)
+	p.metrics = newMetrics()
+	p.view = 3
+	p.lastExecuted = 42
+
+	state := &RequestState{}
+	p.markLocked(state, TracePrePrepared)
+	p.markLocked(state, TracePrepared)
+	p.metrics.observeBatch("write", 16)
+	p.metrics.observeWAL(time.Millisecond, 2*time.Millisecond, true)
+	p.metrics.rpcFailed(3, RPCCommit)
+	p.metrics.rpcFailed(3, RPCCommit)
+
+	var buf bytes.Buffer
+	p.writeMetrics(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		"pbft_view 3",
+		"pbft_last_executed_sequence 42",
+		`pbft_phase_duration_seconds_count{phase="prepare"} 1`,
+		`pbft_batch_size_requests_bucket{kind="write",le="16"} 1`,
+		"pbft_wal_fsync_seconds_count 1",
+		`pbft_rpc_failures_total{peer="3",method="PBFT.Commit"} 2`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("metrics are missing %q:\n%s", line, out)
+		}
+	}
+
+	// Metrics off: every recording call is a no-op
+	var off *metrics
+	off.observeBatch("write", 1)
+	off.rpcFailed(1, RPCCommit)
+}
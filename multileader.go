@@ -0,0 +1,753 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// Multi-leader ordering in the style of Mir-BFT, for --leaders N. Instead of one
+// primary, the leaders of an epoch take turns owning sequence numbers: from the
+// epoch's start on, sequence number s belongs to leaders[(s-start) % len(leaders)].
+// Each leader runs the normal PrePrepare/Prepare/Commit instances for its own
+// sequence numbers in parallel with the others, and every replica still executes
+// in sequence order, so the output is one total order.
+//
+// Client requests are split by a hash bucket of their client ID. Each bucket
+// belongs to one leader per epoch, rotating between epochs so no leader can keep
+// censoring a bucket. The clients stay on node 1, which forwards every batch to
+// the leader owning its bucket. A leader without requests would block execution
+// at its sequence numbers, so once another leader proposes past them it fills
+// them with empty batches.
+//
+// The view counts epochs. When execution stalls for EPOCH_TIMEOUT on a sequence
+// number, replicas suspect its leader and broadcast an EpochChange with their
+// prepared certificates. The next epoch drops every leader that f+1 of 2f+1
+// EpochChanges suspect. Its first leader coordinates: it re-proposes every
+// certified batch above the latest stable checkpoint and fills the rest with
+// empty batches. The sequence numbers after those are partitioned among the new
+// leaders, and node 1 resubmits any of its batches that did not survive. If the
+// coordinator does not deliver in time, replicas move on to the epoch after,
+// suspecting it as well.
+
+const (
+	RPCPropose     = "PBFT.Propose"
+	RPCEpochChange = "PBFT.EpochChange"
+	RPCNewEpoch    = "PBFT.NewEpoch"
+
+	LEADER_BUCKETS     = 16
+	EPOCH_TIMEOUT      = 2 * time.Second
+	EPOCH_FUTURE_LIMIT = 10000 // messages kept for epochs not entered yet
+)
+
+type epoch struct {
+	leaders []int
+	start   int // first sequence number partitioned among the leaders
+}
+
+type multiLeader struct {
+	epochs   map[int]*epoch // view -> epoch
+	proposed int            // last sequence number we proposed in this epoch
+	maxSeen  int            // highest sequence number with any state
+
+	// Node 1: batches by sequence number until answered, to resubmit those an
+	// epoch change drops, and requests waiting for the next epoch
+	proposals map[int][]ClientRequest
+	stalled   []ClientRequest
+
+	votes      map[int]map[int]*EpochChangeArgs // epoch -> NodeID -> vote
+	voted      int                              // highest epoch we voted for
+	votedAt    time.Time
+	suspects   []int         // the leaders we blamed in that vote
+	future     []interface{} // PrePrepares, Prepares and Commits for later epochs
+	lastSeen   int           // lastExecuted at progressAt
+	progressAt time.Time
+}
+
+func newMultiLeader(leaders int) *multiLeader {
+	e := &epoch{start: 1}
+	for id := 1; id <= leaders; id++ {
+		e.leaders = append(e.leaders, id)
+	}
+	return &multiLeader{
+		epochs:     map[int]*epoch{0: e},
+		proposals:  make(map[int][]ClientRequest),
+		votes:      make(map[int]map[int]*EpochChangeArgs),
+		progressAt: time.Now(),
+	}
+}
+
+type ProposeArgs struct {
+	Command []byte
+}
+
+type ProposeReply struct {
+	Success        bool
+	View           int
+	SequenceNumber int
+}
+
+type EpochChangeArgs struct {
+	Epoch      int   // the view to move to
+	Suspects   []int // leaders blamed for the stall
+	NodeID     int
+	Checkpoint int                    // our latest stable checkpoint
+	Prepared   []*PreparedCertificate // everything prepared above it
+	Signature  []byte
+	Auth       Authenticator
+}
+
+type EpochChangeReply struct {
+	Success bool
+}
+
+// NewEpochArgs carries the 2f+1 EpochChanges the epoch is built from and the
+// PrePrepares the new coordinator derived from them, which replicas check by
+// deriving them again.
+type NewEpochArgs struct {
+	Epoch       int
+	Proofs      []*EpochChangeArgs
+	PrePrepares []*PrePrepareArgs
+}
+
+type NewEpochReply struct {
+	Success bool
+}
+
+// noopBatch is the empty batch leaders propose to fill their sequence numbers.
+var noopBatch = encodeBatch(nil)
+
+// primaryID is the node hosting the clients: the primary, or node 1 with several
+// leaders, where the view counts epochs instead.
+func (p *PBFT) primaryID() int {
+	if p.multi != nil {
+		return 1
+	}
+	return p.memberAt(p.view)
+}
+
+// proposer returns the node whose PrePrepare for seq is valid in view.
+func (p *PBFT) proposer(view int, seq int) int {
+	if p.multi == nil {
+		return p.memberAt(view)
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.proposerLocked(view, seq)
+}
+
+func (p *PBFT) proposerLocked(view int, seq int) int {
+	if p.multi == nil {
+		return p.memberAt(view)
+	}
+	e, ok := p.multi.epochs[view]
+	if !ok {
+		return 0
+	}
+	if seq < e.start {
+		// Re-proposed by the coordinator in its NewEpoch
+		return e.leaders[0]
+	}
+	return e.leaders[(seq-e.start)%len(e.leaders)]
+}
+
+// bucketLeaderLocked returns the leader that orders a client's requests this epoch.
+func (p *PBFT) bucketLeaderLocked(clientID int) int {
+	e := p.multi.epochs[p.view]
+	bucket := clientID % LEADER_BUCKETS
+	if bucket < 0 {
+		bucket += LEADER_BUCKETS
+	}
+	return e.leaders[(bucket+p.view)%len(e.leaders)]
+}
+
+// nextSeqLocked reserves the next sequence number we own in this epoch.
+func (p *PBFT) nextSeqLocked() int {
+	if p.multi == nil {
+		p.sequenceNumber++
+		return p.sequenceNumber
+	}
+	seq := p.multi.proposed + 1
+	for p.proposerLocked(p.view, seq) != p.id {
+		seq++
+	}
+	p.multi.proposed = seq
+	return seq
+}
+
+// isLeaderLocked reports whether we own sequence numbers in this epoch.
+func (p *PBFT) isLeaderLocked() bool {
+	for _, id := range p.multi.epochs[p.view].leaders {
+		if id == p.id {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardBatch hands a batch from node 1 to the leader of its bucket.
+func (p *PBFT) forwardBatch(leader int, command []byte, reqs []ClientRequest) {
+	reply := &ProposeReply{}
+	ok := p.sendRPC(leader, RPCPropose, &ProposeArgs{Command: command}, reply) && reply.Success
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !ok {
+		p.logPutLocked(LogEpoch, slog.LevelWarn, "Leader did not take a batch, holding it for the next epoch", "leader", leader)
+		p.withdrawLocked(reqs)
+		p.multi.stalled = append(p.multi.stalled, reqs...)
+		return
+	}
+	p.trackProposalLocked(reply.View, reply.SequenceNumber, command, reqs)
+}
+
+// trackProposalLocked registers where a batch from node 1 was ordered. If an
+// epoch change happened in the meantime, it only counts if the new epoch kept it.
+func (p *PBFT) trackProposalLocked(view int, seq int, command []byte, reqs []ClientRequest) {
+	if view != p.view {
+		state, ok := p.reqState[seq]
+		if !ok || state.PrePrepareMsg == nil || state.PrePrepareMsg.Digest != hash(command) {
+			p.withdrawLocked(reqs)
+			go p.processWriteBatch(reqs)
+			return
+		}
+	}
+	chans := make([]chan Response, len(reqs))
+	for i, req := range reqs {
+		chans[i] = req.RespCh
+	}
+	p.pendingResponses[seq] = chans
+	p.multi.proposals[seq] = reqs
+
+	// Replies may have come in before we learned the sequence number
+	if state, ok := p.reqState[seq]; ok && !state.ReplySent {
+		for nodeID, value := range state.ClientReplies {
+			p.handleClientReplyLocked(seq, nodeID, value)
+		}
+	}
+}
+
+// withdrawLocked gives back the window slot of a batch that was not ordered.
+func (p *PBFT) withdrawLocked(reqs []ClientRequest) {
+	delete(p.batchStarted, reqs[0].RespCh)
+	p.batchDoneLocked(nil)
+}
+
+// Propose orders a batch node 1 forwarded to us as leader of its bucket.
+func (p *PBFT) Propose(args *ProposeArgs, reply *ProposeReply) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.multi == nil || !p.isLeaderLocked() || p.multi.voted > p.view {
+		reply.Success = false
+		return nil
+	}
+	seq := p.nextSeqLocked()
+	reply.Success = true
+	reply.View = p.view
+	reply.SequenceNumber = seq
+	go p.broadcastPrePrepare(p.view, seq, args.Command)
+	return nil
+}
+
+// fillGapLocked proposes empty batches for the sequence numbers we own below
+// one another leader just proposed, as execution would otherwise wait for them.
+// Like PBFT's high watermark, it never fills beyond two checkpoint intervals.
+func (p *PBFT) fillGapLocked(seq int) {
+	if p.multi == nil || p.multi.voted > p.view || !p.isLeaderLocked() {
+		return
+	}
+	seq = min(seq, p.stableCheckpoint+LOG_WINDOW)
+	for {
+		next := p.multi.proposed + 1
+		for p.proposerLocked(p.view, next) != p.id {
+			next++
+		}
+		if next >= seq {
+			return
+		}
+		s := p.nextSeqLocked()
+		p.logPutLocked(LogEpoch, slog.LevelWarn, "Filling a sequence number with an empty batch", "seq", s)
+		go p.broadcastPrePrepare(p.view, s, noopBatch)
+	}
+}
+
+// deferLocked keeps a message for an epoch we have not entered yet. It reports
+// whether the message belongs to a later epoch.
+func (p *PBFT) deferLocked(view int, msg interface{}) bool {
+	if p.multi == nil || view <= p.view {
+		return false
+	}
+	if len(p.multi.future) < EPOCH_FUTURE_LIMIT {
+		p.multi.future = append(p.multi.future, msg)
+	}
+	return true
+}
+
+// deferFuture is deferLocked for handlers that check signatures before locking:
+// whoever signs a message for a later epoch is only known once we enter it.
+func (p *PBFT) deferFuture(view int, msg interface{}) bool {
+	if p.multi == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.deferLocked(view, msg)
+}
+
+// replayFutureLocked hands deferred messages for the current epoch back to their handlers.
+func (p *PBFT) replayFutureLocked() {
+	var now []interface{}
+	later := p.multi.future[:0]
+	for _, msg := range p.multi.future {
+		var view int
+		switch m := msg.(type) {
+		case *PrePrepareArgs:
+			view = m.View
+		case *PrepareArgs:
+			view = m.View
+		case *CommitArgs:
+			view = m.View
+		}
+		if view == p.view {
+			now = append(now, msg)
+		} else if view > p.view {
+			later = append(later, msg)
+		}
+	}
+	p.multi.future = later
+
+	go func() {
+		for _, msg := range now {
+			switch m := msg.(type) {
+			case *PrePrepareArgs:
+				p.PrePrepare(m, &PrePrepareReply{})
+			case *PrepareArgs:
+				p.Prepare(m, &PrepareReply{})
+			case *CommitArgs:
+				p.Commit(m, &CommitReply{})
+			}
+		}
+	}()
+}
+
+// monitorEpochs suspects the leader execution is waiting on once it has not
+// moved for EPOCH_TIMEOUT, and the coordinator of an epoch change that does not
+// complete in time.
+func (p *PBFT) monitorEpochs() {
+	ticker := time.NewTicker(EPOCH_TIMEOUT / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.mu.Lock()
+		m := p.multi
+		if p.lastExecuted != m.lastSeen || m.maxSeen <= p.lastExecuted {
+			m.lastSeen = p.lastExecuted
+			m.progressAt = time.Now()
+		}
+		var vote *EpochChangeArgs
+		if m.voted > p.view {
+			if time.Since(m.votedAt) > EPOCH_TIMEOUT {
+				coordinator := p.nextLeadersLocked(m.suspects)[0]
+				if coordinator != p.id {
+					vote = p.epochChangeLocked(m.voted+1, append(m.suspects, coordinator))
+				}
+			}
+		} else if time.Since(m.progressAt) > EPOCH_TIMEOUT {
+			if suspect := p.proposerLocked(p.view, p.lastExecuted+1); suspect != p.id {
+				vote = p.epochChangeLocked(p.view+1, []int{suspect})
+			}
+		}
+		p.mu.Unlock()
+
+		if vote != nil {
+			p.broadcastEpochChange(vote)
+		}
+	}
+}
+
+// nextLeadersLocked returns the leaders of the current epoch without suspects. If
+// that leaves none, the first node after the suspects takes over.
+func (p *PBFT) nextLeadersLocked(suspects []int) []int {
+	blamed := make(map[int]bool)
+	last := 0
+	for _, id := range suspects {
+		blamed[id] = true
+		last = max(last, id)
+	}
+	var leaders []int
+	for _, id := range p.multi.epochs[p.view].leaders {
+		if !blamed[id] {
+			leaders = append(leaders, id)
+		}
+	}
+	for i := 0; len(leaders) == 0 && i < p.replicas().clusterSize; i++ {
+		if id := p.memberAt(last + i); !blamed[id] {
+			leaders = []int{id}
+		}
+	}
+	return leaders
+}
+
+// epochChangeLocked builds our vote to move to epoch, blaming suspects.
+func (p *PBFT) epochChangeLocked(epoch int, suspects []int) *EpochChangeArgs {
+	args := &EpochChangeArgs{
+		Epoch:      epoch,
+		Suspects:   suspects,
+		NodeID:     p.id,
+		Checkpoint: p.stableCheckpoint,
+	}
+	for seq := p.stableCheckpoint + 1; seq <= p.multi.maxSeen; seq++ {
+		if cert := p.preparedCertificateLocked(seq); cert != nil {
+			args.Prepared = append(args.Prepared, cert)
+		}
+	}
+	sig, auth, err := p.signMessage(digestEpochChange(args))
+	if err != nil {
+		p.logPutLocked(LogEpoch, slog.LevelError, "Error signing EpochChange", "epoch", epoch, "err", err)
+		return nil
+	}
+	args.Signature = sig
+	args.Auth = auth
+
+	p.logPutLocked(LogEpoch, slog.LevelWarn, "Execution stuck, moving to a new epoch", "seq", p.lastExecuted+1, "suspects", suspects, "epoch", epoch)
+	p.multi.voted = epoch
+	p.multi.votedAt = time.Now()
+	p.multi.suspects = suspects
+	p.addEpochVoteLocked(args)
+	return args
+}
+
+func (p *PBFT) broadcastEpochChange(args *EpochChangeArgs) {
+	for peerID := range p.replicas().peerIPPort {
+		if peerID != p.id {
+			go func(target int) {
+				reply := &EpochChangeReply{}
+				p.sendRPC(target, RPCEpochChange, args, reply)
+			}(peerID)
+		}
+	}
+	p.maybeNewEpoch(args.Epoch)
+}
+
+// verifyEpochChange checks a vote and every certificate it carries.
+func (p *PBFT) verifyEpochChange(args *EpochChangeArgs) error {
+	if err := p.verifyMessage(args.NodeID, digestEpochChange(args), args.Signature, args.Auth); err != nil {
+		return err
+	}
+	for _, cert := range args.Prepared {
+		if cert.PrePrepare == nil || cert.PrePrepare.SequenceNumber <= args.Checkpoint {
+			return fmt.Errorf("certificate below the checkpoint")
+		}
+		if err := p.verifyPreparedCertificate(cert); err != nil {
+			return fmt.Errorf("certificate for seq %d: %v", cert.PrePrepare.SequenceNumber, err)
+		}
+	}
+	return nil
+}
+
+// EpochChange collects votes to leave the current epoch.
+func (p *PBFT) EpochChange(args *EpochChangeArgs, reply *EpochChangeReply) error {
+	if p.multi == nil {
+		reply.Success = false
+		return nil
+	}
+	if err := p.verifier.Verify(func() error { return p.verifyEpochChange(args) }); err != nil {
+		p.logPut(LogEpoch, slog.LevelWarn, "Verification failed for EpochChange", "peer", args.NodeID, "err", err)
+		reply.Success = false
+		return nil
+	}
+
+	p.mu.Lock()
+	if args.Epoch <= p.view {
+		p.mu.Unlock()
+		reply.Success = false
+		return nil
+	}
+	p.addEpochVoteLocked(args)
+
+	// f+1 votes mean a correct replica is stuck too, so join them, blaming the
+	// leaders named most often
+	var vote *EpochChangeArgs
+	f := maxFaulty(p.replicas().clusterSize)
+	if votes := p.multi.votes[args.Epoch]; len(votes) > f && p.multi.voted < args.Epoch {
+		var all []*EpochChangeArgs
+		for _, v := range votes {
+			all = append(all, v)
+		}
+		vote = p.epochChangeLocked(args.Epoch, blamedBy(all, 0))
+	}
+	p.mu.Unlock()
+
+	if vote != nil {
+		p.broadcastEpochChange(vote)
+	} else {
+		p.maybeNewEpoch(args.Epoch)
+	}
+	reply.Success = true
+	return nil
+}
+
+func (p *PBFT) addEpochVoteLocked(args *EpochChangeArgs) {
+	if p.multi.votes[args.Epoch] == nil {
+		p.multi.votes[args.Epoch] = make(map[int]*EpochChangeArgs)
+	}
+	p.multi.votes[args.Epoch][args.NodeID] = args
+}
+
+// maybeNewEpoch starts the epoch if we coordinate it and have a quorum of votes.
+func (p *PBFT) maybeNewEpoch(epoch int) {
+	p.mu.Lock()
+	if epoch <= p.view || p.multi.votes[epoch] == nil {
+		p.mu.Unlock()
+		return
+	}
+	var proofs []*EpochChangeArgs
+	for _, v := range p.multi.votes[epoch] {
+		proofs = append(proofs, v)
+	}
+	sort.Slice(proofs, func(i, j int) bool { return proofs[i].NodeID < proofs[j].NodeID })
+	plan, err := p.planEpochLocked(epoch, proofs)
+	if err != nil || plan.leaders[0] != p.id {
+		p.mu.Unlock()
+		return
+	}
+
+	args := &NewEpochArgs{Epoch: epoch, Proofs: proofs}
+	for seq := plan.low + 1; seq <= plan.high; seq++ {
+		pp := &PrePrepareArgs{View: epoch, SequenceNumber: seq, Digest: plan.digests[seq], Command: plan.commands[seq]}
+		sig, auth, err := p.signMessage(digestPrePrepare(pp.View, pp.SequenceNumber, pp.Digest, pp.Command))
+		if err != nil {
+			p.logPutLocked(LogEpoch, slog.LevelError, "Error signing NewEpoch PrePrepare", "epoch", epoch, "err", err)
+			p.mu.Unlock()
+			return
+		}
+		pp.Signature = sig
+		pp.Auth = auth
+		args.PrePrepares = append(args.PrePrepares, pp)
+	}
+	p.logPutLocked(LogEpoch, slog.LevelInfo, "Starting epoch", "epoch", epoch, "leaders", plan.leaders, "reproposed_from", plan.low+1, "reproposed_to", plan.high)
+	p.installEpochLocked(epoch, plan, args.PrePrepares)
+	p.mu.Unlock()
+
+	for peerID := range p.replicas().peerIPPort {
+		if peerID != p.id {
+			go func(target int) {
+				reply := &NewEpochReply{}
+				p.sendRPC(target, RPCNewEpoch, args, reply)
+			}(peerID)
+		}
+	}
+}
+
+// NewEpoch enters the epoch a coordinator announced, after deriving the same plan.
+func (p *PBFT) NewEpoch(args *NewEpochArgs, reply *NewEpochReply) error {
+	if p.multi == nil {
+		reply.Success = false
+		return nil
+	}
+	err := p.verifier.Verify(func() error {
+		senders := make(map[int]bool)
+		for _, proof := range args.Proofs {
+			if proof.Epoch != args.Epoch || senders[proof.NodeID] {
+				return fmt.Errorf("proof from %d is for another epoch or repeated", proof.NodeID)
+			}
+			senders[proof.NodeID] = true
+			if err := p.verifyEpochChange(proof); err != nil {
+				return fmt.Errorf("proof from %d: %v", proof.NodeID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		p.logPut(LogEpoch, slog.LevelWarn, "Verification failed for NewEpoch", "epoch", args.Epoch, "err", err)
+		reply.Success = false
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if args.Epoch <= p.view {
+		reply.Success = false
+		return nil
+	}
+	plan, err := p.planEpochLocked(args.Epoch, args.Proofs)
+	if err == nil {
+		err = plan.check(p, args.PrePrepares)
+	}
+	if err != nil {
+		p.logPutLocked(LogEpoch, slog.LevelWarn, "Rejecting NewEpoch", "epoch", args.Epoch, "err", err)
+		reply.Success = false
+		return nil
+	}
+	p.logPutLocked(LogEpoch, slog.LevelInfo, "Entering epoch", "epoch", args.Epoch, "leaders", plan.leaders)
+	p.installEpochLocked(args.Epoch, plan, args.PrePrepares)
+	reply.Success = true
+	return nil
+}
+
+// epochPlan is what 2f+1 EpochChanges determine about the next epoch.
+type epochPlan struct {
+	leaders  []int
+	low      int            // latest stable checkpoint among the votes
+	high     int            // highest sequence number any vote has prepared
+	digests  map[int]string // low < seq <= high -> batch to re-propose
+	commands map[int][]byte
+}
+
+func (p *PBFT) planEpochLocked(epoch int, proofs []*EpochChangeArgs) (*epochPlan, error) {
+	if len(proofs) < p.quorumSize() {
+		return nil, fmt.Errorf("only %d votes, need %d", len(proofs), p.quorumSize())
+	}
+	// Only leaders f+1 votes agree on: at least one correct replica blames them
+	suspects := blamedBy(proofs, maxFaulty(p.replicas().clusterSize)+1)
+	if len(suspects) == 0 {
+		return nil, fmt.Errorf("no leader is suspected by f+1 votes")
+	}
+
+	plan := &epochPlan{
+		leaders:  p.nextLeadersLocked(suspects),
+		digests:  make(map[int]string),
+		commands: make(map[int][]byte),
+	}
+	for _, proof := range proofs {
+		plan.low = max(plan.low, proof.Checkpoint)
+	}
+	certView := make(map[int]int)
+	for _, proof := range proofs {
+		for _, cert := range proof.Prepared {
+			pp := cert.PrePrepare
+			if pp.SequenceNumber <= plan.low {
+				continue
+			}
+			plan.high = max(plan.high, pp.SequenceNumber)
+			// The certificate from the latest view wins, as in a PBFT view change
+			if v, ok := certView[pp.SequenceNumber]; !ok || pp.View > v {
+				certView[pp.SequenceNumber] = pp.View
+				plan.digests[pp.SequenceNumber] = pp.Digest
+				plan.commands[pp.SequenceNumber] = pp.Command
+			}
+		}
+	}
+	plan.high = max(plan.high, plan.low)
+	for seq := plan.low + 1; seq <= plan.high; seq++ {
+		if _, ok := plan.digests[seq]; !ok {
+			plan.digests[seq] = hash(noopBatch)
+			plan.commands[seq] = noopBatch
+		}
+	}
+	return plan, nil
+}
+
+// check verifies that the coordinator re-proposed exactly the planned batches.
+func (plan *epochPlan) check(p *PBFT, pps []*PrePrepareArgs) error {
+	if len(pps) != plan.high-plan.low {
+		return fmt.Errorf("%d PrePrepares for %d sequence numbers", len(pps), plan.high-plan.low)
+	}
+	for i, pp := range pps {
+		seq := plan.low + 1 + i
+		if pp.SequenceNumber != seq || pp.Digest != plan.digests[seq] {
+			return fmt.Errorf("PrePrepare for seq %d does not match the votes", seq)
+		}
+		if err := p.verifyMessage(plan.leaders[0], digestPrePrepare(pp.View, pp.SequenceNumber, pp.Digest, pp.Command), pp.Signature, pp.Auth); err != nil {
+			return fmt.Errorf("PrePrepare for seq %d: %v", seq, err)
+		}
+		if err := p.checkPayload(pp); err != nil {
+			return fmt.Errorf("PrePrepare for seq %d: %v", seq, err)
+		}
+	}
+	return nil
+}
+
+// installEpochLocked moves to a new epoch: instances above the checkpoint start
+// over with the re-proposed batches, and the rest of the sequence space is
+// partitioned among the new leaders.
+func (p *PBFT) installEpochLocked(view int, plan *epochPlan, pps []*PrePrepareArgs) {
+	m := p.multi
+	p.view = view
+	m.epochs[view] = &epoch{leaders: plan.leaders, start: plan.high + 1}
+	m.proposed = plan.high
+	m.progressAt = time.Now()
+
+	for seq := plan.low + 1; seq <= m.maxSeen; seq++ {
+		if state, ok := p.reqState[seq]; ok {
+			// Replies to the client stay: only executed batches have them, and
+			// those are among the re-proposed ones
+			state.PrePrepared = false
+			state.Prepared = false
+			state.Committed = false
+			state.PrePrepareMsg = nil
+			state.PrepareMsgs = make(map[int]string)
+			state.PrepareProofs = make(map[int]*PrepareArgs)
+			state.CommitMsgs = make(map[int]string)
+		}
+	}
+
+	coordinator := plan.leaders[0] == p.id
+	for _, pp := range pps {
+		if coordinator {
+			state := p.getRequestState(pp.SequenceNumber)
+			state.PrePrepared = true
+			state.PrePrepareMsg = pp
+			p.orderBatchLocked(pp)
+			continue
+		}
+		p.acceptPrePrepareLocked(pp)
+	}
+
+	// Node 1 resubmits every batch the new epoch does not order
+	if p.isPrimary() {
+		var resubmit [][]ClientRequest
+		for seq, reqs := range m.proposals {
+			if seq <= plan.high && plan.digests[seq] == hash(encodeRequests(reqs)) {
+				continue
+			}
+			delete(m.proposals, seq)
+			delete(p.pendingResponses, seq)
+			p.withdrawLocked(reqs)
+			resubmit = append(resubmit, reqs)
+		}
+		if len(m.stalled) > 0 {
+			resubmit = append(resubmit, m.stalled)
+			m.stalled = nil
+		}
+		for _, reqs := range resubmit {
+			go p.processWriteBatch(reqs)
+		}
+	}
+
+	p.replayFutureLocked()
+	p.executeCommittedLocked()
+}
+
+// blamedBy returns, in ID order, the leaders at least min votes suspect, or with
+// min 0 those suspected by the most votes.
+func blamedBy(votes []*EpochChangeArgs, min int) []int {
+	counts := make(map[int]int)
+	most := 0
+	for _, v := range votes {
+		for _, id := range v.Suspects {
+			counts[id]++
+			most = max(most, counts[id])
+		}
+	}
+	if min == 0 {
+		min = most
+	}
+	var ids []int
+	for id, c := range counts {
+		if c >= min {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// encodeRequests packs requests into a batch the way the batcher does.
+func encodeRequests(reqs []ClientRequest) []byte {
+	cmds := make([][]byte, len(reqs))
+	for i, req := range reqs {
+		cmds[i] = req.Command
+	}
+	return encodeBatch(cmds)
+}
@@ -1,16 +1,28 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"fmt"
+	"log/slog"
 	"net/rpc"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ClientRequest struct {
-	Command []byte
-	RespCh  chan Response
+	ClientID int
+	Command  []byte
+	RespCh   chan Response
+	Queued   time.Time // when it was handed to the batcher (see trace.go)
+	Ordered  bool      // a GET that fell back to consensus (see read.go)
 }
 
+const (
+	ProtocolPBFT     = "pbft"
+	ProtocolHotStuff = "hotstuff"
+)
+
 type LogEntry struct {
 	View    int
 	Command []byte
@@ -22,12 +34,30 @@ type RequestState struct {
 	Committed   bool
 
 	PrePrepareMsg *PrePrepareArgs
-	PrepareMsgs   map[int]string // NodeID -> Digest
-	CommitMsgs    map[int]string // NodeID -> Digest
+	PrepareMsgs   map[int]string       // NodeID -> Digest
+	PrepareProofs map[int]*PrepareArgs // NodeID -> signed Prepare, for prepared certificates
+	CommitMsgs    map[int]string       // NodeID -> Digest
+	CommitProofs  map[int]*CommitArgs  // NodeID -> signed Commit, kept with --audit
+
+	// --crypto multisig: shares collected by the primary, and the certificates
+	PrepareShares map[int][]byte
+	CommitShares  map[int][]byte
+	PrepareQC     *QuorumCert
+	CommitQC      *QuorumCert
 
 	// Track replies for client verification
 	ClientReplies map[int]string // NodeID -> Value
 	ReplySent     bool           // True if we already sent response to client
+
+	// --speculative: replies carrying history hashes, and the commit-certificate fallback
+	SpecReplies    map[int]*SpecReplyArgs
+	SpecTimerArmed bool
+	SpecValue      string       // result the commit certificate vouches for
+	LocalCommits   map[int]bool // NodeID -> acknowledged the commit certificate
+
+	Trace [TRACE_POINTS]time.Time // when each phase was reached (see trace.go)
+
+	Audited bool // appended to the audit trail (see audit.go)
 }
 
 type PBFT struct {
@@ -36,25 +66,42 @@ type PBFT struct {
 	writeBatchSize int
 	readBatchSize  int
 	workers        int
-	debug          bool
+	logging        *logging // see logger.go
 	workload       int
 	asyncLog       bool
 
 	// Network and Cluster
-	peerIPPort  map[int]string
-	clusterSize int
-	rpcConns    map[int]*rpc.Client
+	replicaSet atomic.Pointer[replicaSet] // see reconfig.go
+	learners   map[int]string             // learner ID -> address (see learner.go)
+	learner    bool                       // this node is a learner
+	conns      *ConnManager
+	faults     *FaultInjector // nil unless started with --faults
+	tls        *tlsSetup      // nil when cluster.conf has no certificates
+
+	replicaServer *rpc.Server
+	clientServer  *rpc.Server
 
 	// Crypto
-	cryptoType CryptoType
-	privKey    interface{}         // ed25519.PrivateKey or nil for MAC
-	pubKeys    map[int]interface{} // ed25519.PublicKey for ed25519, []byte for MAC (shared key with peer)
-	macKeys    map[int][]byte      // MAC: shared keys with each peer
+	cryptoType  CryptoType
+	privKey     interface{}               // ed25519.PrivateKey or nil for MAC
+	macKeys     atomic.Pointer[macKeySet] // MAC: shared keys with each peer (see recovery.go)
+	learnerKeys map[int]interface{}       // the same for learners, which never vote
+	idKey       ed25519.PrivateKey        // long-term signing key, also kept with MAC
+	idKeys      map[int]ed25519.PublicKey
+
+	verifier      *Verifier // signature checks for incoming messages, outside p.mu
+	verifyWorkers int       // size of the verifier pool (0: one per CPU)
 
 	// Consensus State
 	view           int
 	sequenceNumber int
 	reqState       map[int]*RequestState // SequenceNumber -> State
+	lastExecuted   int                   // highest sequence number applied to StateMachine
+
+	// Checkpoints (see checkpoint.go)
+	lastCheckpoint   int                    // our own latest checkpoint
+	stableCheckpoint int                    // latest checkpoint with 2f+1 matching digests
+	checkpointVotes  map[int]map[int]string // SequenceNumber -> NodeID -> state digest
 
 	// Storage & State Machine
 	storage      *Storage
@@ -66,44 +113,129 @@ type PBFT struct {
 
 	pendingResponses map[int][]chan Response // SequenceNumber -> Response Channels
 
+	// Flow control: at most windowSize write batches in flight (0: unlimited)
+	windowSize int
+	inFlight   int
+	windowFree chan struct{} // signalled when an in-flight batch completes
+
+	batching     string
+	batcher      *batcher
+	batchStarted map[chan Response]time.Time // keyed by the first request of a write batch
+	nextReadID   int                         // last ReadID used for a read-only batch
+	readMode     Guarantee                   // how GETs are served (see read.go)
+	readMaxLag   int                         // --read-mode stale(maxLag)
+
+	// Consensus engine: "pbft", or "hotstuff" to run the HotStuff engine instead
+	protocol string
+	hotstuff *HotStuff
+
+	// Zyzzyva-style speculative execution instead of Prepare/Commit (see speculative.go)
+	speculative bool
+	spec        *speculation
+
+	// Several leaders ordering in parallel (see multileader.go)
+	leaders int
+	multi   *multiLeader
+
+	// Batch dissemination with digest-only PrePrepares (see disseminate.go)
+	disseminate bool
+	batches     map[string]*dissemBatch // digest -> batch and how long to keep it
+	fetching    map[string]bool         // digests being fetched from peers
+
+	// Membership changes (see reconfig.go)
+	testKeys      bool
+	reconfigMu    sync.Mutex // one reconfiguration at a time on the primary
+	reconfiguring bool       // the primary drains its pipeline for a reconfiguration
+	reconfigAt    int        // accepted reconfiguration that has not executed yet
+	held          []interface{}
+	welcome       []int // members added by the batch being executed
+	joining       bool  // --join: waiting for the state from the replica set
+	joins         map[int]*JoinArgs
+
+	learn *learning // nil unless this node is a learner
+
+	// Proactive recovery (see recovery.go)
+	recoveryInterval time.Duration
+	recovery         *recovery // nil unless started with --recovery
+
+	// Prometheus metrics (see metrics.go)
+	metricsAddr string
+	metrics     *metrics // nil unless started with --metrics-addr
+
+	// Per-sequence phase traces (see trace.go)
+	tracer *tracer // nil unless started with --trace
+
+	// Audit trail of commit certificates (see audit.go)
+	audit *auditor // nil unless started with --audit
+
+	// Client history recording for linearizability checks (nil when disabled)
+	history     *History
+	historyPath string
+
 	// Client Handling
 	mu sync.RWMutex
 }
 
-func NewPBFT(id int, confPath string, writeBatchSize int, readBatchSize int, workers int, debug bool, workload int, asyncLog bool, inMemory bool, cryptoType CryptoType) *PBFT {
-	peerIPPort := parseConfig(confPath)
+func NewPBFT(id int, confPath string, writeBatchSize int, readBatchSize int, workers int, logging *logging, workload int, asyncLog bool, inMemory bool, cryptoType CryptoType, testKeys bool) *PBFT {
+	nodes := parseClusterConfig(confPath)
+	tlsSetup, err := loadTLS(confPath, id, nodes)
+	if err != nil {
+		panic(err)
+	}
+	peerIPPort := make(map[int]string)
+	learners := make(map[int]string)
+	var members []Member
+	learner := false
+	for _, node := range nodes {
+		addr := fmt.Sprintf("%s:%d", node.IP, node.Port)
+		switch node.Role {
+		case "", RoleReplica:
+			peerIPPort[node.ID] = addr
+			members = append(members, Member{ID: node.ID})
+		case RoleLearner:
+			learners[node.ID] = addr
+			learner = learner || node.ID == id
+		default:
+			panic(fmt.Sprintf("node %d has unknown role %q (replica, learner)", node.ID, node.Role))
+		}
+	}
 
 	storage, err := NewStorage(id, asyncLog, inMemory)
 	if err != nil {
 		panic(err)
 	}
 
-	// Generate Keys based on crypto type
+	keys, err := loadKeys(confPath, id, nodes, testKeys)
+	if err != nil {
+		panic(err)
+	}
+
 	var privKey interface{}
 	pubKeys := make(map[int]interface{})
 	macKeys := make(map[int][]byte)
+	learnerKeys := make(map[int]interface{})
 
 	switch cryptoType {
-	case CryptoEd25519:
-		pk, err := generateEd25519Key(id)
-		if err != nil {
-			panic(err)
-		}
-		privKey = pk
+	case CryptoEd25519, CryptoMultiSig:
+		privKey = keys.priv
 		for peerID := range peerIPPort {
-			key, err := generateEd25519Key(peerID)
-			if err != nil {
-				panic(err)
-			}
-			pubKeys[peerID] = key.Public()
+			pubKeys[peerID] = keys.pubKeys[peerID]
+		}
+		for learnerID := range learners {
+			learnerKeys[learnerID] = keys.pubKeys[learnerID]
 		}
 	case CryptoMAC:
 		privKey = nil
 		for peerID := range peerIPPort {
-			sharedKey := generateMACKey(id, peerID)
+			sharedKey := keys.macKeys[peerID]
 			macKeys[peerID] = sharedKey
 			pubKeys[peerID] = sharedKey // For verification in RPC handlers
 		}
+		for learnerID := range learners {
+			if learnerID != id {
+				learnerKeys[learnerID] = keys.macKeys[learnerID]
+			}
+		}
 	default:
 		panic(fmt.Sprintf("unknown crypto type: %s", cryptoType))
 	}
@@ -114,36 +246,91 @@ func NewPBFT(id int, confPath string, writeBatchSize int, readBatchSize int, wor
 		writeBatchSize:   writeBatchSize,
 		readBatchSize:    readBatchSize,
 		workers:          workers,
-		debug:            debug,
+		logging:          logging,
 		workload:         workload,
 		asyncLog:         asyncLog,
-		peerIPPort:       peerIPPort,
-		clusterSize:      len(peerIPPort),
-		rpcConns:         make(map[int]*rpc.Client),
+		learners:         learners,
+		learner:          learner,
 		cryptoType:       cryptoType,
 		privKey:          privKey,
-		pubKeys:          pubKeys,
-		macKeys:          macKeys,
+		learnerKeys:      learnerKeys,
+		idKey:            keys.priv,
+		idKeys:           keys.pubKeys,
+		testKeys:         testKeys,
+		joins:            make(map[int]*JoinArgs),
+		tls:              tlsSetup,
 		view:             0,
 		sequenceNumber:   0,
 		reqState:         make(map[int]*RequestState),
+		checkpointVotes:  make(map[int]map[int]string),
+		batches:          make(map[string]*dissemBatch),
+		fetching:         make(map[string]bool),
+		protocol:         ProtocolPBFT,
+		readMode:         GuaranteeQuorum,
 		storage:          storage,
 		StateMachine:     make(map[string]string),
 		ReqCh:            make(chan ClientRequest, 5000),
 		ReadCh:           make(chan []ClientRequest, 500),
 		pendingResponses: make(map[int][]chan Response),
+		windowFree:       make(chan struct{}, 1),
+		batching:         BatchingStatic,
+		batchStarted:     make(map[chan Response]time.Time),
 		mu:               sync.RWMutex{},
 	}
-	fmt.Println(p)
+	p.replicaSet.Store(&replicaSet{
+		members:     memberIDs(members),
+		peerIPPort:  peerIPPort,
+		pubKeys:     pubKeys,
+		clusterSize: len(peerIPPort),
+	})
+	p.macKeys.Store(&macKeySet{current: macKeys})
+	if learner {
+		p.learn = newLearning()
+	}
+	p.conns = NewConnManager(p)
 
 	return p
 }
 
 func (p *PBFT) Run() {
-	fmt.Printf("PBFT node %d starting... (Cluster Size: %d)\n", p.id, p.clusterSize)
+	p.logPut(LogMain, slog.LevelInfo, "PBFT node starting", "cluster_size", p.replicas().clusterSize, "protocol", p.protocol, "learner", p.learner)
+
+	p.verifier = NewVerifier(p.verifyWorkers)
+	if p.metricsAddr != "" {
+		p.metrics = newMetrics()
+		p.storage.metrics = p.metrics
+		go p.serveMetrics()
+	}
+	if p.learner {
+		// Learners only take reports of executed batches (see learner.go)
+		p.listenRPC()
+		return
+	}
+	p.batcher = newBatcher(p.writeBatchSize, p.batching == BatchingAdaptive)
+	if p.protocol == ProtocolHotStuff {
+		p.hotstuff = NewHotStuff(p)
+	}
+	if p.speculative {
+		p.spec = newSpeculation()
+	}
+	if p.leaders > 1 {
+		p.multi = newMultiLeader(p.leaders)
+	}
+	if p.recoveryInterval > 0 {
+		p.recovery = newRecovery()
+	}
 
 	go p.listenRPC()
 	p.dialRPCToAllPeers()
+	if p.hotstuff != nil {
+		go p.hotstuff.run()
+	}
+	if p.multi != nil {
+		go p.monitorEpochs()
+	}
+	if p.recovery != nil {
+		go p.watchdog()
+	}
 
 	go p.concClient()
 	go p.handleClientRequest()
@@ -155,5 +342,5 @@ func (p *PBFT) isPrimary() bool {
 	// Primary is usually view % N
 	// IDs are 1-based in config (1, 2, 3, 4)
 	// (view % N) + 1 == id
-	return (p.view%p.clusterSize)+1 == p.id
+	return p.primaryID() == p.id
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"log/slog"
+	"sort"
+)
+
+// Linear-communication commit path for --crypto multisig, in the style of SBFT
+// and HotStuff. Instead of broadcasting Prepare and Commit, each replica sends a
+// signature share to the primary, which combines 2f+1 matching shares into a
+// quorum certificate and broadcasts that. Each phase therefore costs O(N)
+// messages instead of O(N²).
+//
+// The standard library has no pairing-based signatures, so a certificate is a
+// multi-signature in the plain sense: a signer list plus one ed25519 signature
+// per signer over the same bytes. It is O(N) in size and costs 2f+1 verifications
+// to check, but the message count is what limits large clusters.
+
+const (
+	RPCVote       = "PBFT.Vote"
+	RPCQuorumCert = "PBFT.QuorumCert"
+	PhasePrepare  = VotePhase("prepare")
+	PhaseCommit   = VotePhase("commit")
+	PhaseHotStuff = VotePhase("hotstuff") // one vote per block, see hotstuff.go
+)
+
+type VotePhase string
+
+type VoteArgs struct {
+	Phase          VotePhase
+	View           int
+	SequenceNumber int
+	Digest         string
+	NodeID         int
+	Share          []byte // signature over digestVote
+}
+
+type VoteReply struct {
+	Success bool
+}
+
+// QuorumCert proves that 2f+1 replicas voted for Digest at (View, SequenceNumber)
+// in Phase.
+type QuorumCert struct {
+	Phase          VotePhase
+	View           int
+	SequenceNumber int
+	Digest         string
+	Signers        []int
+	Shares         [][]byte // Shares[i] is from Signers[i]
+}
+
+type QuorumCertReply struct {
+	Success bool
+}
+
+func (p *PBFT) linearVotes() bool {
+	return p.cryptoType == CryptoMultiSig
+}
+
+// maxFaulty is f, the number of Byzantine replicas that n replicas tolerate.
+func maxFaulty(n int) int {
+	return (n - 1) / 3
+}
+
+// quorumOf is the quorum size among n replicas, ⌈(n+f+1)/2⌉: two quorums share
+// at least f+1 replicas, one of them correct, and since a quorum is at most n-f
+// the faulty replicas cannot block one by staying silent. For n = 3f+1 this is
+// 2f+1, but membership changes leave n arbitrary (4 -> 5 needs 4, not 3).
+func quorumOf(n int) int {
+	return (n + maxFaulty(n) + 2) / 2
+}
+
+func (p *PBFT) quorumSize() int {
+	return quorumOf(p.replicas().clusterSize)
+}
+
+// newQuorumCert combines shares (already verified) into a certificate.
+func newQuorumCert(phase VotePhase, view int, seq int, digest string, shares map[int][]byte) *QuorumCert {
+	qc := &QuorumCert{Phase: phase, View: view, SequenceNumber: seq, Digest: digest}
+	for id := range shares {
+		qc.Signers = append(qc.Signers, id)
+	}
+	sort.Ints(qc.Signers)
+	for _, id := range qc.Signers {
+		qc.Shares = append(qc.Shares, shares[id])
+	}
+	return qc
+}
+
+// verifyQuorumCert checks that qc carries valid shares from a quorum of distinct
+// replicas.
+func (p *PBFT) verifyQuorumCert(qc *QuorumCert) error {
+	if qc.Phase != PhasePrepare && qc.Phase != PhaseCommit && qc.Phase != PhaseHotStuff {
+		return fmt.Errorf("unknown phase %q", qc.Phase)
+	}
+	if len(qc.Signers) != len(qc.Shares) {
+		return fmt.Errorf("%d signers but %d shares", len(qc.Signers), len(qc.Shares))
+	}
+	data := digestVote(qc.Phase, qc.View, qc.SequenceNumber, qc.Digest)
+	seen := make(map[int]bool)
+	for i, id := range qc.Signers {
+		if seen[id] {
+			return fmt.Errorf("node %d signed twice", id)
+		}
+		key, ok := p.replicas().pubKeys[id].(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("no public key for node %d", id)
+		}
+		if err := verify(key, data, qc.Shares[i]); err != nil {
+			return fmt.Errorf("share from %d: %v", id, err)
+		}
+		seen[id] = true
+	}
+	if len(seen) < p.quorumSize() {
+		return fmt.Errorf("only %d signers, need %d", len(seen), p.quorumSize())
+	}
+	return nil
+}
+
+// sendVote signs a share for (view, seq, digest) and hands it to the primary.
+func (p *PBFT) sendVote(phase VotePhase, view int, seq int, digest string) {
+	share, err := sign(p.privKey, digestVote(phase, view, seq, digest))
+	if err != nil {
+		p.logPut(LogConsensus, slog.LevelError, "Error signing vote", "phase", phase, "seq", seq, "err", err)
+		return
+	}
+	args := &VoteArgs{
+		Phase:          phase,
+		View:           view,
+		SequenceNumber: seq,
+		Digest:         digest,
+		NodeID:         p.id,
+		Share:          share,
+	}
+
+	primaryID := p.memberAt(view)
+	if primaryID == p.id {
+		p.mu.Lock()
+		p.addVoteLocked(args)
+		p.mu.Unlock()
+		return
+	}
+	reply := &VoteReply{}
+	p.sendRPC(primaryID, RPCVote, args, reply)
+}
+
+// Vote collects signature shares at the primary.
+func (p *PBFT) Vote(args *VoteArgs, reply *VoteReply) error {
+	err := p.verifier.Verify(func() error {
+		key, ok := p.replicas().pubKeys[args.NodeID].(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("no public key for node %d", args.NodeID)
+		}
+		return verify(key, digestVote(args.Phase, args.View, args.SequenceNumber, args.Digest), args.Share)
+	})
+	if err != nil {
+		p.logPut(LogConsensus, slog.LevelWarn, "Signature verification failed for vote", "phase", args.Phase, "peer", args.NodeID, "seq", args.SequenceNumber, "err", err)
+		reply.Success = false
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if args.View != p.view || !p.isPrimary() {
+		reply.Success = false
+		return nil
+	}
+	p.addVoteLocked(args)
+	reply.Success = true
+	return nil
+}
+
+func (p *PBFT) addVoteLocked(args *VoteArgs) {
+	state := p.getRequestState(args.SequenceNumber)
+	if state.PrePrepareMsg == nil || state.PrePrepareMsg.Digest != args.Digest {
+		return
+	}
+
+	shares, done := state.PrepareShares, state.PrepareQC != nil
+	if args.Phase == PhaseCommit {
+		shares, done = state.CommitShares, state.CommitQC != nil
+	}
+	if done {
+		return
+	}
+	shares[args.NodeID] = args.Share
+
+	p.logPutLocked(LogConsensus, slog.LevelDebug, "Received vote", "phase", args.Phase, "peer", args.NodeID, "seq", args.SequenceNumber, "count", len(shares))
+
+	if len(shares) < p.quorumSize() {
+		return
+	}
+	qc := newQuorumCert(args.Phase, args.View, args.SequenceNumber, args.Digest, shares)
+	p.logPutLocked(LogConsensus, slog.LevelDebug, "Quorum certificate formed, broadcasting", "phase", args.Phase, "seq", args.SequenceNumber)
+
+	for peerID := range p.replicas().peerIPPort {
+		if peerID != p.id {
+			go func(target int) {
+				reply := &QuorumCertReply{}
+				p.sendRPC(target, RPCQuorumCert, qc, reply)
+			}(peerID)
+		}
+	}
+	p.addQuorumCertLocked(state, qc)
+}
+
+// QuorumCert accepts a certificate broadcast by the primary.
+func (p *PBFT) QuorumCert(args *QuorumCert, reply *QuorumCertReply) error {
+	if err := p.verifier.Verify(func() error { return p.verifyQuorumCert(args) }); err != nil {
+		p.logPut(LogConsensus, slog.LevelWarn, "Invalid quorum certificate", "phase", args.Phase, "seq", args.SequenceNumber, "err", err)
+		reply.Success = false
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if args.View != p.view {
+		reply.Success = false
+		return nil
+	}
+	p.addQuorumCertLocked(p.getRequestState(args.SequenceNumber), args)
+	reply.Success = true
+	return nil
+}
+
+func (p *PBFT) addQuorumCertLocked(state *RequestState, qc *QuorumCert) {
+	if qc.Phase == PhasePrepare {
+		if state.PrepareQC == nil {
+			state.PrepareQC = qc
+		}
+	} else if state.CommitQC == nil {
+		state.CommitQC = qc
+	}
+	p.advanceLinearLocked(state, qc.SequenceNumber)
+}
+
+// advanceLinearLocked moves seq through prepared and committed as far as the
+// certificates received so far allow. A certificate can arrive before the
+// PrePrepare it refers to, so this also runs when the PrePrepare comes in.
+func (p *PBFT) advanceLinearLocked(state *RequestState, seq int) {
+	pp := state.PrePrepareMsg
+	if !state.PrePrepared || pp == nil {
+		return
+	}
+
+	if !state.Prepared && state.PrepareQC != nil && state.PrepareQC.Digest == pp.Digest {
+		state.Prepared = true
+		p.markLocked(state, TracePrepared)
+		p.logPutLocked(LogConsensus, slog.LevelDebug, "Prepared (certificate), voting to commit", "seq", seq)
+		go p.sendVote(PhaseCommit, pp.View, seq, pp.Digest)
+	}
+
+	// A commit certificate implies a quorum prepared, so it is enough on its own
+	if !state.Committed && state.CommitQC != nil && state.CommitQC.Digest == pp.Digest {
+		state.Prepared = true
+		state.Committed = true
+		p.markLocked(state, TraceCommitted)
+		p.logPutLocked(LogConsensus, slog.LevelDebug, "Committed (certificate), executing", "seq", seq)
+		p.executeCommittedLocked()
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Read-only optimization from the PBFT paper. The client sends a batch of GETs
+// straight to every replica, each replica answers from the state it has executed,
+// and a GET completes once 2f+1 replicas return the same value for it. A write
+// only completes after f+1 replicas executed it, so 2f+1 matching answers cannot
+// all predate a completed write. GETs without a quorum (concurrent writes, lagging
+// replicas) are retried through consensus.
+//
+// --read-mode picks how GETs are served, and every answer reports which of these
+// guarantees it carries:
+//   - linearizable: ordered through consensus like writes
+//   - quorum: 2f+1 matching replies as above (also linearizable)
+//   - stale(maxLag): a single replica answers, provided the last sequence number it
+//     executed is at most maxLag behind the latest stable checkpoint it knows of
+
+const (
+	RPCRead      = "PBFT.Read"
+	READ_TIMEOUT = 200 * time.Millisecond
+
+	GuaranteeLinearizable = Guarantee("linearizable")
+	GuaranteeQuorum       = Guarantee("quorum")
+	GuaranteeStale        = Guarantee("stale")
+)
+
+// Guarantee is a --read-mode, and the consistency an answer was served with.
+type Guarantee string
+
+// parseReadMode parses a --read-mode value; maxLag only applies to stale.
+func parseReadMode(s string) (Guarantee, int, error) {
+	switch s {
+	case string(GuaranteeLinearizable), string(GuaranteeQuorum):
+		return Guarantee(s), 0, nil
+	}
+	if strings.HasPrefix(s, "stale(") && strings.HasSuffix(s, ")") {
+		maxLag, err := strconv.Atoi(s[len("stale(") : len(s)-1])
+		if err != nil || maxLag < 0 {
+			return "", 0, fmt.Errorf("invalid lag bound in read mode %q", s)
+		}
+		return GuaranteeStale, maxLag, nil
+	}
+	return "", 0, fmt.Errorf("unknown read mode %q (linearizable, quorum, stale(maxLag))", s)
+}
+
+type ReadArgs struct {
+	ReadID  int    // fresh per batch, so old replies cannot be replayed
+	Command []byte // batch of GETs
+	Stale   bool   // answer alone, if within MaxLag of the stable checkpoint
+	MaxLag  int
+}
+
+type ReadReply struct {
+	Success   bool
+	NodeID    int
+	Value     string // encoded batch results
+	Signature []byte
+	Auth      Authenticator
+}
+
+// Read executes a batch of read-only commands against the current state.
+func (p *PBFT) Read(args *ReadArgs, reply *ReadReply) error {
+	cmds, err := decodeBatch(args.Command)
+	if err != nil {
+		reply.Success = false
+		return nil
+	}
+	for _, cmd := range cmds {
+		if !isReadOnly(cmd) {
+			p.logPut(LogRead, slog.LevelWarn, "Rejecting read: command is not read-only", "read", args.ReadID, "command", string(cmd))
+			reply.Success = false
+			return nil
+		}
+	}
+
+	results := make([]string, len(cmds))
+	p.mu.RLock()
+	if args.Stale && p.lastExecuted < p.stableCheckpoint-args.MaxLag {
+		p.logPutLocked(LogRead, slog.LevelWarn, "Refusing stale read", "read", args.ReadID, "executed", p.lastExecuted, "stable", p.stableCheckpoint)
+		p.mu.RUnlock()
+		reply.Success = false
+		return nil
+	}
+	for i, cmd := range cmds {
+		results[i] = p.applyCommandLocked(cmd)
+	}
+	p.mu.RUnlock()
+
+	value := encodeBatchResults(results)
+	sig, auth, err := p.signMessage(digestReadReply(args.ReadID, hash(args.Command), p.id, value))
+	if err != nil {
+		p.logPut(LogRead, slog.LevelError, "Error signing ReadReply", "read", args.ReadID, "err", err)
+		reply.Success = false
+		return nil
+	}
+	reply.Success = true
+	reply.NodeID = p.id
+	reply.Value = value
+	reply.Signature = sig
+	reply.Auth = auth
+	return nil
+}
+
+// readQuorum multicasts a read batch and answers each request from 2f+1 matching
+// replies, sending the rest through consensus.
+func (p *PBFT) readQuorum(args *ReadArgs, reqs []ClientRequest) {
+	digest := hash(args.Command)
+	peers := p.replicas().peerIPPort
+	replies := make(chan *ReadReply, len(peers))
+	for peerID := range peers {
+		go func(target int) {
+			reply := &ReadReply{}
+			if target == p.id {
+				p.Read(args, reply)
+			} else if !p.sendRPC(target, RPCRead, args, reply) {
+				replies <- nil
+				return
+			}
+			if !reply.Success {
+				replies <- nil
+				return
+			}
+			data := digestReadReply(args.ReadID, digest, target, reply.Value)
+			if err := p.verifyMessage(target, data, reply.Signature, reply.Auth); err != nil {
+				p.logPut(LogRead, slog.LevelWarn, "Signature verification failed for ReadReply", "peer", target, "read", args.ReadID, "err", err)
+				replies <- nil
+				return
+			}
+			replies <- reply
+		}(peerID)
+	}
+
+	votes := make([]map[string]int, len(reqs))
+	for i := range votes {
+		votes[i] = make(map[string]int)
+	}
+	done := make([]bool, len(reqs))
+	remaining := len(reqs)
+
+	timeout := time.NewTimer(READ_TIMEOUT)
+	defer timeout.Stop()
+
+collect:
+	for received := 0; received < len(peers) && remaining > 0; received++ {
+		var reply *ReadReply
+		select {
+		case reply = <-replies:
+		case <-timeout.C:
+			break collect
+		}
+		if reply == nil {
+			continue
+		}
+		results, err := decodeBatchResults(reply.Value)
+		if err != nil || len(results) != len(reqs) {
+			continue
+		}
+		for i, value := range results {
+			if done[i] {
+				continue
+			}
+			votes[i][value]++
+			if votes[i][value] >= p.quorumSize() {
+				done[i] = true
+				remaining--
+				select {
+				case reqs[i].RespCh <- Response{success: true, value: value, guarantee: GuaranteeQuorum}:
+				default:
+				}
+			}
+		}
+	}
+
+	var retry []ClientRequest
+	for i, req := range reqs {
+		if !done[i] {
+			retry = append(retry, req)
+		}
+	}
+	if len(retry) > 0 {
+		p.logPut(LogRead, slog.LevelDebug, "GETs without a matching quorum, retrying through consensus", "read", args.ReadID, "retried", len(retry), "batch", len(reqs))
+		p.orderReads(retry)
+	}
+}
+
+// orderReads hands GETs back to the batcher to be ordered like writes, so they
+// wait for room in the window as writes do.
+func (p *PBFT) orderReads(reqs []ClientRequest) {
+	for _, req := range reqs {
+		req.Ordered = true
+		p.ReqCh <- req
+	}
+}
+
+// readStale asks a single replica or learner, rotating through them, and falls
+// back to consensus if it is too far behind.
+func (p *PBFT) readStale(args *ReadArgs, reqs []ClientRequest) {
+	target := p.staleReaderAt(args.ReadID)
+	verify := p.verifyMessage
+	if p.isLearner(target) {
+		verify = p.verifyLearnerMessage
+	}
+	reply := &ReadReply{}
+	if target == p.id {
+		p.Read(args, reply)
+	} else if !p.sendRPC(target, RPCRead, args, reply) {
+		reply.Success = false
+	}
+
+	var results []string
+	if reply.Success {
+		data := digestReadReply(args.ReadID, hash(args.Command), target, reply.Value)
+		if err := verify(target, data, reply.Signature, reply.Auth); err != nil {
+			p.logPut(LogRead, slog.LevelWarn, "Signature verification failed for ReadReply", "peer", target, "read", args.ReadID, "err", err)
+		} else if r, err := decodeBatchResults(reply.Value); err == nil && len(r) == len(reqs) {
+			results = r
+		}
+	}
+	if results == nil {
+		p.logPut(LogRead, slog.LevelWarn, "Stale read refused, retrying through consensus", "read", args.ReadID, "peer", target)
+		p.orderReads(reqs)
+		return
+	}
+
+	for i, req := range reqs {
+		select {
+		case req.RespCh <- Response{success: true, value: results[i], guarantee: GuaranteeStale}:
+		default:
+		}
+	}
+}
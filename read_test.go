@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func TestParseReadMode(t *testing.T) {
+	for _, tc := range []struct {
+		in     string
+		mode   Guarantee
+		maxLag int
+		ok     bool
+	}{
+		{"linearizable", GuaranteeLinearizable, 0, true},
+		{"quorum", GuaranteeQuorum, 0, true},
+		{"stale(256)", GuaranteeStale, 256, true},
+		{"stale(0)", GuaranteeStale, 0, true},
+		{"stale", "", 0, false},
+		{"stale(-1)", "", 0, false},
+		{"local", "", 0, false},
+	} {
+		mode, maxLag, err := parseReadMode(tc.in)
+		if (err == nil) != tc.ok || mode != tc.mode || maxLag != tc.maxLag {
+			t.Errorf("parseReadMode(%q) = %q, %d, %v", tc.in, mode, maxLag, err)
+		}
+	}
+}
+
+func TestStaleReadLagBound(t *testing.T) {
+	p := newTestReplica(t, 2, 4, CryptoEd25519)
+	p.StateMachine = map[string]string{"x": "1"}
+	p.lastExecuted = 100
+	p.stableCheckpoint = 384
+
+	args := &ReadArgs{ReadID: 1, Command: encodeBatch([][]byte{[]byte("GET x")}), Stale: true, MaxLag: 256}
+	reply := &ReadReply{}
+	p.Read(args, reply)
+	if reply.Success {
+		t.Fatalf("replica 284 behind the stable checkpoint served a stale(256) read")
+	}
+
+	args.MaxLag = 300
+	p.Read(args, reply)
+	if results, err := decodeBatchResults(reply.Value); !reply.Success || err != nil || results[0] != "1" {
+		t.Fatalf("stale(300) read = %v, %q, want \"1\"", reply.Success, reply.Value)
+	}
+
+	// Writes never take the read path
+	args.Command = encodeBatch([][]byte{[]byte("SET x 2")})
+	reply = &ReadReply{}
+	p.Read(args, reply)
+	if reply.Success || p.StateMachine["x"] != "1" {
+		t.Fatalf("a SET was executed as a read")
+	}
+}
+
+// readPeer serves a backup's reads and records the PrePrepares it is sent, so a
+// test can see a read fall back to consensus.
+type readPeer struct {
+	p           *PBFT
+	prePrepares chan *PrePrepareArgs
+}
+
+func (r *readPeer) Read(args *ReadArgs, reply *ReadReply) error {
+	return r.p.Read(args, reply)
+}
+
+func (r *readPeer) PrePrepare(args *PrePrepareArgs, reply *PrePrepareReply) error {
+	r.prePrepares <- args
+	return nil
+}
+
+// newReadCluster returns the primary of four replicas that all hold state; the
+// backups are served over RPC.
+func newReadCluster(t *testing.T, state map[string]string) (*PBFT, map[int]*readPeer) {
+	primary := newTestPrimary(t, 4)
+	primary.StateMachine = copyState(state)
+
+	peers := make(map[int]*readPeer)
+	addrs := map[int]string{1: "127.0.0.1:0"}
+	for id := 2; id <= 4; id++ {
+		backup := newTestReplica(t, id, 4, CryptoEd25519)
+		backup.StateMachine = copyState(state)
+		peer := &readPeer{p: backup, prePrepares: make(chan *PrePrepareArgs, 16)}
+		server := rpc.NewServer()
+		if err := server.RegisterName("PBFT", peer); err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn, _ = readHello(conn)
+				go server.ServeConn(conn)
+			}
+		}()
+		peers[id] = peer
+		addrs[id] = l.Addr().String()
+	}
+
+	rs := *primary.replicas()
+	rs.peerIPPort = addrs
+	primary.replicaSet.Store(&rs)
+	primary.conns = NewConnManager(primary)
+	for id := 2; id <= 4; id++ {
+		primary.conns.Start(id)
+		t.Cleanup(func() { primary.conns.Stop(id) })
+		waitFor(t, fmt.Sprintf("node %d", id), DIAL_TIMEOUT, func() bool { return primary.conns.IsUp(id) })
+	}
+
+	// GETs without a quorum go back through the batcher
+	primary.ReqCh = make(chan ClientRequest, 16)
+	primary.batcher = newBatcher(16, false)
+	go primary.handleClientRequest()
+	return primary, peers
+}
+
+func readRequests(commands ...string) []ClientRequest {
+	reqs := make([]ClientRequest, len(commands))
+	for i, cmd := range commands {
+		reqs[i] = ClientRequest{ClientID: i, Command: []byte(cmd), RespCh: make(chan Response, 1)}
+	}
+	return reqs
+}
+
+func readArgs(id int, reqs []ClientRequest) *ReadArgs {
+	cmds := make([][]byte, len(reqs))
+	for i, req := range reqs {
+		cmds[i] = req.Command
+	}
+	return &ReadArgs{ReadID: id, Command: encodeBatch(cmds)}
+}
+
+// A GET is answered from 2f+1 matching replies, which one corrupted replica
+// cannot outvote; without them it is ordered through consensus instead.
+func TestReadQuorum(t *testing.T) {
+	primary, peers := newReadCluster(t, map[string]string{"x": "1", "y": "2"})
+
+	reqs := readRequests("GET x", "GET y")
+	peers[4].p.StateMachine["x"] = "corrupted"
+	primary.readQuorum(readArgs(1, reqs), reqs)
+	for i, want := range []string{"1", "2"} {
+		select {
+		case resp := <-reqs[i].RespCh:
+			if !resp.success || resp.value != want || resp.guarantee != GuaranteeQuorum {
+				t.Fatalf("%s = %+v, want %q from a quorum", reqs[i].Command, resp, want)
+			}
+		default:
+			t.Fatalf("%s was not answered from the quorum", reqs[i].Command)
+		}
+	}
+
+	// Node 3 has not executed the write to x yet: no value has 2f+1 votes
+	peers[3].p.StateMachine["x"] = "0"
+	reqs = readRequests("GET x", "GET y")
+	primary.readQuorum(readArgs(2, reqs), reqs)
+	select {
+	case resp := <-reqs[0].RespCh:
+		t.Fatalf("GET x answered without a quorum: %+v", resp)
+	case resp := <-reqs[1].RespCh:
+		if resp.value != "2" || resp.guarantee != GuaranteeQuorum {
+			t.Fatalf("GET y = %+v, want \"2\" from a quorum", resp)
+		}
+	}
+	for id := 2; id <= 4; id++ {
+		select {
+		case pp := <-peers[id].prePrepares:
+			if !bytes.Equal(pp.Command, encodeRequests(reqs[:1])) {
+				t.Fatalf("node %d was sent %q, want the GET x retried alone", id, pp.Command)
+			}
+		case <-time.After(DIAL_TIMEOUT):
+			t.Fatalf("GET x was not retried through consensus (no PrePrepare at node %d)", id)
+		}
+	}
+	primary.mu.Lock()
+	defer primary.mu.Unlock()
+	if chans := primary.pendingResponses[1]; len(chans) != 1 || chans[0] != reqs[0].RespCh {
+		t.Fatalf("the retried GET does not wait for seq 1")
+	}
+}
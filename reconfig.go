@@ -0,0 +1,539 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Dynamic membership. A reconfiguration is an ordinary command ordered by
+// consensus, "RECONFIG ADD <id> <addr> <public key> <certificate>" or
+// "RECONFIG REMOVE <id>", so every replica changes its replica set at the same
+// point: the batch that carries it is the last one ordered by the old set, and
+// every sequence number after it belongs to the new one, with f and the quorums
+// recomputed from the new size.
+//
+// The primary drains its pipeline before proposing a reconfiguration alone in a
+// batch, and proposes nothing else until it has executed. A backup that accepts
+// it holds messages for later sequence numbers until it has executed it too.
+//
+// A new replica is started with --join. It holds every message until the
+// replicas that executed its addition hand it the membership and the state at
+// that sequence number; f+1 matching handovers guarantee a correct one.
+
+const (
+	RPCJoin        = "PBFT.Join"
+	RPCReconfigure = "Cluster.Reconfigure"
+
+	RECONFIG_COMMAND = "RECONFIG"
+	MIN_CLUSTER_SIZE = 4 // 3f+1 with f = 1
+
+	HOLD_LIMIT          = 10000 // messages kept while the replica set changes
+	JOIN_RETRIES        = 20
+	JOIN_RETRY_INTERVAL = 250 * time.Millisecond
+	DRAIN_POLL_INTERVAL = 5 * time.Millisecond
+)
+
+// Member is a replica as the others need to know it.
+type Member struct {
+	ID        int
+	Addr      string
+	PublicKey []byte // ed25519
+	TLSCert   []byte // DER, empty without TLS
+}
+
+// JoinArgs hands a new replica the replica set and the state after the batch
+// that added it.
+type JoinArgs struct {
+	SequenceNumber int
+	View           int
+	Members        []Member
+	State          map[string]string
+	NodeID         int
+	Signature      []byte
+	Auth           Authenticator
+}
+
+type JoinReply struct {
+	Success bool
+}
+
+// replicaSet is the replica set as one immutable value. A reconfiguration
+// builds a new one and publishes it, so that broadcasts, the verifier workers
+// and the connection handlers can load it without holding p.mu.
+type replicaSet struct {
+	members     []int               // replica IDs in order
+	peerIPPort  map[int]string      // replica ID -> address
+	pubKeys     map[int]interface{} // ed25519.PublicKey for ed25519, []byte for MAC (shared key with peer)
+	clusterSize int
+}
+
+// replicas returns the current replica set. Callers that read several fields
+// should load it once, to see them from the same replica set.
+func (p *PBFT) replicas() *replicaSet {
+	return p.replicaSet.Load()
+}
+
+// isMember reports whether id is in the current replica set.
+func (p *PBFT) isMember(id int) bool {
+	for _, m := range p.replicas().members {
+		if m == id {
+			return true
+		}
+	}
+	return false
+}
+
+// memberAt returns the i-th replica in ID order, wrapping around. The primary of
+// view v is memberAt(v).
+func (p *PBFT) memberAt(i int) int {
+	members := p.replicas().members
+	return members[i%len(members)]
+}
+
+// isReconfig reports whether command changes the replica set. It tokenizes the
+// command as execution does, so extra spaces do not hide one.
+func isReconfig(command []byte) bool {
+	parts := splitCommand(string(command))
+	return len(parts) > 0 && parts[0] == RECONFIG_COMMAND
+}
+
+// reconfigCommand builds the command adding node (or removing it if node.IP is
+// empty) from its cluster.conf entry.
+func reconfigCommand(confPath string, node Node) (string, error) {
+	if node.IP == "" {
+		return fmt.Sprintf("%s REMOVE %d", RECONFIG_COMMAND, node.ID), nil
+	}
+	// "-" leaves the key to be derived (--insecure-test-keys) and means no TLS
+	pub, cert := "-", "-"
+	if node.PublicKey != "" {
+		pub = node.PublicKey
+	}
+	if node.TLSCert != "" {
+		der, err := readCertificate(resolveConfigPath(confPath, node.TLSCert))
+		if err != nil {
+			return "", err
+		}
+		cert = base64.StdEncoding.EncodeToString(der)
+	}
+	return fmt.Sprintf("%s ADD %d %s:%d %s %s", RECONFIG_COMMAND, node.ID, node.IP, node.Port, pub, cert), nil
+}
+
+// applyReconfigLocked executes a reconfiguration command. Every replica reaches
+// the same verdict, so a rejected command is simply answered with the reason.
+func (p *PBFT) applyReconfigLocked(parts []string) string {
+	if p.cryptoType == CryptoMAC {
+		return "Reconfiguration needs signatures, not MAC keys"
+	}
+	if len(parts) < 3 {
+		return "Invalid RECONFIG"
+	}
+	id, err := strconv.Atoi(parts[2])
+	if err != nil || id <= 0 {
+		return "Invalid node ID"
+	}
+	members := p.membersLocked()
+
+	switch parts[1] {
+	case "ADD":
+		if len(parts) != 6 {
+			return "Invalid RECONFIG ADD"
+		}
+		for _, m := range members {
+			if m.ID == id {
+				return fmt.Sprintf("Node %d is already a member", id)
+			}
+		}
+		if p.isLearner(id) {
+			return fmt.Sprintf("Node %d is a learner", id)
+		}
+		m := Member{ID: id, Addr: parts[3]}
+		if parts[4] == "-" {
+			if !p.testKeys {
+				return fmt.Sprintf("No public key for node %d", id)
+			}
+			priv, _ := generateEd25519Key(id)
+			m.PublicKey = priv.Public().(ed25519.PublicKey)
+		} else if m.PublicKey, err = base64.StdEncoding.DecodeString(parts[4]); err != nil || len(m.PublicKey) != ed25519.PublicKeySize {
+			return fmt.Sprintf("Invalid public key for node %d", id)
+		}
+		if (parts[5] == "-") != (p.tls == nil) {
+			return "Every member needs a TLS certificate, or none"
+		}
+		if parts[5] != "-" {
+			if m.TLSCert, err = base64.StdEncoding.DecodeString(parts[5]); err != nil {
+				return fmt.Sprintf("Invalid certificate for node %d", id)
+			}
+		}
+		members = append(members, m)
+		p.welcome = append(p.welcome, id)
+
+	case "REMOVE":
+		if len(parts) != 3 {
+			return "Invalid RECONFIG REMOVE"
+		}
+		if id == p.primaryID() {
+			return fmt.Sprintf("Node %d is the primary", id)
+		}
+		if len(members) <= MIN_CLUSTER_SIZE {
+			return fmt.Sprintf("At least %d replicas are needed", MIN_CLUSTER_SIZE)
+		}
+		kept := members[:0]
+		for _, m := range members {
+			if m.ID != id {
+				kept = append(kept, m)
+			}
+		}
+		if len(kept) == len(members) {
+			return fmt.Sprintf("Node %d is not a member", id)
+		}
+		members = kept
+
+	default:
+		return "Invalid RECONFIG"
+	}
+
+	p.logPutLocked(LogReconfig, slog.LevelInfo, "Replica set changes", "members", memberIDs(members), "seq", p.lastExecuted)
+	p.setMembersLocked(members)
+	return "OK"
+}
+
+// membersLocked describes the current replica set.
+func (p *PBFT) membersLocked() []Member {
+	rs := p.replicas()
+	members := make([]Member, 0, len(rs.members))
+	for _, id := range rs.members {
+		m := Member{ID: id, Addr: rs.peerIPPort[id]}
+		if key, ok := rs.pubKeys[id].(ed25519.PublicKey); ok {
+			m.PublicKey = key
+		}
+		if p.tls != nil {
+			m.TLSCert = p.tls.pins()[id]
+		}
+		members = append(members, m)
+	}
+	return members
+}
+
+// setMembersLocked installs a replica set by publishing a new replicaSet and,
+// with TLS, a new set of pinned certificates.
+func (p *PBFT) setMembersLocked(members []Member) {
+	peerIPPort := make(map[int]string)
+	pubKeys := make(map[int]interface{})
+	var pinned map[int][]byte
+	if p.tls != nil {
+		pinned = make(map[int][]byte)
+	}
+	for _, m := range members {
+		peerIPPort[m.ID] = m.Addr
+		pubKeys[m.ID] = ed25519.PublicKey(m.PublicKey)
+		if pinned != nil {
+			pinned[m.ID] = m.TLSCert
+		}
+	}
+	if pinned != nil {
+		for id := range p.learners {
+			pinned[id] = p.tls.pins()[id]
+		}
+	}
+	if _, ok := peerIPPort[p.id]; !ok && !p.learner {
+		p.logPutLocked(LogReconfig, slog.LevelWarn, "This replica was removed from the cluster")
+	}
+
+	for id := range p.replicas().peerIPPort {
+		if _, ok := peerIPPort[id]; !ok && id != p.id {
+			p.conns.Stop(id)
+		}
+	}
+	// Pins first: a new member may connect as soon as it is in the replica set
+	if pinned != nil {
+		p.tls.pinned.Store(&pinned)
+	}
+	p.replicaSet.Store(&replicaSet{
+		members:     memberIDs(members),
+		peerIPPort:  peerIPPort,
+		pubKeys:     pubKeys,
+		clusterSize: len(members),
+	})
+	for id := range peerIPPort {
+		if id != p.id {
+			p.conns.Start(id)
+		}
+	}
+}
+
+func memberIDs(members []Member) []int {
+	ids := make([]int, 0, len(members))
+	for _, m := range members {
+		ids = append(ids, m.ID)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// holdReconfigLocked notes a reconfiguration in an accepted batch: until it has
+// executed, nobody knows who may vote on the sequence numbers after it.
+func (p *PBFT) holdReconfigLocked(seq int, command []byte) {
+	cmds, err := decodeBatch(command)
+	if err != nil {
+		return
+	}
+	for _, cmd := range cmds {
+		if isReconfig(cmd) && seq > p.lastExecuted {
+			p.reconfigAt = seq
+			return
+		}
+	}
+}
+
+// hold keeps a PrePrepare, Prepare or Commit for seq while the replica set it
+// belongs to is not known yet. It reports whether the message was kept.
+func (p *PBFT) hold(seq int, msg interface{}) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.joining && (p.reconfigAt == 0 || seq <= p.reconfigAt) {
+		return false
+	}
+	if len(p.held) < HOLD_LIMIT {
+		p.held = append(p.held, msg)
+	}
+	return true
+}
+
+// releaseHeldLocked hands held messages back to their handlers, which verify
+// them against the new replica set.
+func (p *PBFT) releaseHeldLocked() {
+	held := p.held
+	p.held = nil
+	go func() {
+		for _, msg := range held {
+			switch m := msg.(type) {
+			case *PrePrepareArgs:
+				p.PrePrepare(m, &PrePrepareReply{})
+			case *PrepareArgs:
+				p.Prepare(m, &PrepareReply{})
+			case *CommitArgs:
+				p.Commit(m, &CommitReply{})
+			}
+		}
+	}()
+}
+
+// reconfiguredLocked runs after the batch at seq executed: it releases what was
+// held for the new replica set and hands the state to new members.
+func (p *PBFT) reconfiguredLocked(seq int) {
+	if p.reconfigAt != 0 && seq >= p.reconfigAt {
+		p.reconfigAt = 0
+		p.releaseHeldLocked()
+	}
+	if len(p.welcome) == 0 {
+		return
+	}
+	args := &JoinArgs{
+		SequenceNumber: seq,
+		View:           p.view,
+		Members:        p.membersLocked(),
+		State:          make(map[string]string, len(p.StateMachine)),
+		NodeID:         p.id,
+	}
+	for k, v := range p.StateMachine {
+		args.State[k] = v
+	}
+	sig, auth, err := p.signMessage(digestJoin(args))
+	if err != nil {
+		p.logPutLocked(LogReconfig, slog.LevelError, "Error signing Join", "err", err)
+		return
+	}
+	args.Signature = sig
+	args.Auth = auth
+
+	for _, id := range p.welcome {
+		if id != p.id {
+			go p.sendJoin(id, args)
+		}
+	}
+	p.welcome = nil
+}
+
+// sendJoin retries until the new member, which may still be starting, takes it.
+func (p *PBFT) sendJoin(target int, args *JoinArgs) {
+	for attempt := 0; attempt < JOIN_RETRIES; attempt++ {
+		reply := &JoinReply{}
+		if p.sendRPC(target, RPCJoin, args, reply) {
+			return
+		}
+		time.Sleep(JOIN_RETRY_INTERVAL)
+	}
+	p.logPut(LogReconfig, slog.LevelError, "Could not hand the state to the new member", "peer", target)
+}
+
+// Join collects handovers while we wait to join, and enters the replica set once
+// f+1 of them match.
+func (p *PBFT) Join(args *JoinArgs, reply *JoinReply) error {
+	err := p.verifier.Verify(func() error {
+		return p.verifyMessage(args.NodeID, digestJoin(args), args.Signature, args.Auth)
+	})
+	if err != nil {
+		p.logPut(LogReconfig, slog.LevelWarn, "Verification failed for Join", "peer", args.NodeID, "err", err)
+		reply.Success = false
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	reply.Success = true
+	if !p.joining {
+		return nil
+	}
+	sender := false
+	for _, m := range args.Members {
+		sender = sender || (m.ID == args.NodeID && m.ID != p.id)
+	}
+	if !sender {
+		reply.Success = false
+		return nil
+	}
+	p.joins[args.NodeID] = args
+
+	// The sender's ID is the only field allowed to differ
+	content := func(a *JoinArgs) string {
+		c := *a
+		c.NodeID = 0
+		return hash(digestJoin(&c))
+	}
+	want := content(args)
+	matching := 0
+	for _, j := range p.joins {
+		if content(j) == want {
+			matching++
+		}
+	}
+	if matching <= maxFaulty(len(args.Members)) {
+		return nil
+	}
+
+	p.logPutLocked(LogReconfig, slog.LevelInfo, "Joining replica set", "members", memberIDs(args.Members), "seq", args.SequenceNumber)
+	p.setMembersLocked(args.Members)
+	p.StateMachine = make(map[string]string, len(args.State))
+	for k, v := range args.State {
+		p.StateMachine[k] = v
+	}
+	p.view = args.View
+	p.lastExecuted = args.SequenceNumber
+	p.sequenceNumber = args.SequenceNumber
+	p.lastCheckpoint = args.SequenceNumber
+	p.joining = false
+	p.joins = nil
+	p.releaseHeldLocked()
+	return nil
+}
+
+// ClusterService changes the replica set. Like FaultService it is only served to
+// replicas and admin tools holding a node certificate.
+type ClusterService struct {
+	p *PBFT
+}
+
+type ReconfigureArgs struct {
+	Command string
+}
+
+type ReconfigureReply struct {
+	Result string
+}
+
+// Reconfigure orders a reconfiguration command on the primary, once every batch
+// before it has completed.
+func (s *ClusterService) Reconfigure(args *ReconfigureArgs, reply *ReconfigureReply) error {
+	p := s.p
+	if !isReconfig([]byte(args.Command)) {
+		return fmt.Errorf("not a reconfiguration command")
+	}
+	if !p.isPrimary() {
+		p.mu.RLock()
+		primaryID := p.primaryID()
+		p.mu.RUnlock()
+		return fmt.Errorf("node %d is not the primary, send to node %d", p.id, primaryID)
+	}
+	if p.protocol != ProtocolPBFT || p.speculative || p.multi != nil {
+		return fmt.Errorf("reconfiguration needs --protocol pbft without --speculative or --leaders")
+	}
+
+	p.reconfigMu.Lock()
+	defer p.reconfigMu.Unlock()
+
+	// Close the window so the batcher holds new batches, and wait for the rest
+	p.mu.Lock()
+	p.reconfiguring = true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.reconfiguring = false
+		p.mu.Unlock()
+		select {
+		case p.windowFree <- struct{}{}:
+		default:
+		}
+	}()
+	deadline := time.Now().Add(CLIENT_REQUEST_TIMEOUT)
+	for p.inFlightBatches() > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("batches still in flight after %v", CLIENT_REQUEST_TIMEOUT)
+		}
+		time.Sleep(DRAIN_POLL_INTERVAL)
+	}
+
+	req := ClientRequest{Command: []byte(args.Command), RespCh: make(chan Response, 1)}
+	p.orderBatch(p.id, []ClientRequest{req})
+
+	select {
+	case resp := <-req.RespCh:
+		if !resp.success {
+			return fmt.Errorf("reconfiguration failed")
+		}
+		reply.Result = resp.value
+
+		// Nothing resends a PrePrepare, so a new member has to be reachable
+		// before anything is ordered with it
+		deadline = time.Now().Add(DIAL_TIMEOUT)
+		for !p.peersUp() && time.Now().Before(deadline) {
+			time.Sleep(DRAIN_POLL_INTERVAL)
+		}
+		return nil
+	case <-time.After(CLIENT_REQUEST_TIMEOUT):
+		return fmt.Errorf("reconfiguration timed out after %v", CLIENT_REQUEST_TIMEOUT)
+	}
+}
+
+// peersUp reports whether we are connected to every other member.
+func (p *PBFT) peersUp() bool {
+	for id := range p.replicas().peerIPPort {
+		if id != p.id && !p.conns.IsUp(id) {
+			return false
+		}
+	}
+	return true
+}
+
+// clusterCommand sends a reconfiguration to node target, the primary.
+func clusterCommand(confPath string, target int, as int, command string) error {
+	client, err := dialNode(confPath, target, as)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	reply := &ReconfigureReply{}
+	if err := client.Call(RPCReconfigure, &ReconfigureArgs{Command: command}, reply); err != nil {
+		return err
+	}
+	if reply.Result != "OK" {
+		return fmt.Errorf("rejected: %s", reply.Result)
+	}
+	fmt.Println("Replica set changed")
+	return nil
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	mrand "math/rand"
+	"sort"
+	"time"
+)
+
+// Proactive recovery, after PBFT-PR. A watchdog makes every replica recover every
+// --recovery interval, whether or not it looks faulty. Replicas take turns: the
+// interval is split into one slot per replica in ID order, aligned to the wall
+// clock, so only one replica (never more than f) recovers at a time as long as a
+// recovery fits in its slot.
+//
+// A recovering replica
+//   - refreshes its session keys: with --crypto mac it announces a fresh X25519
+//     key, signed with its long-term ed25519 key, and derives a new MAC key with
+//     every replica that answers with its own. Signing keys are long-term, as if
+//     they were kept in the secure coprocessor PBFT-PR assumes.
+//   - asks the other replicas for their latest stable checkpoint, and takes the
+//     latest one that f+1 of them report with the same state digest.
+//   - checks the snapshot it kept at that checkpoint against the digest, and
+//     fetches the snapshot from a replica that reported it if it does not match.
+//   - rebuilds its state from the snapshot by re-executing its log after it,
+//     discarding whatever else the state machine holds.
+//
+// A replica that fell behind the checkpoint installs the snapshot and continues
+// from there, so this is also how a lagging replica catches up.
+
+const (
+	RPCNewKey            = "PBFT.NewKey"
+	RPCStableCheckpoint  = "PBFT.StableCheckpoint"
+	RPCFetchState        = "PBFT.FetchState"
+	RECOVERY_RETRIES     = 10
+	RECOVERY_RETRY_DELAY = 200 * time.Millisecond
+)
+
+// recovery is the state proactive recovery keeps between recoveries.
+type recovery struct {
+	epoch      int                       // our latest key announcement
+	xkey       *ecdh.PrivateKey          // our current X25519 key
+	peerEpochs map[int]int               // latest announcement taken from each replica
+	snapshots  map[int]map[string]string // SequenceNumber -> state at our checkpoints
+	stable     string                    // state digest of the stable checkpoint
+}
+
+// macKeySet holds the MAC keys shared with each peer as one immutable value.
+// Signing and verification load it without holding p.mu, so a key refresh
+// publishes a new one.
+type macKeySet struct {
+	current map[int][]byte
+	prev    map[int][]byte // before the last refresh, still accepted
+	next    map[int][]byte // derived for an announcement, used once it is confirmed
+}
+
+func newRecovery() *recovery {
+	xkey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return &recovery{
+		xkey:       xkey,
+		peerEpochs: make(map[int]int),
+		snapshots:  map[int]map[string]string{0: {}},
+		stable:     stateDigest(nil),
+	}
+}
+
+type NewKeyArgs struct {
+	NodeID    int
+	Epoch     int
+	Public    []byte // X25519
+	Confirm   bool   // the sender switched to the key derived with us
+	Signature []byte // long-term ed25519 key
+}
+
+type NewKeyReply struct {
+	Success   bool
+	NodeID    int
+	Public    []byte
+	Signature []byte
+}
+
+type StableCheckpointArgs struct {
+	Nonce int // fresh per query, so old answers cannot be replayed
+}
+
+type StableCheckpointReply struct {
+	SequenceNumber int
+	StateDigest    string
+	NodeID         int
+	Signature      []byte
+	Auth           Authenticator
+}
+
+type FetchStateArgs struct {
+	SequenceNumber int
+}
+
+type FetchStateReply struct {
+	Found bool
+	State map[string]string
+}
+
+func copyState(state map[string]string) map[string]string {
+	c := make(map[string]string, len(state))
+	for k, v := range state {
+		c[k] = v
+	}
+	return c
+}
+
+// snapshotLocked keeps the state at our checkpoint seq, to check and serve later.
+func (p *PBFT) snapshotLocked(seq int) {
+	if p.recovery != nil {
+		p.recovery.snapshots[seq] = copyState(p.StateMachine)
+	}
+}
+
+// stableLocked notes a stable checkpoint and drops the disseminated batches and
+// snapshots before it.
+func (p *PBFT) stableLocked(seq int, digest string) {
+	p.pruneBatchesLocked(seq)
+	if p.recovery == nil {
+		return
+	}
+	p.recovery.stable = digest
+	for s := range p.recovery.snapshots {
+		if s < seq {
+			delete(p.recovery.snapshots, s)
+		}
+	}
+}
+
+// watchdog starts a recovery at the beginning of this replica's slot in every
+// interval.
+func (p *PBFT) watchdog() {
+	for {
+		p.mu.RLock()
+		members := p.replicas().members
+		slot := p.recoveryInterval / time.Duration(len(members))
+		index := sort.SearchInts(members, p.id)
+		p.mu.RUnlock()
+
+		now := time.Now()
+		next := now.Truncate(p.recoveryInterval).Add(time.Duration(index) * slot)
+		if !next.After(now) {
+			next = next.Add(p.recoveryInterval)
+		}
+		time.Sleep(time.Until(next))
+
+		start := time.Now()
+		if err := p.recover(); err != nil {
+			p.logPut(LogRecovery, slog.LevelError, "Recovery failed", "err", err)
+			continue
+		}
+		if took := time.Since(start); took > slot {
+			p.logPut(LogRecovery, slog.LevelWarn, "Recovery took longer than a slot", "took", took, "slot", slot)
+		}
+	}
+}
+
+func (p *PBFT) recover() error {
+	p.logPut(LogRecovery, slog.LevelInfo, "Starting proactive recovery")
+	if p.cryptoType == CryptoMAC {
+		p.refreshKeys()
+	}
+
+	seq, digest, reporters, err := p.agreeOnCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	p.mu.RLock()
+	snapshot, ok := p.recovery.snapshots[seq]
+	if ok {
+		snapshot = copyState(snapshot)
+	}
+	p.mu.RUnlock()
+	if !ok || stateDigest(snapshot) != digest {
+		p.logPut(LogRecovery, slog.LevelWarn, "No correct snapshot for the checkpoint, fetching it", "seq", seq)
+		if snapshot = p.fetchState(seq, digest, reporters); snapshot == nil {
+			return fmt.Errorf("no replica sent the state at checkpoint %d", seq)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.rebuildLocked(seq, digest, snapshot); err != nil {
+		return err
+	}
+	p.logPutLocked(LogRecovery, slog.LevelInfo, "Recovered", "checkpoint", seq, "executed", p.lastExecuted)
+	return nil
+}
+
+// refreshKeys announces a fresh X25519 key to every replica and switches to the
+// MAC keys derived with those that answer.
+func (p *PBFT) refreshKeys() {
+	xkey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		p.logPut(LogRecovery, slog.LevelError, "Error generating a session key", "err", err)
+		return
+	}
+	p.mu.Lock()
+	p.recovery.epoch++
+	args := &NewKeyArgs{NodeID: p.id, Epoch: p.recovery.epoch, Public: xkey.PublicKey().Bytes()}
+	peers := p.replicas().peerIPPort
+	p.mu.Unlock()
+	args.Signature = ed25519.Sign(p.idKey, digestNewKey(TAG_NEW_KEY, args.NodeID, args.Epoch, args.Public))
+	confirm := &NewKeyArgs{NodeID: p.id, Epoch: args.Epoch, Public: args.Public, Confirm: true}
+	confirm.Signature = ed25519.Sign(p.idKey, digestNewKey(TAG_NEW_KEY_CONFIRM, confirm.NodeID, confirm.Epoch, confirm.Public))
+
+	replies := make(chan *NewKeyReply, len(peers))
+	for id := range peers {
+		if id == p.id {
+			continue
+		}
+		go func(target int) {
+			reply := &NewKeyReply{}
+			if !p.sendRPC(target, RPCNewKey, args, reply) || !reply.Success || reply.NodeID != target {
+				reply = nil
+			}
+			replies <- reply
+		}(id)
+	}
+
+	refreshed := 0
+	for i := 1; i < len(peers); i++ {
+		reply := <-replies
+		if reply == nil {
+			continue
+		}
+		data := digestNewKey(TAG_NEW_KEY_REPLY, reply.NodeID, args.Epoch, reply.Public)
+		idKey := p.idKeys[reply.NodeID]
+		if len(idKey) != ed25519.PublicKeySize || !ed25519.Verify(idKey, data, reply.Signature) {
+			p.logPut(LogRecovery, slog.LevelWarn, "Invalid NewKey reply", "peer", reply.NodeID)
+			continue
+		}
+		key, err := deriveMACKey(xkey, reply.Public, p.id, reply.NodeID)
+		if err != nil {
+			continue
+		}
+		p.mu.Lock()
+		p.setMACKeyLocked(reply.NodeID, key)
+		p.mu.Unlock()
+		refreshed++
+		go p.sendRPC(reply.NodeID, RPCNewKey, confirm, &NewKeyReply{})
+	}
+
+	p.mu.Lock()
+	p.recovery.xkey = xkey
+	p.mu.Unlock()
+	p.logPut(LogRecovery, slog.LevelInfo, "Refreshed session keys", "replicas", refreshed)
+}
+
+// NewKey takes a replica's key announcement and answers with our own key. We keep
+// signing with the old key until the replica confirms it switched, but accept
+// both in the meantime.
+func (p *PBFT) NewKey(args *NewKeyArgs, reply *NewKeyReply) error {
+	if p.recovery == nil || p.cryptoType != CryptoMAC {
+		reply.Success = false
+		return nil
+	}
+	tag := TAG_NEW_KEY
+	if args.Confirm {
+		tag = TAG_NEW_KEY_CONFIRM
+	}
+	idKey := p.idKeys[args.NodeID]
+	if len(idKey) != ed25519.PublicKeySize || !ed25519.Verify(idKey, digestNewKey(tag, args.NodeID, args.Epoch, args.Public), args.Signature) {
+		p.logPut(LogRecovery, slog.LevelWarn, "Invalid NewKey", "peer", args.NodeID)
+		reply.Success = false
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if args.Confirm {
+		key := p.macKeys.Load().next[args.NodeID]
+		reply.Success = key != nil && args.Epoch == p.recovery.peerEpochs[args.NodeID]
+		if reply.Success {
+			p.setMACKeyLocked(args.NodeID, key)
+		}
+		return nil
+	}
+	if args.Epoch <= p.recovery.peerEpochs[args.NodeID] {
+		reply.Success = false
+		return nil
+	}
+	key, err := deriveMACKey(p.recovery.xkey, args.Public, p.id, args.NodeID)
+	if err != nil {
+		reply.Success = false
+		return nil
+	}
+	p.recovery.peerEpochs[args.NodeID] = args.Epoch
+	keys := *p.macKeys.Load()
+	keys.next = withKey(keys.next, args.NodeID, key)
+	p.macKeys.Store(&keys)
+
+	reply.Success = true
+	reply.NodeID = p.id
+	reply.Public = p.recovery.xkey.PublicKey().Bytes()
+	reply.Signature = ed25519.Sign(p.idKey, digestNewKey(TAG_NEW_KEY_REPLY, p.id, args.Epoch, reply.Public))
+	return nil
+}
+
+// deriveMACKey derives the MAC key two replicas share from their X25519 keys.
+func deriveMACKey(xkey *ecdh.PrivateKey, peerPublic []byte, id1 int, id2 int) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := xkey.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	info := fmt.Sprintf("pbft mac key %d-%d", min(id1, id2), max(id1, id2))
+	return hkdf.Key(sha256.New, secret, nil, info, 32)
+}
+
+// setMACKeyLocked switches to a new MAC key shared with peer. The old key is
+// still accepted for messages already in flight.
+func (p *PBFT) setMACKeyLocked(peer int, key []byte) {
+	keys := *p.macKeys.Load()
+	keys.prev = withKey(keys.prev, peer, keys.current[peer])
+	keys.next = withKey(keys.next, peer, nil)
+	keys.current = withKey(keys.current, peer, key)
+	p.macKeys.Store(&keys)
+
+	rs := *p.replicas()
+	pubKeys := make(map[int]interface{}, len(rs.pubKeys))
+	for id, k := range rs.pubKeys {
+		pubKeys[id] = k
+	}
+	pubKeys[peer] = key
+	rs.pubKeys = pubKeys
+	p.replicaSet.Store(&rs)
+}
+
+// withKey returns a copy of keys with the key for peer set, or removed if nil.
+func withKey(keys map[int][]byte, peer int, key []byte) map[int][]byte {
+	c := make(map[int][]byte, len(keys)+1)
+	for id, k := range keys {
+		c[id] = k
+	}
+	if key == nil {
+		delete(c, peer)
+	} else {
+		c[peer] = key
+	}
+	return c
+}
+
+// spare returns the other keys accepted from peer while keys change.
+func (keys *macKeySet) spare(peer int) [][]byte {
+	return [][]byte{keys.prev[peer], keys.next[peer]}
+}
+
+type checkpointID struct {
+	seq    int
+	digest string
+}
+
+// agreeOnCheckpoint returns the latest stable checkpoint that f+1 other replicas
+// report with the same digest, and who reported it.
+func (p *PBFT) agreeOnCheckpoint() (int, string, []int, error) {
+	for attempt := 0; attempt < RECOVERY_RETRIES; attempt++ {
+		if attempt > 0 {
+			time.Sleep(RECOVERY_RETRY_DELAY)
+		}
+		p.mu.RLock()
+		rs := p.replicas()
+		peers := rs.peerIPPort
+		f := maxFaulty(rs.clusterSize)
+		p.mu.RUnlock()
+
+		args := &StableCheckpointArgs{Nonce: mrand.Int()}
+		replies := make(chan *StableCheckpointReply, len(peers))
+		for id := range peers {
+			if id == p.id {
+				continue
+			}
+			go func(target int) {
+				reply := &StableCheckpointReply{}
+				if !p.sendRPC(target, RPCStableCheckpoint, args, reply) || reply.NodeID != target {
+					reply = nil
+				}
+				replies <- reply
+			}(id)
+		}
+
+		reporters := make(map[checkpointID][]int)
+		for i := 1; i < len(peers); i++ {
+			reply := <-replies
+			if reply == nil {
+				continue
+			}
+			data := digestStableCheckpoint(args.Nonce, reply.SequenceNumber, reply.StateDigest, reply.NodeID)
+			if err := p.verifyMessage(reply.NodeID, data, reply.Signature, reply.Auth); err != nil {
+				p.logPut(LogRecovery, slog.LevelWarn, "Signature verification failed for StableCheckpoint", "peer", reply.NodeID, "err", err)
+				continue
+			}
+			id := checkpointID{seq: reply.SequenceNumber, digest: reply.StateDigest}
+			reporters[id] = append(reporters[id], reply.NodeID)
+		}
+
+		best := checkpointID{seq: -1}
+		for id, ids := range reporters {
+			if len(ids) > f && id.seq > best.seq {
+				best = id
+			}
+		}
+		if best.seq >= 0 {
+			return best.seq, best.digest, reporters[best], nil
+		}
+	}
+	return 0, "", nil, fmt.Errorf("replicas do not agree on a stable checkpoint")
+}
+
+// StableCheckpoint reports our latest stable checkpoint to a recovering replica.
+func (p *PBFT) StableCheckpoint(args *StableCheckpointArgs, reply *StableCheckpointReply) error {
+	if p.recovery == nil {
+		return fmt.Errorf("node %d was started without --recovery", p.id)
+	}
+	p.mu.RLock()
+	reply.SequenceNumber = p.stableCheckpoint
+	reply.StateDigest = p.recovery.stable
+	p.mu.RUnlock()
+
+	reply.NodeID = p.id
+	sig, auth, err := p.signMessage(digestStableCheckpoint(args.Nonce, reply.SequenceNumber, reply.StateDigest, p.id))
+	if err != nil {
+		return err
+	}
+	reply.Signature = sig
+	reply.Auth = auth
+	return nil
+}
+
+// fetchState asks the replicas that reported a checkpoint for its state, until
+// one sends a state that matches the digest.
+func (p *PBFT) fetchState(seq int, digest string, reporters []int) map[string]string {
+	for _, id := range reporters {
+		reply := &FetchStateReply{}
+		if !p.sendRPC(id, RPCFetchState, &FetchStateArgs{SequenceNumber: seq}, reply) || !reply.Found {
+			continue
+		}
+		if stateDigest(reply.State) == digest {
+			return reply.State
+		}
+		p.logPut(LogRecovery, slog.LevelWarn, "State does not match the checkpoint", "peer", id, "seq", seq)
+	}
+	return nil
+}
+
+// FetchState sends the snapshot we kept at a checkpoint.
+func (p *PBFT) FetchState(args *FetchStateArgs, reply *FetchStateReply) error {
+	if p.recovery == nil {
+		reply.Found = false
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	snapshot, ok := p.recovery.snapshots[args.SequenceNumber]
+	reply.Found = ok
+	reply.State = copyState(snapshot)
+	return nil
+}
+
+// rebuildLocked replaces the state machine with the checked snapshot at seq and
+// re-executes the log after it. A replica behind seq continues from it instead.
+func (p *PBFT) rebuildLocked(seq int, digest string, snapshot map[string]string) error {
+	if seq > p.lastExecuted {
+		p.StateMachine = copyState(snapshot)
+		p.recovery.snapshots[seq] = snapshot
+		p.lastExecuted = seq
+		p.lastCheckpoint = seq
+		if seq > p.sequenceNumber {
+			p.sequenceNumber = seq
+		}
+		if seq > p.stableCheckpoint {
+			p.stableCheckpoint = seq
+			p.stableLocked(seq, digest)
+		}
+		p.executeCommittedLocked()
+		return nil
+	}
+
+	var log [][]byte
+	for s := seq + 1; s <= p.lastExecuted; s++ {
+		state, ok := p.reqState[s]
+		if !ok || state.PrePrepareMsg == nil {
+			return fmt.Errorf("seq %d is missing from the log", s)
+		}
+		command := p.batchLocked(state.PrePrepareMsg)
+		if command == nil {
+			return fmt.Errorf("the batch of seq %d is missing", s)
+		}
+		log = append(log, command)
+	}
+
+	p.StateMachine = copyState(snapshot)
+	p.recovery.snapshots[seq] = snapshot
+	for i, command := range log {
+		p.replayBatchLocked(command)
+		if _, ok := p.recovery.snapshots[seq+1+i]; ok {
+			p.snapshotLocked(seq + 1 + i)
+		}
+	}
+	return nil
+}
+
+// replayBatchLocked re-applies a batch to the state machine only: replica set
+// changes it carries took effect when it first executed.
+func (p *PBFT) replayBatchLocked(command []byte) {
+	cmds, err := decodeBatch(command)
+	if err != nil {
+		cmds = [][]byte{command}
+	}
+	for _, cmd := range cmds {
+		if !isReconfig(cmd) {
+			p.applyCommandLocked(cmd)
+		}
+	}
+}
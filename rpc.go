@@ -1,7 +1,7 @@
 package main
 
 import (
-	"fmt"
+	"log/slog"
 )
 
 const (
@@ -16,7 +16,8 @@ type PrePrepareArgs struct {
 	SequenceNumber int
 	Digest         string
 	Command        []byte
-	Signature      []byte
+	Signature      []byte        // ed25519 mode
+	Auth           Authenticator // MAC mode: one MAC per replica
 }
 
 type PrePrepareReply struct {
@@ -29,6 +30,7 @@ type PrepareArgs struct {
 	Digest         string
 	NodeID         int
 	Signature      []byte
+	Auth           Authenticator
 }
 
 type PrepareReply struct {
@@ -41,16 +43,28 @@ type CommitArgs struct {
 	Digest         string
 	NodeID         int
 	Signature      []byte
+	Auth           Authenticator
 }
 
 type CommitReply struct {
 	Success bool
 }
 
+// PreparedCertificate proves that a request prepared in some view: the primary's
+// PrePrepare plus 2f matching Prepares from backups, or a prepare quorum
+// certificate with --crypto multisig.
+type PreparedCertificate struct {
+	PrePrepare *PrePrepareArgs
+	Prepares   []*PrepareArgs
+	PrepareQC  *QuorumCert
+}
+
 type ClientReplyArgs struct {
 	SequenceNumber int
 	NodeID         int
 	Value          string
+	Signature      []byte
+	Auth           Authenticator
 }
 
 type ClientReplyReply struct {
@@ -58,88 +72,118 @@ type ClientReplyReply struct {
 }
 
 func (p *PBFT) PrePrepare(args *PrePrepareArgs, reply *PrePrepareReply) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	// 0. Verify Signature
-	// In PrePrepare, the sender is the Primary.
-	// Primary ID depends on View.
-	primaryID := (args.View % p.clusterSize) + 1
-	var verifyKey interface{}
-	if p.cryptoType == CryptoMAC {
-		verifyKey = p.macKeys[primaryID]
-	} else {
-		verifyKey = p.pubKeys[primaryID]
-	}
-	if verifyKey == nil {
-		reply.Success = false
+	// The leaders of a later epoch, or the replicas after a reconfiguration, are
+	// only known once we get there
+	if p.hold(args.SequenceNumber, args) || p.deferFuture(args.View, args) {
+		reply.Success = true
 		return nil
 	}
-	data := digestPrePrepare(args.View, args.SequenceNumber, args.Digest)
-	if err := verify(verifyKey, data, args.Signature); err != nil {
-		p.logPutLocked(fmt.Sprintf("Signature verification failed for PrePrepare seq %d from %d. SigLen: %d", args.SequenceNumber, primaryID, len(args.Signature)), RED)
+
+	// 0. Verify Signature (outside the lock)
+	// In PrePrepare, the sender is the Primary, or the leader of the sequence
+	// number with --leaders.
+	primaryID := p.proposer(args.View, args.SequenceNumber)
+	err := p.verifier.Verify(func() error {
+		data := digestPrePrepare(args.View, args.SequenceNumber, args.Digest, args.Command)
+		if err := p.verifyMessage(primaryID, data, args.Signature, args.Auth); err != nil {
+			return err
+		}
+		// The signature covers the payload, but the digest is what Prepare and
+		// Commit agree on, so it has to actually be the hash of the payload.
+		return p.checkPayload(args)
+	})
+	if err != nil {
+		p.logPut(LogConsensus, slog.LevelWarn, "Verification failed for PrePrepare", "peer", primaryID, "seq", args.SequenceNumber, "err", err)
 		reply.Success = false
 		return nil
 	}
 
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	// 1. Check view
 	if args.View != p.view {
 		reply.Success = false
 		return nil
 	}
 
+	reply.Success = p.acceptPrePrepareLocked(args)
+	return nil
+}
+
+// acceptPrePrepareLocked stores a verified PrePrepare for the current view and
+// starts the next phase.
+func (p *PBFT) acceptPrePrepareLocked(args *PrePrepareArgs) bool {
 	// 2. Accept and store
 	state := p.getRequestState(args.SequenceNumber)
 	if state.PrePrepared {
 		// Already received
-		reply.Success = true
-		return nil
+		return true
 	}
 
 	state.PrePrepared = true
 	state.PrePrepareMsg = args
-
-	// WAL
-	if err := p.storage.AppendEntry(LogEntry{View: args.View, Command: args.Command}); err != nil {
-		p.logPutLocked("Failed to append to log", RED)
-		reply.Success = false
-		return nil
+	p.orderBatchLocked(args)
+	p.markLocked(state, TracePrePrepared)
+
+	// WAL (a disseminated batch is logged when it arrives)
+	if len(args.Command) > 0 {
+		if err := p.storage.AppendEntry(LogEntry{View: args.View, Command: args.Command}); err != nil {
+			p.logPutLocked(LogConsensus, slog.LevelError, "Failed to append to log", "seq", args.SequenceNumber, "err", err)
+			return false
+		}
 	}
 
-	p.logPutLocked(fmt.Sprintf("Received PrePrepare for seq %d", args.SequenceNumber), BLUE)
+	p.logPutLocked(LogConsensus, slog.LevelDebug, "Received PrePrepare", "seq", args.SequenceNumber)
+	if command := p.batchLocked(args); command != nil {
+		p.holdReconfigLocked(args.SequenceNumber, command)
+	}
+	p.fillGapLocked(args.SequenceNumber)
 
-	// 3. Broadcast Prepare
+	// 3. Execute speculatively, broadcast Prepare, or vote to the primary in linear mode
+	if p.speculative {
+		p.speculateLocked()
+		return true
+	}
+	if p.linearVotes() {
+		go p.sendVote(PhasePrepare, args.View, args.SequenceNumber, args.Digest)
+		p.advanceLinearLocked(state, args.SequenceNumber)
+		return true
+	}
 	go p.broadcastPrepare(args.View, args.SequenceNumber, args.Digest)
 
 	// Add own prepare to state
 	state.PrepareMsgs[p.id] = args.Digest
 
-	reply.Success = true
-	return nil
+	// Prepares from the other backups may have arrived before this PrePrepare
+	p.checkPreparedLocked(state, args.SequenceNumber, args.Digest)
+	return true
 }
 
 func (p *PBFT) Prepare(args *PrepareArgs, reply *PrepareReply) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	// 0. Verify Signature
-	var verifyKey interface{}
-	if p.cryptoType == CryptoMAC {
-		verifyKey = p.macKeys[args.NodeID]
-	} else {
-		verifyKey = p.pubKeys[args.NodeID]
-	}
-	if verifyKey == nil {
-		reply.Success = false
+	if p.hold(args.SequenceNumber, args) {
+		reply.Success = true
 		return nil
 	}
-	data := digestPrepare(args.View, args.SequenceNumber, args.Digest, args.NodeID)
-	if err := verify(verifyKey, data, args.Signature); err != nil {
-		p.logPutLocked(fmt.Sprintf("Signature verification failed for Prepare from %d seq %d. SigLen: %d", args.NodeID, args.SequenceNumber, len(args.Signature)), RED)
+
+	// 0. Verify Signature (outside the lock)
+	err := p.verifier.Verify(func() error {
+		data := digestPrepare(args.View, args.SequenceNumber, args.Digest, args.NodeID)
+		return p.verifyMessage(args.NodeID, data, args.Signature, args.Auth)
+	})
+	if err != nil {
+		p.logPut(LogConsensus, slog.LevelWarn, "Signature verification failed for Prepare", "peer", args.NodeID, "seq", args.SequenceNumber, "err", err)
 		reply.Success = false
 		return nil
 	}
 
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.deferLocked(args.View, args) {
+		reply.Success = true
+		return nil
+	}
 	if args.View != p.view {
 		reply.Success = false
 		return nil
@@ -147,8 +191,9 @@ func (p *PBFT) Prepare(args *PrepareArgs, reply *PrepareReply) error {
 
 	state := p.getRequestState(args.SequenceNumber)
 	state.PrepareMsgs[args.NodeID] = args.Digest
+	state.PrepareProofs[args.NodeID] = args
 
-	p.logPutLocked(fmt.Sprintf("Received Prepare from %d for seq %d (Count: %d)", args.NodeID, args.SequenceNumber, len(state.PrepareMsgs)), YELLOW)
+	p.logPutLocked(LogConsensus, slog.LevelDebug, "Received Prepare", "peer", args.NodeID, "seq", args.SequenceNumber, "count", len(state.PrepareMsgs))
 
 	p.checkPreparedLocked(state, args.SequenceNumber, args.Digest)
 
@@ -157,27 +202,29 @@ func (p *PBFT) Prepare(args *PrepareArgs, reply *PrepareReply) error {
 }
 
 func (p *PBFT) Commit(args *CommitArgs, reply *CommitReply) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	// 0. Verify Signature
-	var verifyKey interface{}
-	if p.cryptoType == CryptoMAC {
-		verifyKey = p.macKeys[args.NodeID]
-	} else {
-		verifyKey = p.pubKeys[args.NodeID]
-	}
-	if verifyKey == nil {
-		reply.Success = false
+	if p.hold(args.SequenceNumber, args) {
+		reply.Success = true
 		return nil
 	}
-	data := digestCommit(args.View, args.SequenceNumber, args.Digest, args.NodeID)
-	if err := verify(verifyKey, data, args.Signature); err != nil {
-		p.logPutLocked(fmt.Sprintf("Signature verification failed for Commit from %d seq %d. SigLen: %d", args.NodeID, args.SequenceNumber, len(args.Signature)), RED)
+
+	// 0. Verify Signature (outside the lock)
+	err := p.verifier.Verify(func() error {
+		data := digestCommit(args.View, args.SequenceNumber, args.Digest, args.NodeID)
+		return p.verifyMessage(args.NodeID, data, args.Signature, args.Auth)
+	})
+	if err != nil {
+		p.logPut(LogConsensus, slog.LevelWarn, "Signature verification failed for Commit", "peer", args.NodeID, "seq", args.SequenceNumber, "err", err)
 		reply.Success = false
 		return nil
 	}
 
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.deferLocked(args.View, args) {
+		reply.Success = true
+		return nil
+	}
 	if args.View != p.view {
 		reply.Success = false
 		return nil
@@ -185,21 +232,34 @@ func (p *PBFT) Commit(args *CommitArgs, reply *CommitReply) error {
 
 	state := p.getRequestState(args.SequenceNumber)
 	state.CommitMsgs[args.NodeID] = args.Digest
+	if p.audit != nil {
+		state.CommitProofs[args.NodeID] = args
+	}
 
-	p.logPutLocked(fmt.Sprintf("Received Commit from %d for seq %d (Count: %d)", args.NodeID, args.SequenceNumber, len(state.CommitMsgs)), ORANGE)
+	p.logPutLocked(LogConsensus, slog.LevelDebug, "Received Commit", "peer", args.NodeID, "seq", args.SequenceNumber, "count", len(state.CommitMsgs))
 
 	p.checkCommittedLocked(state, args.SequenceNumber, args.Digest)
+	p.auditLocked(args.SequenceNumber, state)
 
 	reply.Success = true
 	return nil
 }
 
 func (p *PBFT) getRequestState(seq int) *RequestState {
+	if p.multi != nil && seq > p.multi.maxSeen {
+		p.multi.maxSeen = seq
+	}
 	if _, ok := p.reqState[seq]; !ok {
 		p.reqState[seq] = &RequestState{
 			PrepareMsgs:   make(map[int]string),
+			PrepareProofs: make(map[int]*PrepareArgs),
 			CommitMsgs:    make(map[int]string),
+			CommitProofs:  make(map[int]*CommitArgs),
+			PrepareShares: make(map[int][]byte),
+			CommitShares:  make(map[int][]byte),
 			ClientReplies: make(map[int]string),
+			SpecReplies:   make(map[int]*SpecReplyArgs),
+			LocalCommits:  make(map[int]bool),
 		}
 	}
 	return p.reqState[seq]
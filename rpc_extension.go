@@ -1,14 +1,21 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
-	"fmt"
-	"sort"
+	"log/slog"
 )
 
 // ClientReply handles the reply from a replica to the client (Primary acts as client proxy here)
 func (p *PBFT) ClientReply(args *ClientReplyArgs, reply *ClientReplyReply) error {
+	err := p.verifier.Verify(func() error {
+		data := digestClientReply(args.SequenceNumber, args.NodeID, args.Value)
+		return p.verifyMessage(args.NodeID, data, args.Signature, args.Auth)
+	})
+	if err != nil {
+		p.logPut(LogClient, slog.LevelWarn, "Signature verification failed for ClientReply", "peer", args.NodeID, "seq", args.SequenceNumber, "err", err)
+		reply.Success = false
+		return nil
+	}
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -34,7 +41,7 @@ func (p *PBFT) handleClientReplyLocked(seq int, nodeID int, value string) {
 	state.ClientReplies[nodeID] = value
 
 	// Check for f+1 matches
-	f := (p.clusterSize - 1) / 3
+	f := maxFaulty(p.replicas().clusterSize)
 	required := f + 1
 
 	// Count matches for this value
@@ -45,41 +52,60 @@ func (p *PBFT) handleClientReplyLocked(seq int, nodeID int, value string) {
 		}
 	}
 
+	// With HotStuff the client only learns which sequence number its batch got
+	// when it executes it, so replies from faster replicas may arrive first
+	if _, ok := p.pendingResponses[seq]; !ok {
+		return
+	}
+
 	if count >= required {
-		p.logPutLocked(fmt.Sprintf("Client received %d replies for seq %d. Returning to app.", count, seq), GREEN)
-		state.ReplySent = true
-
-		results, err := decodeBatchResults(value)
-		if err != nil {
-			// If decoding fails, fallback to treating as single result?
-			// This matches consensus.go's fallback logic roughly.
-			p.logPutLocked("Error decoding batch results in reply", RED)
-			// Try single
-			results = []string{value}
+		p.logPutLocked(LogClient, slog.LevelDebug, "Client received matching replies, returning to app", "seq", seq, "replies", count)
+		p.deliverRepliesLocked(state, seq, value)
+	}
+}
+
+// deliverRepliesLocked hands the results of the batch at seq back to the
+// requests waiting on it.
+func (p *PBFT) deliverRepliesLocked(state *RequestState, seq int, value string) {
+	state.ReplySent = true
+	p.markLocked(state, TraceReplied)
+
+	results, err := decodeBatchResults(value)
+	if err != nil {
+		// If decoding fails, fallback to treating as single result?
+		// This matches consensus.go's fallback logic roughly.
+		p.logPutLocked(LogClient, slog.LevelError, "Error decoding batch results in reply", "seq", seq, "err", err)
+		// Try single
+		results = []string{value}
+	}
+
+	if chans, ok := p.pendingResponses[seq]; ok {
+		delete(p.pendingResponses, seq)
+		if p.multi != nil {
+			delete(p.multi.proposals, seq)
 		}
+		p.batchDoneLocked(chans)
 
-		if chans, ok := p.pendingResponses[seq]; ok {
-			delete(p.pendingResponses, seq)
+		// Match results to channels
+		// If mismatch, we have a problem. But we assume 1:1 if batching worked.
+		limit := len(chans)
+		if len(results) < limit {
+			limit = len(results)
+		}
 
-			// Match results to channels
-			// If mismatch, we have a problem. But we assume 1:1 if batching worked.
-			limit := len(chans)
-			if len(results) < limit {
-				limit = len(results)
+		for i := 0; i < limit; i++ {
+			resp := Response{
+				success:   true,
+				value:     results[i],
+				guarantee: GuaranteeLinearizable,
 			}
-
-			for i := 0; i < limit; i++ {
-				resp := Response{
-					success: true,
-					value:   results[i],
-				}
-				select {
-				case chans[i] <- resp:
-				default:
-				}
+			select {
+			case chans[i] <- resp:
+			default:
 			}
 		}
 	}
+	p.traceDoneLocked(seq, state)
 }
 
 type GetStateChecksumArgs struct{}
@@ -94,20 +120,22 @@ func (p *PBFT) GetStateChecksum(args *GetStateChecksumArgs, reply *GetStateCheck
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	keys := make([]string, 0, len(p.StateMachine))
-	for k := range p.StateMachine {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-
-	h := sha256.New()
-	for _, k := range keys {
-		v := p.StateMachine[k]
-		h.Write([]byte(fmt.Sprintf("%s:%s;", k, v)))
-	}
-
-	reply.Checksum = hex.EncodeToString(h.Sum(nil))
+	reply.Checksum = p.stateDigestLocked()
 	reply.StateMachineSize = len(p.StateMachine)
 	reply.SeqNum = p.sequenceNumber
 	return nil
 }
+
+type GetPeerStatusArgs struct{}
+
+type GetPeerStatusReply struct {
+	NodeID int
+	Peers  []PeerStatus
+}
+
+// GetPeerStatus reports this node's view of its connections to the other replicas.
+func (p *PBFT) GetPeerStatus(args *GetPeerStatusArgs, reply *GetPeerStatusReply) error {
+	reply.NodeID = p.id
+	reply.Peers = p.conns.Status()
+	return nil
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// Speculative execution (--speculative), after Zyzzyva. Replicas skip Prepare and
+// Commit: they execute each batch as soon as its PrePrepare arrives, strictly in
+// sequence order, and reply to the client with a hash of the history they have
+// executed so far. The client (hosted by the primary) completes a request on
+// 3f+1 matching replies. With 2f+1 to 3f it waits SPEC_REPLY_TIMEOUT, then sends
+// the matching replies back to the replicas as a commit certificate, and
+// completes once 2f+1 of them acknowledge it with a LocalCommit.
+//
+// Every speculative batch keeps an undo log until a commit certificate covers
+// it. A replica whose history does not match a certificate (it executed a
+// different batch for some sequence number) rolls back to just before that batch
+// and re-executes the certified one. On the fast path nothing would ever commit
+// at the replicas, so the client also sends a certificate for every
+// SPEC_CHECKPOINT_INTERVAL-th batch, which lets them drop their undo logs.
+// History hashes are chained, so the first batch that differs can be any one
+// after the committed prefix. If re-executing the certified batch does not
+// repair the history, the replica takes the certified batches from a replica
+// that vouched for the certificate.
+
+const (
+	RPCSpecReply   = "PBFT.SpecReply"
+	RPCSpecCommit  = "PBFT.SpecCommit"
+	RPCSpecBatches = "PBFT.SpecBatches"
+
+	SPEC_REPLY_TIMEOUT       = 20 * time.Millisecond
+	SPEC_COMMIT_RETRIES      = 3
+	SPEC_CHECKPOINT_INTERVAL = 128
+)
+
+type SpecReplyArgs struct {
+	View           int
+	SequenceNumber int
+	Digest         string
+	History        string // history hash after executing this batch
+	NodeID         int
+	Value          string
+	Signature      []byte
+	Auth           Authenticator
+}
+
+type SpecReplyReply struct {
+	Success bool
+}
+
+// CommitCertificate proves that 2f+1 replicas executed the same batch with the
+// same history. It carries the PrePrepare so replicas that executed something
+// else at this sequence number can repair their state.
+type CommitCertificate struct {
+	PrePrepare *PrePrepareArgs
+	History    string
+	Replies    []*SpecReplyArgs
+}
+
+// SpecBatchesArgs asks for the PrePrepares a replica executed in (From, To].
+type SpecBatchesArgs struct {
+	From int
+	To   int
+}
+
+type SpecBatchesReply struct {
+	PrePrepares []*PrePrepareArgs
+}
+
+// LocalCommitReply acknowledges a commit certificate.
+type LocalCommitReply struct {
+	Success   bool
+	NodeID    int
+	Signature []byte
+	Auth      Authenticator
+}
+
+type undoEntry struct {
+	key     string
+	value   string
+	existed bool
+}
+
+type speculation struct {
+	executed  int                 // highest sequence number executed speculatively
+	committed int                 // highest sequence number covered by a commit certificate
+	history   map[int]string      // sequence number -> history hash after executing it
+	undo      map[int][]undoEntry // sequence number -> previous values of the keys it wrote
+
+	recording bool // applyCommandLocked is running for a speculative batch
+	current   []undoEntry
+}
+
+func newSpeculation() *speculation {
+	return &speculation{
+		history: make(map[int]string),
+		undo:    make(map[int][]undoEntry),
+	}
+}
+
+// recordUndoLocked saves the current value of key before a speculative write.
+func (p *PBFT) recordUndoLocked(key string) {
+	if p.spec == nil || !p.spec.recording {
+		return
+	}
+	value, existed := p.StateMachine[key]
+	p.spec.current = append(p.spec.current, undoEntry{key: key, value: value, existed: existed})
+}
+
+// speculateLocked executes every PrePrepared batch that directly follows the
+// last one executed. Batches that arrive out of order wait for the gap to fill,
+// and with --disseminate for the batch itself.
+func (p *PBFT) speculateLocked() {
+	for {
+		seq := p.spec.executed + 1
+		state, ok := p.reqState[seq]
+		if !ok || state.PrePrepareMsg == nil {
+			return
+		}
+		command := p.batchLocked(state.PrePrepareMsg)
+		if command == nil {
+			p.fetchBatchLocked(state.PrePrepareMsg.Digest)
+			return
+		}
+		p.executeSpeculativeLocked(seq, state.PrePrepareMsg, command)
+	}
+}
+
+func (p *PBFT) executeSpeculativeLocked(seq int, pp *PrePrepareArgs, command []byte) {
+	if seq > p.sequenceNumber {
+		p.sequenceNumber = seq
+	}
+
+	p.spec.recording = true
+	value := p.applyBatchLocked(command)
+	p.spec.undo[seq] = p.spec.current
+	p.spec.recording = false
+	p.spec.current = nil
+
+	history := digestHistory(p.spec.history[seq-1], pp.Digest)
+	p.spec.history[seq] = history
+	p.spec.executed = seq
+	p.lastExecuted = seq
+	p.logPutLocked(LogSpeculative, slog.LevelDebug, "Executed speculatively", "seq", seq)
+
+	args := &SpecReplyArgs{
+		View:           pp.View,
+		SequenceNumber: seq,
+		Digest:         pp.Digest,
+		History:        history,
+		NodeID:         p.id,
+		Value:          value,
+	}
+	sig, auth, err := p.signMessage(digestSpecReply(pp.View, seq, pp.Digest, history, p.id, value))
+	if err != nil {
+		p.logPutLocked(LogSpeculative, slog.LevelError, "Error signing SpecReply", "seq", seq, "err", err)
+		return
+	}
+	args.Signature = sig
+	args.Auth = auth
+
+	primaryID := p.memberAt(pp.View)
+	if primaryID == p.id {
+		p.handleSpecReplyLocked(args)
+		return
+	}
+	go func(target int, a *SpecReplyArgs) {
+		reply := &SpecReplyReply{}
+		p.sendRPC(target, RPCSpecReply, a, reply)
+	}(primaryID, args)
+}
+
+// rollbackLocked undoes speculative batches until to is the last one executed.
+// Committed batches have no undo log, so to must not be below spec.committed.
+func (p *PBFT) rollbackLocked(to int) {
+	for seq := p.spec.executed; seq > to; seq-- {
+		entries := p.spec.undo[seq]
+		for i := len(entries) - 1; i >= 0; i-- {
+			e := entries[i]
+			if e.existed {
+				p.StateMachine[e.key] = e.value
+			} else {
+				delete(p.StateMachine, e.key)
+			}
+		}
+		delete(p.spec.undo, seq)
+		delete(p.spec.history, seq)
+	}
+	p.spec.executed = to
+	p.lastExecuted = to
+}
+
+// commitSpeculativeLocked marks everything up to seq as committed. A history hash
+// covers the whole prefix, so a certificate for seq commits all earlier batches too.
+// Only the history hash at seq is kept, to chain the next batch onto.
+func (p *PBFT) commitSpeculativeLocked(seq int) {
+	for s := p.spec.committed + 1; s <= seq; s++ {
+		delete(p.spec.undo, s)
+		delete(p.spec.history, s-1)
+		if state, ok := p.reqState[s]; ok {
+			state.Prepared = true
+			state.Committed = true
+		}
+	}
+	if seq > p.spec.committed {
+		p.spec.committed = seq
+	}
+}
+
+// SpecReply collects speculative replies at the client.
+func (p *PBFT) SpecReply(args *SpecReplyArgs, reply *SpecReplyReply) error {
+	err := p.verifier.Verify(func() error {
+		data := digestSpecReply(args.View, args.SequenceNumber, args.Digest, args.History, args.NodeID, args.Value)
+		return p.verifyMessage(args.NodeID, data, args.Signature, args.Auth)
+	})
+	if err != nil {
+		p.logPut(LogSpeculative, slog.LevelWarn, "Signature verification failed for SpecReply", "peer", args.NodeID, "seq", args.SequenceNumber, "err", err)
+		reply.Success = false
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.isPrimary() {
+		reply.Success = false
+		return nil
+	}
+	p.handleSpecReplyLocked(args)
+	reply.Success = true
+	return nil
+}
+
+func specRepliesMatch(a, b *SpecReplyArgs) bool {
+	return a.View == b.View && a.Digest == b.Digest && a.History == b.History && a.Value == b.Value
+}
+
+func (p *PBFT) handleSpecReplyLocked(args *SpecReplyArgs) {
+	seq := args.SequenceNumber
+	state := p.getRequestState(seq)
+	if state.ReplySent {
+		return
+	}
+	// A replica that rolled back replies again for the same batch
+	state.SpecReplies[args.NodeID] = args
+
+	count := 0
+	for _, r := range state.SpecReplies {
+		if specRepliesMatch(r, args) {
+			count++
+		}
+	}
+
+	// The fast path needs every replica, 3f+1 when N = 3f+1
+	if count >= p.replicas().clusterSize {
+		p.logPutLocked(LogSpeculative, slog.LevelDebug, "Client received matching speculative replies, returning to app", "seq", seq, "replies", count)
+		p.deliverRepliesLocked(state, seq, args.Value)
+		if seq%SPEC_CHECKPOINT_INTERVAL == 0 {
+			if cert := p.commitCertificateLocked(state); cert != nil {
+				go p.broadcastCommitCertificate(cert)
+			}
+		}
+		return
+	}
+	if count >= p.quorumSize() && !state.SpecTimerArmed {
+		state.SpecTimerArmed = true
+		time.AfterFunc(SPEC_REPLY_TIMEOUT, func() { p.onSpecReplyTimeout(seq, 1) })
+	}
+}
+
+// commitCertificateLocked returns a certificate built from the largest set of
+// matching replies, or nil if no 2f+1 of them match the primary's PrePrepare.
+func (p *PBFT) commitCertificateLocked(state *RequestState) *CommitCertificate {
+	pp := state.PrePrepareMsg
+	if pp == nil {
+		return nil
+	}
+	var best []*SpecReplyArgs
+	for _, candidate := range state.SpecReplies {
+		if candidate.View != pp.View || candidate.Digest != pp.Digest {
+			continue
+		}
+		var group []*SpecReplyArgs
+		for _, r := range state.SpecReplies {
+			if specRepliesMatch(r, candidate) {
+				group = append(group, r)
+			}
+		}
+		if len(group) > len(best) {
+			best = group
+		}
+	}
+	if len(best) < p.quorumSize() {
+		return nil
+	}
+	sort.Slice(best, func(i, j int) bool { return best[i].NodeID < best[j].NodeID })
+	return &CommitCertificate{PrePrepare: pp, History: best[0].History, Replies: best}
+}
+
+// onSpecReplyTimeout runs when a request has 2f+1 matching replies but not 3f+1
+// after SPEC_REPLY_TIMEOUT, and falls back to the commit-certificate phase.
+func (p *PBFT) onSpecReplyTimeout(seq int, attempt int) {
+	p.mu.Lock()
+	state := p.getRequestState(seq)
+	if state.ReplySent {
+		p.mu.Unlock()
+		return
+	}
+	cert := p.commitCertificateLocked(state)
+	if cert == nil {
+		p.mu.Unlock()
+		return
+	}
+	state.SpecValue = cert.Replies[0].Value
+	p.logPutLocked(LogSpeculative, slog.LevelWarn, "Speculative replies disagree, sending commit certificate", "seq", seq, "matching", len(cert.Replies), "replicas", p.replicas().clusterSize)
+	p.mu.Unlock()
+
+	p.broadcastCommitCertificate(cert)
+
+	// Replicas that were still behind can acknowledge a later copy
+	if attempt < SPEC_COMMIT_RETRIES {
+		time.AfterFunc(SPEC_REPLY_TIMEOUT<<attempt, func() { p.onSpecReplyTimeout(seq, attempt+1) })
+	}
+}
+
+// broadcastCommitCertificate sends cert to every replica, including this one,
+// and counts their LocalCommits.
+func (p *PBFT) broadcastCommitCertificate(cert *CommitCertificate) {
+	pp := cert.PrePrepare
+	for peerID := range p.replicas().peerIPPort {
+		go func(target int) {
+			reply := &LocalCommitReply{}
+			if target == p.id {
+				p.SpecCommit(cert, reply)
+			} else if !p.sendRPC(target, RPCSpecCommit, cert, reply) {
+				return
+			}
+			if !reply.Success {
+				return
+			}
+			data := digestLocalCommit(pp.View, pp.SequenceNumber, pp.Digest, cert.History, target)
+			if err := p.verifyMessage(target, data, reply.Signature, reply.Auth); err != nil {
+				p.logPut(LogSpeculative, slog.LevelWarn, "Signature verification failed for LocalCommit", "peer", target, "seq", pp.SequenceNumber, "err", err)
+				return
+			}
+
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.addLocalCommitLocked(pp.SequenceNumber, target)
+		}(peerID)
+	}
+}
+
+func (p *PBFT) addLocalCommitLocked(seq int, nodeID int) {
+	state := p.getRequestState(seq)
+	if state.ReplySent {
+		return
+	}
+	state.LocalCommits[nodeID] = true
+	if len(state.LocalCommits) >= p.quorumSize() {
+		p.logPutLocked(LogSpeculative, slog.LevelDebug, "Client received LocalCommits, returning to app", "seq", seq, "count", len(state.LocalCommits))
+		p.deliverRepliesLocked(state, seq, state.SpecValue)
+	}
+}
+
+// verifyCommitCertificate checks the PrePrepare and 2f+1 matching replies from
+// distinct replicas.
+func (p *PBFT) verifyCommitCertificate(cert *CommitCertificate) error {
+	pp := cert.PrePrepare
+	if pp == nil || len(cert.Replies) == 0 {
+		return fmt.Errorf("certificate has no PrePrepare or replies")
+	}
+	primaryID := p.memberAt(pp.View)
+	if err := p.verifyMessage(primaryID, digestPrePrepare(pp.View, pp.SequenceNumber, pp.Digest, pp.Command), pp.Signature, pp.Auth); err != nil {
+		return fmt.Errorf("PrePrepare: %v", err)
+	}
+	if err := p.checkPayload(pp); err != nil {
+		return fmt.Errorf("PrePrepare %v", err)
+	}
+
+	senders := make(map[int]bool)
+	for _, r := range cert.Replies {
+		if r.View != pp.View || r.SequenceNumber != pp.SequenceNumber || r.Digest != pp.Digest || r.History != cert.History || r.Value != cert.Replies[0].Value {
+			return fmt.Errorf("reply from %d does not match the certificate", r.NodeID)
+		}
+		if senders[r.NodeID] {
+			continue
+		}
+		data := digestSpecReply(r.View, r.SequenceNumber, r.Digest, r.History, r.NodeID, r.Value)
+		if err := p.verifyMessage(r.NodeID, data, r.Signature, r.Auth); err != nil {
+			return fmt.Errorf("reply from %d: %v", r.NodeID, err)
+		}
+		senders[r.NodeID] = true
+	}
+	if len(senders) < p.quorumSize() {
+		return fmt.Errorf("only %d valid replies, need %d", len(senders), p.quorumSize())
+	}
+	return nil
+}
+
+// SpecCommit handles a commit certificate from the client. The replica rolls
+// back if it speculated differently, commits, and acknowledges with a
+// LocalCommit if its history now matches the certificate.
+func (p *PBFT) SpecCommit(args *CommitCertificate, reply *LocalCommitReply) error {
+	if err := p.verifier.Verify(func() error { return p.verifyCommitCertificate(args) }); err != nil {
+		p.logPut(LogSpeculative, slog.LevelWarn, "Invalid commit certificate", "err", err)
+		reply.Success = false
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pp := args.PrePrepare
+	seq := pp.SequenceNumber
+	if pp.View != p.view {
+		reply.Success = false
+		return nil
+	}
+
+	if seq < p.spec.committed {
+		// A late certificate, for a batch a later one committed already. Its
+		// history hash is pruned, so it has to name the batch executed there.
+		state, ok := p.reqState[seq]
+		if !ok || state.PrePrepareMsg == nil || state.PrePrepareMsg.Digest != pp.Digest {
+			p.logPutLocked(LogSpeculative, slog.LevelWarn, "Commit certificate does not match the committed batch", "seq", seq)
+			reply.Success = false
+			return nil
+		}
+		return p.localCommitLocked(args, reply)
+	}
+
+	if p.spec.executed >= seq && p.spec.history[seq] != args.History {
+		if seq <= p.spec.committed {
+			p.logPutLocked(LogSpeculative, slog.LevelError, "Commit certificate conflicts with committed history", "seq", seq)
+			reply.Success = false
+			return nil
+		}
+		p.logPutLocked(LogSpeculative, slog.LevelWarn, "Speculative history does not match the commit certificate, rolling back", "seq", seq, "batches", p.spec.executed-seq+1)
+		p.rollbackLocked(seq - 1)
+	}
+
+	if p.spec.executed < seq {
+		// Adopt the certified batch in case we hold a different one, then catch up
+		state := p.getRequestState(seq)
+		if state.PrePrepareMsg == nil || state.PrePrepareMsg.Digest != pp.Digest {
+			if len(pp.Command) > 0 {
+				if err := p.storage.AppendEntry(LogEntry{View: pp.View, Command: pp.Command}); err != nil {
+					p.logPutLocked(LogSpeculative, slog.LevelError, "Failed to append to log", "seq", seq, "err", err)
+					reply.Success = false
+					return nil
+				}
+			}
+			state.PrePrepared = true
+			state.PrePrepareMsg = pp
+			p.orderBatchLocked(pp)
+		}
+		p.speculateLocked()
+	}
+
+	// An earlier batch differs as well
+	if p.spec.executed >= seq && p.spec.history[seq] != args.History {
+		if !p.repairHistoryLocked(args) {
+			reply.Success = false
+			return nil
+		}
+		p.speculateLocked()
+	}
+
+	// Still missing earlier batches
+	if p.spec.history[seq] != args.History {
+		reply.Success = false
+		return nil
+	}
+	p.commitSpeculativeLocked(seq)
+	return p.localCommitLocked(args, reply)
+}
+
+// repairHistoryLocked rolls back to the first batch after the committed prefix
+// where our history leaves the certified one, and adopts the certified batches
+// from there. It releases p.mu while it fetches them.
+func (p *PBFT) repairHistoryLocked(cert *CommitCertificate) bool {
+	seq := cert.PrePrepare.SequenceNumber
+	from := p.spec.committed
+	base := p.spec.history[from]
+	p.mu.Unlock()
+	pps := p.fetchCertifiedBatches(cert, from, base)
+	p.mu.Lock()
+	if pps == nil || p.spec.committed != from {
+		return false
+	}
+
+	first := seq + 1
+	history := base
+	for i, pp := range pps {
+		s := from + 1 + i
+		history = digestHistory(history, pp.Digest)
+		if s > p.spec.executed || p.spec.history[s] != history {
+			first = s
+			break
+		}
+	}
+	if first > seq {
+		// Repaired while we were fetching
+		return true
+	}
+	p.logPutLocked(LogSpeculative, slog.LevelWarn, "An earlier batch differs from the certified history, rolling back further", "seq", seq, "from", first, "batches", p.spec.executed-first+1)
+	p.rollbackLocked(first - 1)
+
+	for _, pp := range pps[first-from-1:] {
+		state := p.getRequestState(pp.SequenceNumber)
+		if state.PrePrepareMsg != nil && state.PrePrepareMsg.Digest == pp.Digest {
+			continue
+		}
+		if len(pp.Command) > 0 {
+			if err := p.storage.AppendEntry(LogEntry{View: pp.View, Command: pp.Command}); err != nil {
+				p.logPutLocked(LogSpeculative, slog.LevelError, "Failed to append to log", "seq", pp.SequenceNumber, "err", err)
+				return false
+			}
+		}
+		state.PrePrepared = true
+		state.PrePrepareMsg = pp
+		p.orderBatchLocked(pp)
+	}
+	return true
+}
+
+// fetchCertifiedBatches asks the replicas that vouched for cert, in turn, for the
+// batches after from, and returns the first answer whose PrePrepares the primary
+// signed and whose history, chained onto base, is the certified one.
+func (p *PBFT) fetchCertifiedBatches(cert *CommitCertificate, from int, base string) []*PrePrepareArgs {
+	seq := cert.PrePrepare.SequenceNumber
+	for _, r := range cert.Replies {
+		if r.NodeID == p.id {
+			continue
+		}
+		reply := &SpecBatchesReply{}
+		if !p.sendRPC(r.NodeID, RPCSpecBatches, &SpecBatchesArgs{From: from, To: seq}, reply) {
+			continue
+		}
+		if err := p.checkCertifiedBatches(reply.PrePrepares, from, base, cert.History); err != nil {
+			p.logPut(LogSpeculative, slog.LevelWarn, "Certified batches do not check out", "peer", r.NodeID, "seq", seq, "err", err)
+			continue
+		}
+		return reply.PrePrepares
+	}
+	p.logPut(LogSpeculative, slog.LevelError, "Could not fetch the certified batches from any replica", "seq", seq)
+	return nil
+}
+
+func (p *PBFT) checkCertifiedBatches(pps []*PrePrepareArgs, from int, base string, certified string) error {
+	history := base
+	for i, pp := range pps {
+		if pp == nil || pp.SequenceNumber != from+1+i {
+			return fmt.Errorf("batch %d is missing", from+1+i)
+		}
+		primaryID := p.memberAt(pp.View)
+		if err := p.verifyMessage(primaryID, digestPrePrepare(pp.View, pp.SequenceNumber, pp.Digest, pp.Command), pp.Signature, pp.Auth); err != nil {
+			return fmt.Errorf("PrePrepare for seq %d: %v", pp.SequenceNumber, err)
+		}
+		if err := p.checkPayload(pp); err != nil {
+			return fmt.Errorf("PrePrepare for seq %d: %v", pp.SequenceNumber, err)
+		}
+		history = digestHistory(history, pp.Digest)
+	}
+	if history != certified {
+		return fmt.Errorf("history does not match the certificate")
+	}
+	return nil
+}
+
+// SpecBatches serves the PrePrepares this replica executed speculatively, for a
+// replica whose history left a certified one.
+func (p *PBFT) SpecBatches(args *SpecBatchesArgs, reply *SpecBatchesReply) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.spec == nil {
+		return fmt.Errorf("node %d does not speculate", p.id)
+	}
+	to := min(args.To, p.spec.executed, args.From+LOG_WINDOW)
+	for s := args.From + 1; s <= to; s++ {
+		state, ok := p.reqState[s]
+		if !ok || state.PrePrepareMsg == nil {
+			break
+		}
+		reply.PrePrepares = append(reply.PrePrepares, state.PrePrepareMsg)
+	}
+	return nil
+}
+
+// localCommitLocked acknowledges a certificate the replica has committed.
+func (p *PBFT) localCommitLocked(args *CommitCertificate, reply *LocalCommitReply) error {
+	pp := args.PrePrepare
+	seq := pp.SequenceNumber
+	sig, auth, err := p.signMessage(digestLocalCommit(pp.View, seq, pp.Digest, args.History, p.id))
+	if err != nil {
+		p.logPutLocked(LogSpeculative, slog.LevelError, "Error signing LocalCommit", "seq", seq, "err", err)
+		reply.Success = false
+		return nil
+	}
+	reply.Success = true
+	reply.NodeID = p.id
+	reply.Signature = sig
+	reply.Auth = auth
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// newSpeculativeReplica is a replica with no peers connected, so its speculative
+// replies go nowhere.
+func newSpeculativeReplica(t *testing.T, id int, n int) *PBFT {
+	p := newTestReplica(t, id, n, CryptoEd25519)
+	p.speculative = true
+	p.spec = newSpeculation()
+	p.reqState = make(map[int]*RequestState)
+	p.StateMachine = make(map[string]string)
+	p.pendingResponses = make(map[int][]chan Response)
+	p.verifier = NewVerifier(1)
+	p.conns = NewConnManager(p)
+
+	t.Chdir(t.TempDir())
+	storage, err := NewStorage(id, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.storage = storage
+	return p
+}
+
+// serveSpeculative has replicas 1-3 serve RPC and connects replica 4 to them.
+func serveSpeculative(t *testing.T, replicas map[int]*PBFT) {
+	addrs := make(map[int]string)
+	for id := range replicas {
+		addrs[id] = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	}
+	for id, p := range replicas {
+		rs := *p.replicas()
+		rs.peerIPPort = addrs
+		p.replicaSet.Store(&rs)
+		if id != 4 {
+			go p.listenRPC()
+		}
+	}
+	p := replicas[4]
+	for id := 1; id <= 3; id++ {
+		p.conns.Start(id)
+		t.Cleanup(func() { p.conns.Stop(id) })
+		waitFor(t, fmt.Sprintf("node %d", id), DIAL_TIMEOUT, func() bool { return p.conns.IsUp(id) })
+	}
+}
+
+func signedPrePrepare(t *testing.T, primary *PBFT, seq int, cmds ...string) *PrePrepareArgs {
+	batch := make([][]byte, len(cmds))
+	for i, cmd := range cmds {
+		batch[i] = []byte(cmd)
+	}
+	command := encodeBatch(batch)
+	digest := hash(command)
+	sig, auth, err := primary.signMessage(digestPrePrepare(0, seq, digest, command))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &PrePrepareArgs{View: 0, SequenceNumber: seq, Digest: digest, Command: command, Signature: sig, Auth: auth}
+}
+
+// A replica that executed a different batch than the one a commit certificate
+// vouches for must roll back and converge on the certified state.
+func TestSpeculativeRollback(t *testing.T) {
+	replicas := make(map[int]*PBFT)
+	for id := 1; id <= 4; id++ {
+		replicas[id] = newSpeculativeReplica(t, id, 4)
+	}
+	first := signedPrePrepare(t, replicas[1], 1, "SET a 1", "SET b 1")
+	good := signedPrePrepare(t, replicas[1], 2, "SET b 2")
+	bad := signedPrePrepare(t, replicas[1], 2, "DELETE a", "SET c 3")
+
+	execute := func(p *PBFT, pps ...*PrePrepareArgs) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for _, pp := range pps {
+			state := p.getRequestState(pp.SequenceNumber)
+			state.PrePrepared = true
+			state.PrePrepareMsg = pp
+		}
+		p.speculateLocked()
+	}
+	for id := 1; id <= 3; id++ {
+		execute(replicas[id], first, good)
+	}
+	execute(replicas[4], first, bad)
+
+	if _, ok := replicas[4].StateMachine["c"]; !ok {
+		t.Fatalf("replica 4 did not execute speculatively")
+	}
+
+	// The client's side: replies from 1-3, which agree
+	certify := func(pp *PrePrepareArgs, value string) *CommitCertificate {
+		seq := pp.SequenceNumber
+		cert := &CommitCertificate{PrePrepare: pp, History: replicas[1].spec.history[seq]}
+		for id := 1; id <= 3; id++ {
+			p := replicas[id]
+			sig, _, err := p.signMessage(digestSpecReply(0, seq, pp.Digest, p.spec.history[seq], id, value))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert.Replies = append(cert.Replies, &SpecReplyArgs{View: 0, SequenceNumber: seq, Digest: pp.Digest, History: p.spec.history[seq], NodeID: id, Value: value, Signature: sig})
+		}
+		return cert
+	}
+	late := certify(first, encodeBatchResults([]string{"OK", "OK"}))
+	cert := certify(good, encodeBatchResults([]string{"OK"}))
+
+	reply := &LocalCommitReply{}
+	if err := replicas[4].SpecCommit(cert, reply); err != nil || !reply.Success {
+		t.Fatalf("replica 4 did not commit the certificate: %v", err)
+	}
+	want := map[string]string{"a": "1", "b": "2"}
+	if len(replicas[4].StateMachine) != len(want) {
+		t.Fatalf("state after rollback = %v, want %v", replicas[4].StateMachine, want)
+	}
+	for k, v := range want {
+		if replicas[4].StateMachine[k] != v {
+			t.Fatalf("state after rollback = %v, want %v", replicas[4].StateMachine, want)
+		}
+	}
+	if replicas[4].spec.committed != 2 || len(replicas[4].spec.undo) != 0 {
+		t.Fatalf("committed = %d with %d undo logs left, want 2 and 0", replicas[4].spec.committed, len(replicas[4].spec.undo))
+	}
+	if len(replicas[4].spec.history) != 1 || replicas[4].spec.history[2] != cert.History {
+		t.Fatalf("history after commit = %v, want only the committed hash", replicas[4].spec.history)
+	}
+
+	// A certificate that arrives after a later one still gets its LocalCommit
+	reply = &LocalCommitReply{}
+	if err := replicas[4].SpecCommit(late, reply); err != nil || !reply.Success {
+		t.Fatalf("late certificate for seq 1 not acknowledged: %v", err)
+	}
+
+	// Replies for one batch do not certify another
+	cert.PrePrepare = bad
+	reply = &LocalCommitReply{}
+	if err := replicas[4].SpecCommit(cert, reply); err != nil || reply.Success {
+		t.Fatalf("certificate with mismatched replies accepted")
+	}
+	if replicas[4].StateMachine["b"] != "2" {
+		t.Fatalf("a committed batch was rolled back")
+	}
+
+	// Replica 4 took a different batch two before the certified one. Histories
+	// are chained, so re-executing from just before the certified batch cannot
+	// repair it: it takes the certified batches from a replica that vouched for
+	// them and rolls back to where it left them.
+	replicas = make(map[int]*PBFT)
+	for id := 1; id <= 4; id++ {
+		replicas[id] = newSpeculativeReplica(t, id, 4)
+	}
+	serveSpeculative(t, replicas)
+	first = signedPrePrepare(t, replicas[1], 1, "SET a 1")
+	bad = signedPrePrepare(t, replicas[1], 1, "SET a 9", "SET d 4")
+	second := signedPrePrepare(t, replicas[1], 2, "SET b 2")
+	third := signedPrePrepare(t, replicas[1], 3, "SET c 3")
+	for id := 1; id <= 3; id++ {
+		execute(replicas[id], first, second, third)
+	}
+	execute(replicas[4], bad, second, third)
+
+	cert = certify(third, encodeBatchResults([]string{"OK"}))
+	reply = &LocalCommitReply{}
+	if err := replicas[4].SpecCommit(cert, reply); err != nil || !reply.Success {
+		t.Fatalf("replica 4 did not converge on a certificate two batches past its divergence: %v", err)
+	}
+	want = map[string]string{"a": "1", "b": "2", "c": "3"}
+	if fmt.Sprint(replicas[4].StateMachine) != fmt.Sprint(want) {
+		t.Fatalf("state after rollback = %v, want %v", replicas[4].StateMachine, want)
+	}
+	if replicas[4].spec.committed != 3 || replicas[4].spec.history[3] != cert.History {
+		t.Fatalf("committed = %d, want 3 with the certified history", replicas[4].spec.committed)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
-import ()
+import (
+	"log/slog"
+)
 
 func (p *PBFT) applyCommandLocked(command []byte) string {
 	commandStr := string(command)
@@ -15,8 +17,9 @@ func (p *PBFT) applyCommandLocked(command []byte) string {
 		}
 		key := parts[1]
 		value := parts[2]
+		p.recordUndoLocked(key)
 		p.StateMachine[key] = value
-		p.logPutLocked("Applied command to state machine: "+commandStr, GREEN)
+		p.logPutLocked(LogExec, slog.LevelDebug, "Applied command", "command", commandStr)
 		return "OK"
 
 	case "GET":
@@ -30,19 +33,29 @@ func (p *PBFT) applyCommandLocked(command []byte) string {
 		}
 		return val
 
+	case RECONFIG_COMMAND:
+		return p.applyReconfigLocked(parts)
+
 	case "DELETE":
 		if len(parts) != 2 {
 			return "Invalid DELETE"
 		}
 		key := parts[1]
+		p.recordUndoLocked(key)
 		delete(p.StateMachine, key)
-		p.logPutLocked("Applied command to state machine: "+commandStr, GREEN)
+		p.logPutLocked(LogExec, slog.LevelDebug, "Applied command", "command", commandStr)
 		return "OK"
 	default:
 		return "Unknown command"
 	}
 }
 
+// isReadOnly reports whether command leaves the state machine unchanged.
+func isReadOnly(command []byte) bool {
+	parts := splitCommand(string(command))
+	return len(parts) > 0 && parts[0] == "GET"
+}
+
 func splitCommand(command string) []string {
 	var parts []string
 	current := ""
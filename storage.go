@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 )
 
 type Storage struct {
@@ -16,6 +17,7 @@ type Storage struct {
 	logOffsets []int64
 	async      bool
 	inMemory   bool
+	metrics    *metrics
 }
 
 func NewStorage(id int, async bool, inMemory bool) (*Storage, error) {
@@ -90,6 +92,7 @@ func (s *Storage) LoadState() (int, error) {
 }
 
 func (s *Storage) AppendEntry(entry LogEntry) error {
+	start := time.Now()
 	offset, err := s.logFile.Seek(0, io.SeekEnd)
 	if err != nil {
 		return err
@@ -111,12 +114,25 @@ func (s *Storage) AppendEntry(entry LogEntry) error {
 	if err := s.logWriter.Flush(); err != nil {
 		return err
 	}
+	written := time.Now()
 	if !s.async {
-		return s.logFile.Sync()
+		err := s.logFile.Sync()
+		s.metrics.observeWAL(written.Sub(start), time.Since(written), true)
+		return err
 	}
+	s.metrics.observeWAL(written.Sub(start), 0, false)
 	return nil
 }
 
+// Size returns the number of entries in the log and its size in bytes.
+func (s *Storage) Size() (int, int64, error) {
+	info, err := s.logFile.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(s.logOffsets), info.Size(), nil
+}
+
 func (s *Storage) LoadLog() ([]LogEntry, error) {
 	if _, err := s.logFile.Seek(0, 0); err != nil {
 		return nil, err
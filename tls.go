@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// Mutual TLS between replicas. Certificates are not checked against a CA: each
+// node's certificate is pinned in cluster.conf, and a connection is accepted only
+// if the certificate presented is exactly the one pinned for the expected node.
+// The accepting side also derives the caller's node ID from its certificate, so a
+// replica can't claim to be someone else in its hello.
+//
+// Callers without a certificate are allowed to connect, but they only get the
+// client-facing RPC server (see listenRPC).
+
+type tlsSetup struct {
+	self   int
+	cert   *tls.Certificate               // nil for unauthenticated tools
+	pinned atomic.Pointer[map[int][]byte] // node ID -> DER of its certificate
+}
+
+// pins returns the pinned certificates. Handshakes run outside p.mu, so a
+// reconfiguration publishes a new map instead of changing this one.
+func (t *tlsSetup) pins() map[int][]byte {
+	return *t.pinned.Load()
+}
+
+// loadTLS returns nil when no node in the config has a certificate. self == 0
+// loads only the pinned certificates, for tools that talk to the cluster as an
+// unauthenticated client.
+func loadTLS(confPath string, self int, nodes []Node) (*tlsSetup, error) {
+	t := &tlsSetup{self: self}
+	pinned := make(map[int][]byte)
+	for _, node := range nodes {
+		if node.TLSCert == "" {
+			continue
+		}
+		der, err := readCertificate(resolveConfigPath(confPath, node.TLSCert))
+		if err != nil {
+			return nil, fmt.Errorf("node %d: %v", node.ID, err)
+		}
+		pinned[node.ID] = der
+	}
+	if len(pinned) == 0 {
+		return nil, nil
+	}
+	t.pinned.Store(&pinned)
+	if len(pinned) != len(nodes) {
+		return nil, fmt.Errorf("tls_cert must be set for every node or for none")
+	}
+
+	if self == 0 {
+		return t, nil
+	}
+	for _, node := range nodes {
+		if node.ID != self {
+			continue
+		}
+		if node.TLSKey == "" {
+			return nil, fmt.Errorf("node %d has no tls_key", self)
+		}
+		cert, err := tls.LoadX509KeyPair(resolveConfigPath(confPath, node.TLSCert), resolveConfigPath(confPath, node.TLSKey))
+		if err != nil {
+			return nil, err
+		}
+		t.cert = &cert
+		return t, nil
+	}
+	return nil, fmt.Errorf("node %d is not in the config", self)
+}
+
+func readCertificate(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no PEM certificate", path)
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return block.Bytes, nil
+}
+
+// nodeFor returns the node whose pinned certificate is cert, or 0.
+func (t *tlsSetup) nodeFor(cert *x509.Certificate) int {
+	for id, der := range t.pins() {
+		if bytes.Equal(der, cert.Raw) {
+			return id
+		}
+	}
+	return 0
+}
+
+func (t *tlsSetup) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{*t.cert},
+		// The CA chain is irrelevant; VerifyConnection checks the pin.
+		ClientAuth: tls.RequestClientCert,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return nil // unauthenticated client
+			}
+			if t.nodeFor(cs.PeerCertificates[0]) == 0 {
+				return fmt.Errorf("client certificate is not pinned for any node")
+			}
+			return nil
+		},
+	}
+}
+
+func (t *tlsSetup) clientConfig(peerID int) *tls.Config {
+	conf := &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true, // replaced by the pin check below
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 || !bytes.Equal(cs.PeerCertificates[0].Raw, t.pins()[peerID]) {
+				return fmt.Errorf("peer %d presented a certificate that is not pinned for it", peerID)
+			}
+			return nil
+		},
+	}
+	if t.cert != nil {
+		conf.Certificates = []tls.Certificate{*t.cert}
+	}
+	return conf
+}
+
+// peerFromTLS returns the node ID bound to the client certificate of an accepted
+// connection, or 0 if the client did not present one.
+func (t *tlsSetup) peerFromTLS(conn *tls.Conn) int {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return 0
+	}
+	return t.nodeFor(certs[0])
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keygenCluster writes a cluster.conf for n nodes on free local ports and runs
+// `pbft keygen` on it, in a temporary directory.
+func keygenCluster(t *testing.T, n int) string {
+	nodes := make([]Node, n)
+	for i := range nodes {
+		nodes[i] = Node{ID: i + 1, IP: "127.0.0.1", Port: freePort(t)}
+	}
+	data, err := json.Marshal(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	confPath := filepath.Join(t.TempDir(), "cluster.conf")
+	if err := os.WriteFile(confPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := generateClusterKeys(confPath, "keys", false); err != nil {
+		t.Fatalf("keygen: %v", err)
+	}
+	return confPath
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// serveTLSReplica serves node id of confPath the way a started node does.
+func serveTLSReplica(t *testing.T, confPath string, id int) *PBFT {
+	nodes := parseClusterConfig(confPath)
+	p := newTestReplica(t, id, len(nodes), CryptoEd25519)
+	tlsSetup, err := loadTLS(confPath, id, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.tls = tlsSetup
+	rs := *p.replicas()
+	rs.peerIPPort = parseConfig(confPath)
+	p.replicaSet.Store(&rs)
+	go p.listenRPC()
+
+	deadline := time.Now().Add(DIAL_TIMEOUT)
+	for {
+		conn, err := net.Dial("tcp", p.addrOf(id))
+		if err == nil {
+			conn.Close()
+			return p
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node %d is not listening: %v", id, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// caSignedCertificate returns a certificate issued by a fresh CA, valid by
+// every usual rule but pinned nowhere.
+func caSignedCertificate(t *testing.T) tls.Certificate {
+	caPub, caPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pbft test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, caPub, caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err = x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node-1"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, leaf, ca, pub, caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parsed.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		t.Fatalf("test certificate does not verify against its CA: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der, caDER}, PrivateKey: priv}
+}
+
+// A certificate counts only if it is the one pinned for the node: a CA
+// signature does not make it acceptable, on either side of a connection.
+func TestTLSRejectsUnpinnedCertificate(t *testing.T) {
+	confPath := keygenCluster(t, 4)
+	p := serveTLSReplica(t, confPath, 1)
+	rogue := caSignedCertificate(t)
+
+	// As a client of a replica
+	conn, err := tls.Dial("tcp", p.addrOf(1), &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{rogue},
+	})
+	if err == nil {
+		err = writeHello(conn, 2)
+		if err == nil {
+			var reply GetStateChecksumReply
+			err = rpc.NewClient(conn).Call("PBFT.GetStateChecksum", &GetStateChecksumArgs{}, &reply)
+		}
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatalf("replica accepted a client certificate that is not pinned")
+	}
+
+	// As a replica dialed by another
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{MinVersion: tls.VersionTLS13, Certificates: []tls.Certificate{rogue}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	if conn, err := dialConn(l.Addr().String(), p.tls, 2); err == nil {
+		conn.Close()
+		t.Fatalf("dialed a peer whose certificate is not pinned for it")
+	}
+}
+
+// A replica may only claim, in its hello, the node ID its certificate is
+// pinned to.
+func TestTLSRejectsHelloForAnotherNode(t *testing.T) {
+	confPath := keygenCluster(t, 4)
+	p := serveTLSReplica(t, confPath, 1)
+	nodes := parseClusterConfig(confPath)
+	node2, err := loadTLS(confPath, 2, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(hello int) error {
+		conn, err := dialConn(p.addrOf(1), node2, 1)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if err := writeHello(conn, hello); err != nil {
+			return err
+		}
+		var reply GetStateChecksumReply
+		return rpc.NewClient(conn).Call("PBFT.GetStateChecksum", &GetStateChecksumArgs{}, &reply)
+	}
+	if err := call(2); err != nil {
+		t.Fatalf("node 2 rejected as itself: %v", err)
+	}
+	if err := call(3); err == nil {
+		t.Fatalf("node 2 was accepted as node 3")
+	}
+}
+
+// Callers without a certificate reach the Client service and nothing else.
+func TestTLSUnauthenticatedClient(t *testing.T) {
+	confPath := keygenCluster(t, 4)
+	serveTLSReplica(t, confPath, 2)
+
+	client, err := dialNode(confPath, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Node 2 is a backup, so the request is refused by the service itself
+	err = client.Call("Client.Request", &ClientRequestArgs{Command: []byte("GET k")}, &ClientRequestReply{})
+	if err == nil || !strings.Contains(err.Error(), "not the primary") {
+		t.Fatalf("Client.Request: got %v, want a redirect to the primary", err)
+	}
+	if err := client.Call("PBFT.GetStateChecksum", &GetStateChecksumArgs{}, &GetStateChecksumReply{}); err == nil {
+		t.Fatalf("unauthenticated client called PBFT.GetStateChecksum")
+	}
+	if err := client.Call("PBFT.ClientReply", &ClientReplyArgs{NodeID: 1}, &ClientReplyReply{}); err == nil {
+		t.Fatalf("unauthenticated client called PBFT.ClientReply")
+	}
+
+	// The same calls with a node certificate
+	admin, err := dialNode(confPath, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	if err := admin.Call("PBFT.GetStateChecksum", &GetStateChecksumArgs{}, &GetStateChecksumReply{}); err != nil {
+		t.Fatalf("node 1 could not call PBFT.GetStateChecksum: %v", err)
+	}
+}
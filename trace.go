@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Per-sequence phase tracing. With --trace every node stamps the phase
+// transitions of a sequence number in its RequestState and, once it has executed
+// the batch (and answered the clients, on the node that has them), appends one
+// JSON line to its trace file. `pbft trace` merges the files of all nodes into a
+// latency breakdown per phase and a timeline of the slowest sequence numbers
+// (see trace_report.go).
+//
+// Timestamps are wall-clock, so phases measured across nodes (the PrePrepare
+// fan-out, the reply aggregation) are only as good as the clock sync between
+// the machines.
+
+type tracePoint int
+
+const (
+	TraceBatched     tracePoint = iota // the oldest request of the batch was queued
+	TraceProposed                      // the primary sent its PrePrepare
+	TracePrePrepared                   // a backup accepted the PrePrepare
+	TracePrepared
+	TraceCommitted
+	TraceExecuted
+	TraceReplied // f+1 matching replies reached the client
+	TRACE_POINTS
+)
+
+var traceNames = [TRACE_POINTS]string{"batched", "proposed", "preprepared", "prepared", "committed", "executed", "replied"}
+
+// metricPhases names the pbft_phase_duration_seconds phase that ends at a point.
+var metricPhases = map[tracePoint]string{
+	TracePrepared:  "prepare",
+	TraceCommitted: "commit",
+	TraceExecuted:  "execute",
+}
+
+const (
+	TRACE_BUFFER         = 4096 // records waiting to be written before new ones are dropped
+	TRACE_FLUSH_INTERVAL = 100 * time.Millisecond
+)
+
+// TraceRecord is what one node saw of one sequence number.
+type TraceRecord struct {
+	Node  int              `json:"node"`
+	Seq   int              `json:"seq"`
+	View  int              `json:"view"`
+	Times map[string]int64 `json:"times"` // point -> Unix nanoseconds
+}
+
+type tracer struct {
+	records chan TraceRecord
+	logging *logging
+}
+
+// newTracer truncates path and appends records to it in the background.
+func newTracer(path string, logging *logging) (*tracer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	t := &tracer{records: make(chan TraceRecord, TRACE_BUFFER), logging: logging}
+	go t.run(f)
+	return t, nil
+}
+
+// run writes records as they come and flushes them every TRACE_FLUSH_INTERVAL,
+// so the file is usable while the node is still running.
+func (t *tracer) run(f *os.File) {
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	ticker := time.NewTicker(TRACE_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case rec := <-t.records:
+			if err := enc.Encode(rec); err != nil {
+				t.logging.log(LogMetrics, slog.LevelError, "Failed to write trace", "err", err)
+			}
+		case <-ticker.C:
+			w.Flush()
+		}
+	}
+}
+
+// markLocked stamps point for a sequence number now.
+func (p *PBFT) markLocked(state *RequestState, point tracePoint) {
+	p.markAtLocked(state, point, time.Now())
+}
+
+// markAtLocked stamps point at t unless it was reached before, and records the
+// phase it ends in the metrics.
+func (p *PBFT) markAtLocked(state *RequestState, point tracePoint, t time.Time) {
+	if p.tracer == nil && p.metrics == nil {
+		return
+	}
+	if !state.Trace[point].IsZero() {
+		return
+	}
+	state.Trace[point] = t
+	phase, ok := metricPhases[point]
+	if !ok {
+		return
+	}
+	for prev := point - 1; prev >= 0; prev-- {
+		if !state.Trace[prev].IsZero() {
+			p.metrics.observePhase(phase, t.Sub(state.Trace[prev]))
+			return
+		}
+	}
+}
+
+// traceDoneLocked emits the trace of seq once it is complete: executed here and,
+// if our clients wait on it, answered.
+func (p *PBFT) traceDoneLocked(seq int, state *RequestState) {
+	if p.tracer == nil || state.Trace[TraceExecuted].IsZero() {
+		return
+	}
+	if _, waiting := p.pendingResponses[seq]; waiting && state.Trace[TraceReplied].IsZero() {
+		return
+	}
+	rec := TraceRecord{Node: p.id, Seq: seq, View: p.view, Times: make(map[string]int64)}
+	for point, t := range state.Trace {
+		if !t.IsZero() {
+			rec.Times[traceNames[point]] = t.UnixNano()
+		}
+	}
+	select {
+	case p.tracer.records <- rec:
+	default:
+		p.logPutLocked(LogMetrics, slog.LevelWarn, "Trace buffer full, dropping", "seq", seq)
+	}
+}
+
+// oldestQueued returns when the first request of a batch was queued, or zero if
+// none records it.
+func oldestQueued(reqs []ClientRequest) time.Time {
+	var oldest time.Time
+	for _, req := range reqs {
+		if !req.Queued.IsZero() && (oldest.IsZero() || req.Queued.Before(oldest)) {
+			oldest = req.Queued
+		}
+	}
+	return oldest
+}
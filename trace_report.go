@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The `pbft trace` report: trace files of all nodes are merged by sequence
+// number and every sequence number is broken down into
+//
+//	batching    first request queued -> PrePrepare sent, on the primary
+//	preprepare  PrePrepare sent -> accepted, median over the backups (fan-out)
+//	prepare     PrePrepare -> prepared, median over the nodes
+//	commit      prepared -> committed, median over the nodes
+//	execute     committed -> executed, median over the nodes
+//	reply       f+1-th execution -> f+1 matching replies at the client
+//	total       first request queued -> replies (or last execution)
+
+var reportPhases = []string{"batching", "preprepare", "prepare", "commit", "execute", "reply", "total"}
+
+// timelineMarks are the letters a timeline draws for each point.
+var timelineMarks = [TRACE_POINTS]byte{'B', 'S', 'R', 'P', 'C', 'E', 'A'}
+
+const TIMELINE_WIDTH = 60
+
+// seqTrace is every node's record of one sequence number.
+type seqTrace struct {
+	seq   int
+	nodes map[int]TraceRecord
+}
+
+// LoadTraces reads the records of one or more trace files.
+func LoadTraces(paths []string) ([]TraceRecord, error) {
+	var records []TraceRecord
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			var rec TraceRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			records = append(records, rec)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// mergeTraces groups records by sequence number, in order.
+func mergeTraces(records []TraceRecord) []*seqTrace {
+	bySeq := make(map[int]*seqTrace)
+	for _, rec := range records {
+		s, ok := bySeq[rec.Seq]
+		if !ok {
+			s = &seqTrace{seq: rec.Seq, nodes: make(map[int]TraceRecord)}
+			bySeq[rec.Seq] = s
+		}
+		s.nodes[rec.Node] = rec
+	}
+	seqs := make([]*seqTrace, 0, len(bySeq))
+	for _, s := range bySeq {
+		seqs = append(seqs, s)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i].seq < seqs[j].seq })
+	return seqs
+}
+
+func (s *seqTrace) ids() []int {
+	ids := make([]int, 0, len(s.nodes))
+	for id := range s.nodes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// with returns the lowest node ID that reached point, or 0.
+func (s *seqTrace) with(point tracePoint) int {
+	for _, id := range s.ids() {
+		if _, ok := s.nodes[id].Times[traceNames[point]]; ok {
+			return id
+		}
+	}
+	return 0
+}
+
+func (s *seqTrace) at(id int, point tracePoint) (int64, bool) {
+	t, ok := s.nodes[id].Times[traceNames[point]]
+	return t, ok
+}
+
+// span collects, over the nodes, the time from the first point each reached to to.
+func (s *seqTrace) span(to tracePoint, from ...tracePoint) []time.Duration {
+	var ds []time.Duration
+	for _, id := range s.ids() {
+		end, ok := s.at(id, to)
+		if !ok {
+			continue
+		}
+		for _, point := range from {
+			if start, ok := s.at(id, point); ok {
+				ds = append(ds, time.Duration(end-start))
+				break
+			}
+		}
+	}
+	return ds
+}
+
+// breakdown returns how long the sequence number spent in each phase it has
+// data for.
+func (s *seqTrace) breakdown() map[string]time.Duration {
+	phases := make(map[string]time.Duration)
+	addMedian := func(phase string, ds []time.Duration) {
+		if len(ds) > 0 {
+			sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+			phases[phase] = ds[(len(ds)-1)/2]
+		}
+	}
+
+	start, hasStart := int64(0), false
+	if primary := s.with(TraceProposed); primary != 0 {
+		proposed, _ := s.at(primary, TraceProposed)
+		start, hasStart = proposed, true
+		if batched, ok := s.at(primary, TraceBatched); ok {
+			phases["batching"] = time.Duration(proposed - batched)
+			start = batched
+		}
+		var fanout []time.Duration
+		for _, id := range s.ids() {
+			if accepted, ok := s.at(id, TracePrePrepared); ok && id != primary {
+				fanout = append(fanout, time.Duration(accepted-proposed))
+			}
+		}
+		addMedian("preprepare", fanout)
+	}
+	addMedian("prepare", s.span(TracePrepared, TracePrePrepared, TraceProposed))
+	addMedian("commit", s.span(TraceCommitted, TracePrepared))
+	addMedian("execute", s.span(TraceExecuted, TraceCommitted))
+
+	var executed []int64
+	for _, id := range s.ids() {
+		if t, ok := s.at(id, TraceExecuted); ok {
+			executed = append(executed, t)
+		}
+	}
+	sort.Slice(executed, func(i, j int) bool { return executed[i] < executed[j] })
+	end, hasEnd := int64(0), len(executed) > 0
+	if hasEnd {
+		end = executed[len(executed)-1]
+	}
+	if client := s.with(TraceReplied); client != 0 {
+		replied, _ := s.at(client, TraceReplied)
+		f := maxFaulty(len(s.nodes))
+		if len(executed) > f {
+			phases["reply"] = time.Duration(replied - executed[f])
+		}
+		end, hasEnd = replied, true
+	}
+	if hasStart && hasEnd {
+		phases["total"] = time.Duration(end - start)
+	}
+	return phases
+}
+
+// writeTraceReport prints the latency breakdown of seqs, then the timelines of
+// the slowest sequence numbers and of those listed in show.
+func writeTraceReport(w io.Writer, seqs []*seqTrace, slowest int, show []int) {
+	nodes := make(map[int]bool)
+	samples := make(map[string][]time.Duration)
+	totals := make(map[int]time.Duration)
+	for _, s := range seqs {
+		for id := range s.nodes {
+			nodes[id] = true
+		}
+		for phase, d := range s.breakdown() {
+			samples[phase] = append(samples[phase], d)
+			if phase == "total" {
+				totals[s.seq] = d
+			}
+		}
+	}
+	fmt.Fprintf(w, "%d sequence numbers traced on %d nodes\n\n", len(seqs), len(nodes))
+
+	fmt.Fprintf(w, "%-12s %8s %10s %10s %10s %10s\n", "phase", "count", "mean(ms)", "p50(ms)", "p99(ms)", "max(ms)")
+	for _, phase := range reportPhases {
+		ds := samples[phase]
+		if len(ds) == 0 {
+			continue
+		}
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		var sum time.Duration
+		for _, d := range ds {
+			sum += d
+		}
+		fmt.Fprintf(w, "%-12s %8d %10.3f %10.3f %10.3f %10.3f\n", phase, len(ds),
+			millis(sum/time.Duration(len(ds))), millis(percentile(ds, 0.50)), millis(percentile(ds, 0.99)), millis(ds[len(ds)-1]))
+	}
+
+	// Slowest first, then the requested ones
+	order := make([]*seqTrace, 0, len(totals))
+	for _, s := range seqs {
+		if _, ok := totals[s.seq]; ok {
+			order = append(order, s)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return totals[order[i].seq] > totals[order[j].seq] })
+	if slowest < len(order) {
+		order = order[:slowest]
+	}
+	bySeq := make(map[int]*seqTrace, len(seqs))
+	for _, s := range seqs {
+		bySeq[s.seq] = s
+	}
+	for _, seq := range show {
+		if s, ok := bySeq[seq]; ok {
+			order = append(order, s)
+		} else {
+			fmt.Fprintf(w, "\nseq %d was not traced\n", seq)
+		}
+	}
+	if len(order) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "\nTimelines (")
+	for point, name := range traceNames {
+		if point > 0 {
+			fmt.Fprintf(w, ", ")
+		}
+		fmt.Fprintf(w, "%c %s", timelineMarks[point], name)
+	}
+	fmt.Fprintf(w, ")\n")
+	for _, s := range order {
+		writeTimeline(w, s)
+	}
+}
+
+// writeTimeline draws one row per node, scaled to the span of the sequence number.
+func writeTimeline(w io.Writer, s *seqTrace) {
+	first, last, seen := int64(0), int64(0), false
+	for _, rec := range s.nodes {
+		for _, t := range rec.Times {
+			if !seen || t < first {
+				first = t
+			}
+			if !seen || t > last {
+				last = t
+			}
+			seen = true
+		}
+	}
+	span := last - first
+	fmt.Fprintf(w, "\nseq %d: %.3fms\n", s.seq, millis(time.Duration(span)))
+	for _, id := range s.ids() {
+		row := []byte(strings.Repeat(".", TIMELINE_WIDTH))
+		var offsets []string
+		for point, name := range traceNames {
+			t, ok := s.nodes[id].Times[name]
+			if !ok {
+				continue
+			}
+			col := 0
+			if span > 0 {
+				col = int((t - first) * int64(TIMELINE_WIDTH-1) / span)
+			}
+			row[col] = timelineMarks[point]
+			offsets = append(offsets, fmt.Sprintf("%c+%.3f", timelineMarks[point], millis(time.Duration(t-first))))
+		}
+		fmt.Fprintf(w, "  node %-3d |%s| %s\n", id, row, strings.Join(offsets, " "))
+	}
+}
+
+// percentile returns the q-quantile of sorted durations.
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	i := int(q * float64(len(sorted)))
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
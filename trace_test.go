@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceBreakdown(t *testing.T) {
+	ms := func(n int64) int64 { return n * int64(time.Millisecond) }
+	records := []TraceRecord{
+		{Node: 1, Seq: 7, Times: map[string]int64{"batched": 0, "proposed": ms(2), "prepared": ms(5), "committed": ms(7), "executed": ms(8), "replied": ms(11)}},
+		{Node: 2, Seq: 7, Times: map[string]int64{"preprepared": ms(3), "prepared": ms(4), "committed": ms(6), "executed": ms(9)}},
+		{Node: 3, Seq: 7, Times: map[string]int64{"preprepared": ms(4), "prepared": ms(6), "committed": ms(7), "executed": ms(8)}},
+		{Node: 4, Seq: 7, Times: map[string]int64{"preprepared": ms(6), "prepared": ms(7), "committed": ms(9), "executed": ms(12)}},
+	}
+	seqs := mergeTraces(records)
+	if len(seqs) != 1 {
+		t.Fatalf("merged into %d sequence numbers, want 1", len(seqs))
+	}
+	got := seqs[0].breakdown()
+	want := map[string]time.Duration{
+		"batching":   2 * time.Millisecond,
+		"preprepare": 2 * time.Millisecond, // median of 1, 2, 4
+		"prepare":    1 * time.Millisecond, // median of 3, 1, 2, 1
+		"commit":     2 * time.Millisecond,
+		"execute":    1 * time.Millisecond, // median of 1, 3, 1, 3
+		"reply":      3 * time.Millisecond, // replied at 11, second execution at 8
+		"total":      11 * time.Millisecond,
+	}
+	for phase, d := range want {
+		if got[phase] != d {
+			t.Errorf("%s = %v, want %v", phase, got[phase], d)
+		}
+	}
+
+	var buf bytes.Buffer
+	writeTraceReport(&buf, seqs, 1, nil)
+	out := buf.String()
+	for _, s := range []string{"1 sequence numbers traced on 4 nodes", "\nseq 7: 12.000ms\n", "node 1   |B"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("report is missing %q:\n%s", s, out)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"runtime"
+)
+
+// Incoming messages are authenticated before they reach the consensus state
+// machine, and without holding p.mu: a fixed pool of workers checks signatures
+// concurrently, and each RPC handler waits for its own result before taking the
+// lock. The queue is bounded, so when verification falls behind, handlers block
+// here instead of piling up unbounded work.
+
+const VERIFY_QUEUE_SIZE = 4096
+
+type verifyJob struct {
+	check  func() error
+	result chan error
+}
+
+type Verifier struct {
+	jobs chan verifyJob
+}
+
+// NewVerifier starts workers verification goroutines (one per CPU if workers <= 0).
+func NewVerifier(workers int) *Verifier {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	v := &Verifier{jobs: make(chan verifyJob, VERIFY_QUEUE_SIZE)}
+	for i := 0; i < workers; i++ {
+		go v.worker()
+	}
+	return v
+}
+
+func (v *Verifier) worker() {
+	for job := range v.jobs {
+		job.result <- job.check()
+	}
+}
+
+// Verify runs check on the pool and returns its error.
+func (v *Verifier) Verify(check func() error) error {
+	result := make(chan error, 1)
+	v.jobs <- verifyJob{check: check, result: result}
+	return <-result
+}